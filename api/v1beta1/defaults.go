@@ -35,4 +35,25 @@ const (
 
 	//DefaultMaxSize The default max size for report files
 	DefaultMaxSize int64 = PackagingMaxSize
+
+	//DefaultMaxBackfillHours The default number of past hours to collect
+	DefaultMaxBackfillHours int64 = BackfillHours
+
+	//DefaultQueryParallelism The default number of concurrent Prometheus queries
+	DefaultQueryParallelism int64 = QueryParallelism
+
+	//DefaultCollectionInterval The default number of minutes in a report interval
+	DefaultCollectionInterval int64 = CollectionInterval
+
+	//DefaultQueryStep The default number of seconds between Prometheus samples
+	DefaultQueryStep int64 = QueryStep
+
+	//DefaultMaxRowsInMemory The default number of rows of a query set kept in memory
+	DefaultMaxRowsInMemory int64 = RowsInMemory
+
+	//DefaultSettleDelay The default number of minutes an interval must have ended before it is collected
+	DefaultSettleDelay int64 = SettleDelay
+
+	//DefaultRecollectHours The default number of collected hours that are collected again
+	DefaultRecollectHours int64 = RecollectHours
 )
@@ -38,6 +38,27 @@ const (
 
 	//PackagingMaxSize sets the default max file size to be 100 MB
 	PackagingMaxSize int64 = 100
+
+	//BackfillHours sets the default number of past hours to collect to be 24 hours.
+	BackfillHours int64 = 24
+
+	//QueryParallelism sets the default number of concurrent Prometheus queries to be 4.
+	QueryParallelism int64 = 4
+
+	//CollectionInterval sets the default length of a report interval to be 60 minutes.
+	CollectionInterval int64 = 60
+
+	//QueryStep sets the default resolution of the Prometheus samples to be 60 seconds.
+	QueryStep int64 = 60
+
+	//RowsInMemory sets the default number of rows of a query set kept in memory to be 50000.
+	RowsInMemory int64 = 50000
+
+	//SettleDelay sets the default wait after the end of an interval before it is collected to be 0 minutes.
+	SettleDelay int64 = 0
+
+	//RecollectHours sets the default number of collected hours that are collected again to be 0 hours.
+	RecollectHours int64 = 0
 )
 
 // AuthenticationType describes how the upload will be handled.
@@ -55,6 +76,96 @@ const (
 	Token AuthenticationType = "token"
 )
 
+// QueryModeType describes how the interval values are collected from Prometheus.
+// Only one of the following query modes may be specified.
+// If none of the following modes are specified, the default one
+// is range.
+// +kubebuilder:validation:Enum=range;instant;remote-read
+type QueryModeType string
+
+const (
+	// RangeQueryMode queries the samples of the interval and aggregates them in the operator.
+	RangeQueryMode QueryModeType = "range"
+
+	// InstantQueryMode aggregates the samples in Prometheus using `*_over_time` subqueries that are evaluated
+	// at the end of the interval.
+	InstantQueryMode QueryModeType = "instant"
+
+	// RemoteReadQueryMode reads the raw samples of the series selected by a query with the Prometheus remote read
+	// protocol and evaluates the query in the operator. Selectors, rate, sum/max/min/avg by and `* on() group_left()`
+	// joins are evaluated, which covers all built-in queries. Custom queries that use any other PromQL remain range
+	// queries.
+	RemoteReadQueryMode QueryModeType = "remote-read"
+)
+
+// ReportSchemaType describes the layout of the generated reports.
+// Only one of the following report schemas may be specified.
+// If none of the following schemas are specified, the default one
+// is legacy.
+// +kubebuilder:validation:Enum=legacy;standalone-node
+type ReportSchemaType string
+
+const (
+	// LegacyReportSchema writes only the node labels to the node report. Node capacity is written to the pod report rows.
+	LegacyReportSchema ReportSchemaType = "legacy"
+
+	// StandaloneNodeReportSchema also writes the node capacity, allocatable, resource_id and provider_id columns to the
+	// node report. The pod report is unchanged.
+	StandaloneNodeReportSchema ReportSchemaType = "standalone-node"
+)
+
+// MetricsSourceType describes where the report metrics are collected from.
+// Only one of the following metrics sources may be specified.
+// If none of the following sources are specified, the default one
+// is prometheus.
+// +kubebuilder:validation:Enum=prometheus;kubelet
+type MetricsSourceType string
+
+const (
+	// PrometheusMetricsSource queries the report metrics from Prometheus.
+	PrometheusMetricsSource MetricsSourceType = "prometheus"
+
+	// KubeletMetricsSource samples the Kubernetes metrics API and the kubelet summary API. Only the node, pod, storage
+	// and namespace reports contain data.
+	KubeletMetricsSource MetricsSourceType = "kubelet"
+)
+
+// AggregationLevelType describes the level of detail of the packaged reports.
+// Only one of the following aggregation levels may be specified.
+// If none of the following levels are specified, the default one
+// is pod.
+// +kubebuilder:validation:Enum=pod;namespace
+type AggregationLevelType string
+
+const (
+	// PodAggregationLevel packages the reports with one row per pod, container or persistentvolumeclaim and interval.
+	PodAggregationLevel AggregationLevelType = "pod"
+
+	// NamespaceAggregationLevel rolls the pod, container, extended resource, network and storage reports up to one row
+	// per namespace, node and interval before they are packaged. Storage rows have no node and are grouped by
+	// storage class instead. Custom reports are not packaged.
+	NamespaceAggregationLevel AggregationLevelType = "namespace"
+)
+
+// LabelRedactionType describes how the labels that are not allowed are written to the reports.
+// Only one of the following redactions may be specified.
+// If none of the following redactions are specified, the default one
+// is drop.
+// +kubebuilder:validation:Enum=drop;hash;mask
+type LabelRedactionType string
+
+const (
+	// DropLabelRedaction removes the label from the reports.
+	DropLabelRedaction LabelRedactionType = "drop"
+
+	// HashLabelRedaction replaces the label value with a hash salted with a per-cluster secret, so that rows with the
+	// same value can still be grouped.
+	HashLabelRedaction LabelRedactionType = "hash"
+
+	// MaskLabelRedaction replaces the label value with a fixed mask.
+	MaskLabelRedaction LabelRedactionType = "mask"
+)
+
 // EmbeddedObjectMetadata contains a subset of the fields included in k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta
 // Only fields which are relevant to embedded resources are included.
 type EmbeddedObjectMetadata struct {
@@ -126,6 +237,17 @@ type PackagingSpec struct {
 	// +kubebuilder:validation:Minimum=1
 	// +kubebuilder:default=30
 	MaxReports int64 `json:"max_reports_to_store"`
+
+	// AggregationLevel is a field of KokuMetricsConfig to represent the level of detail of the packaged reports. The
+	// level is declared in the manifest.
+	// Valid values are:
+	// - "pod" (default): The reports are packaged as they are written.
+	// - "namespace": The pod, container, extended resource, network and storage reports are summed per namespace,
+	// node and interval. Pod, container, volume and label columns are left empty. Custom reports have no rollup, so
+	// they are neither collected nor packaged.
+	// +kubebuilder:default="pod"
+	// +optional
+	AggregationLevel AggregationLevelType `json:"aggregation_level,omitempty"`
 }
 
 // UploadSpec defines the desired state of Authentication object in the KokuMetricsConfigSpec.
@@ -173,6 +295,198 @@ type PrometheusSpec struct {
 	// The default is false.
 	// +kubebuilder:default=false
 	SkipTLSVerification *bool `json:"skip_tls_verification"`
+
+	// MaxBackfillHours is a field of KokuMetricsConfig to represent the maximum number of past hours that will be
+	// collected when hours were missed, for example because the operator or Prometheus was unavailable.
+	// The default is 24.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=24
+	MaxBackfillHours *int64 `json:"max_backfill_hours,omitempty"`
+
+	// QueryParallelism is a field of KokuMetricsConfig to represent the maximum number of Prometheus queries that are run
+	// concurrently. A value of 1 runs the queries sequentially.
+	// The default is 4.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=32
+	// +kubebuilder:default=4
+	QueryParallelism *int64 `json:"query_parallelism,omitempty"`
+
+	// QueryMode is a field of KokuMetricsConfig to represent how the interval values are collected from Prometheus.
+	// Valid values are:
+	// - "range" (default): Queries the samples of the interval and aggregates them in the operator.
+	// - "instant": Aggregates the samples in Prometheus with `*_over_time` and `count_over_time`
+	// subqueries. The values are the same as in range mode, but much less data is transferred.
+	// - "remote-read": Reads the raw samples of the series selected by each query from the remote_read_address and
+	// evaluates the query at each step in the operator. Selectors, rate, sum/max/min/avg by and `* on() group_left()`
+	// joins are evaluated, which covers all built-in queries. Custom queries that use any other PromQL remain range
+	// queries.
+	// +kubebuilder:default="range"
+	// +optional
+	QueryMode QueryModeType `json:"query_mode,omitempty"`
+
+	// RemoteReadAddress is a field of KokuMetricsConfig to represent the Prometheus remote read endpoint used by the
+	// remote-read query mode. The remote read API is served by Prometheus, not by thanos-querier.
+	// The default is the service_address followed by `/api/v1/read`.
+	// +optional
+	RemoteReadAddress string `json:"remote_read_address,omitempty"`
+
+	// CollectionIntervalMinutes is a field of KokuMetricsConfig to represent the length of the interval covered by
+	// each report row. The intervals are aligned to the hour.
+	// The default is 60.
+	// +kubebuilder:validation:Enum=5;10;15;20;30;60
+	// +kubebuilder:default=60
+	CollectionIntervalMinutes *int64 `json:"collection_interval_minutes,omitempty"`
+
+	// QueryStepSeconds is a field of KokuMetricsConfig to represent the resolution of the Prometheus samples within
+	// an interval. The transformed `-seconds` values are computed from the samples at this resolution.
+	// The default is 60.
+	// +kubebuilder:validation:Enum=15;30;60
+	// +kubebuilder:default=60
+	QueryStepSeconds *int64 `json:"query_step_seconds,omitempty"`
+
+	// SettleDelayMinutes is a field of KokuMetricsConfig to represent how long an interval must have ended before it is
+	// collected, so that late scrapes and the compaction of the samples have settled.
+	// The default is 0.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=0
+	SettleDelayMinutes *int64 `json:"settle_delay_minutes,omitempty"`
+
+	// RecollectHours is a field of KokuMetricsConfig to represent the number of already collected hours that are
+	// collected again whenever a new interval is collected. The re-collected rows replace the rows written earlier, so
+	// that samples which arrived late are captured.
+	// The default is 0.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=0
+	RecollectHours *int64 `json:"recollect_hours,omitempty"`
+
+	// Headers is a field of KokuMetricsConfig to represent the HTTP headers added to every Prometheus request, for
+	// example the `X-Scope-OrgID` tenant header of Grafana Mimir or Cortex.
+	// +optional
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// QueryParameters is a field of KokuMetricsConfig to represent the URL query parameters added to every Prometheus
+	// request, for example the `namespace` parameter of the thanos-querier tenancy port.
+	// +optional
+	QueryParameters map[string]string `json:"query_parameters,omitempty"`
+
+	// CredentialsSecretName is a field of KokuMetricsConfig to represent the secret in the operator namespace with
+	// the Prometheus credentials. The secret holds either a `token` for bearer auth, or a `username` and `password`
+	// for basic auth. The credentials replace the service account token.
+	// +optional
+	CredentialsSecretName string `json:"credentials_secret_name,omitempty"`
+
+	// ClientCertSecretName is a field of KokuMetricsConfig to represent the secret in the operator namespace with the
+	// client certificate for Prometheus endpoints that require mTLS. The secret holds `tls.crt` and `tls.key`, as in
+	// a `kubernetes.io/tls` secret. Changes are picked up at the next reconcile.
+	// +optional
+	ClientCertSecretName string `json:"client_cert_secret_name,omitempty"`
+
+	// CABundleConfigMapName is a field of KokuMetricsConfig to represent the configmap in the operator namespace with
+	// the `ca-bundle.crt` used to verify the Prometheus certificate, instead of the service CA. Changes are picked up at
+	// the next reconcile.
+	// +optional
+	CABundleConfigMapName string `json:"ca_bundle_configmap_name,omitempty"`
+}
+
+// CustomQuerySpec defines a Prometheus query whose results are written to a custom report. The report_period_start,
+// report_period_end, interval_start and interval_end columns are written to every row, so no query may use them.
+type CustomQuerySpec struct {
+
+	// Name is a field of CustomQuerySpec to represent the name of the query. If a method is set, the aggregated value
+	// of the query is written to a column with this name.
+	Name string `json:"name"`
+
+	// Query is a field of CustomQuerySpec to represent the PromQL query.
+	Query string `json:"query"`
+
+	// RowKey is a field of CustomQuerySpec to represent the labels used to group query results into report rows.
+	// Each distinct combination of the label values, for example namespace and pod, is written to its own row.
+	// +kubebuilder:validation:MinItems=1
+	RowKey []string `json:"row_key"`
+
+	// StaticFields is a field of CustomQuerySpec to represent a map of report columns to the label whose value is written to the column.
+	// +optional
+	StaticFields map[string]string `json:"static_fields,omitempty"`
+
+	// RegexFields is a field of CustomQuerySpec to represent a map of report columns to a regular expression.
+	// All labels matching the expression are written to the column as `label:value` pairs separated by `|`.
+	// +optional
+	RegexFields map[string]string `json:"regex_fields,omitempty"`
+
+	// Method is a field of CustomQuerySpec to represent how the query samples are aggregated over the hour.
+	// Valid values are sum, max, min, avg, last and the percentiles p50, p95 and p99.
+	// If no method is set, only the static and regex fields are written.
+	// +kubebuilder:validation:Enum=sum;max;min;avg;last;p50;p95;p99
+	// +optional
+	Method string `json:"method,omitempty"`
+
+	// TransformedName is a field of CustomQuerySpec to represent the column for the aggregated value converted to a per-second
+	// value, for example core-seconds or byte-seconds.
+	// +optional
+	TransformedName string `json:"transformed_name,omitempty"`
+}
+
+// CustomQuerySetSpec defines a set of queries that are written to their own report.
+type CustomQuerySetSpec struct {
+
+	// Name is a field of CustomQuerySetSpec to represent the name of the report. The report is written to `cm-openshift-<name>-usage-YYYYMM.csv`.
+	// The name may not be the name of a built-in report (node, pod, container, extended-resource, network, storage,
+	// namespace, resourcequota or limitrange), or start with a built-in name followed by -usage, such as pod-usage.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Queries is a field of CustomQuerySetSpec to represent the queries whose results are combined into the report rows.
+	// +kubebuilder:validation:MinItems=1
+	Queries []CustomQuerySpec `json:"queries"`
+}
+
+// NamespaceFilterSpec defines which namespaces are written to the reports.
+type NamespaceFilterSpec struct {
+
+	// Include is a field of NamespaceFilterSpec to represent regular expressions of the namespaces to report. The
+	// expressions must match the whole namespace name. When include or include_selector is set, only the matching
+	// namespaces are reported.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude is a field of NamespaceFilterSpec to represent regular expressions of the namespaces that are not
+	// reported, for example `openshift-.*`. Exclusions take precedence over inclusions.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// IncludeSelector is a field of NamespaceFilterSpec to represent a label selector of the namespaces to report.
+	// The namespace labels are the `kube_namespace_labels` written to the namespace report.
+	// +optional
+	IncludeSelector *metav1.LabelSelector `json:"include_selector,omitempty"`
+
+	// ExcludeSelector is a field of NamespaceFilterSpec to represent a label selector of the namespaces that are not
+	// reported.
+	// +optional
+	ExcludeSelector *metav1.LabelSelector `json:"exclude_selector,omitempty"`
+}
+
+// LabelPolicySpec defines which labels are written to the reports verbatim.
+type LabelPolicySpec struct {
+
+	// Allow is a field of LabelPolicySpec to represent regular expressions of the label names written verbatim. The
+	// names are matched as they appear in the reports without the `label_` prefix, for example `app_kubernetes_io_.*`,
+	// and the expressions must match the whole name. When allow is set, all other labels are redacted.
+	// +optional
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny is a field of LabelPolicySpec to represent regular expressions of the label names that are redacted.
+	// Denied labels are redacted even when they are allowed.
+	// +optional
+	Deny []string `json:"deny,omitempty"`
+
+	// Redaction is a field of LabelPolicySpec to represent how the redacted labels are written.
+	// Valid values are:
+	// - "drop" (default): The label is removed.
+	// - "hash": The value is replaced with a hash salted with a secret that the operator creates for the cluster.
+	// - "mask": The value is replaced with `********`.
+	// +kubebuilder:default="drop"
+	// +optional
+	Redaction LabelRedactionType `json:"redaction,omitempty"`
 }
 
 // CloudDotRedHatSourceSpec defines the desired state of CloudDotRedHatSource object in the KokuMetricsConfigSpec.
@@ -229,6 +543,59 @@ type KokuMetricsConfigSpec struct {
 	// Source is a field of KokuMetricsConfig to represent the desired source on cloud.redhat.com.
 	Source CloudDotRedHatSourceSpec `json:"source"`
 
+	// ReportSchema is a field of KokuMetricsConfig to represent the layout of the generated reports.
+	// Valid values are:
+	// - "legacy" (default): The node report contains the node labels. Node capacity is only written to the pod report.
+	// - "standalone-node": The node report contains one row per node with capacity, allocatable, resource_id and provider_id.
+	// +kubebuilder:default="legacy"
+	// +optional
+	ReportSchema ReportSchemaType `json:"report_schema,omitempty"`
+
+	// MetricsSource is a field of KokuMetricsConfig to represent where the report metrics are collected from.
+	// Valid values are:
+	// - "prometheus" (default): Queries Prometheus using the prometheus_config.
+	// - "kubelet": Samples the Kubernetes metrics API and the kubelet summary API of every node every
+	// query_step_seconds. Only the node, pod, storage and namespace reports contain data. The samples are kept for two
+	// hours, so missed and re-collected intervals are limited to the last two hours, and intervals from before the
+	// operator started cannot be collected.
+	// +kubebuilder:default="prometheus"
+	// +optional
+	MetricsSource MetricsSourceType `json:"metrics_source,omitempty"`
+
+	// CustomQueries is a field of KokuMetricsConfig to represent user-defined query sets that produce additional reports.
+	// +optional
+	CustomQueries []CustomQuerySetSpec `json:"custom_queries,omitempty"`
+
+	// NamespaceFilter is a field of KokuMetricsConfig to represent the namespaces written to the reports. The rows of
+	// filtered namespaces are dropped from every report with a namespace column. Node rows are not filtered.
+	// +optional
+	NamespaceFilter NamespaceFilterSpec `json:"namespace_filter,omitempty"`
+
+	// LabelPolicy is a field of KokuMetricsConfig to represent the pod, node, namespace, persistentvolume and
+	// persistentvolumeclaim labels that are written to the reports. All labels are written when it is not set.
+	// +optional
+	LabelPolicy LabelPolicySpec `json:"label_policy,omitempty"`
+
+	// AnonymizeIdentifiers is a field of KokuMetricsConfig to represent if the namespace, pod, node,
+	// persistentvolumeclaim and persistentvolume names and the resource and provider IDs in the reports are replaced
+	// with hashes salted with a secret that the operator creates for the cluster. The values of the hostname, namespace
+	// name and statefulset pod name labels, and of any label that equals an identifier of the row, are replaced too.
+	// The names of the hashes are kept in `anonymization-map.csv` in the root of the operator volume, which is never
+	// uploaded.
+	// The default is false.
+	// +kubebuilder:default=false
+	// +optional
+	AnonymizeIdentifiers *bool `json:"anonymize_identifiers,omitempty"`
+
+	// MaxRowsInMemory is a field of KokuMetricsConfig to represent the maximum number of rows of a report that are kept
+	// in memory while the query results are merged. Larger results are spilled to partitions on the operator volume and
+	// written one partition at a time. A value of 0 never spills.
+	// The default is 50000.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=50000
+	// +optional
+	MaxRowsInMemory *int64 `json:"max_rows_in_memory,omitempty"`
+
 	// VolumeClaimTemplate is a field of KokuMetricsConfig to represent a PVC template.
 	VolumeClaimTemplate *EmbeddedPersistentVolumeClaim `json:"volume_claim_template,omitempty"`
 }
@@ -277,6 +644,9 @@ type PackagingStatus struct {
 
 	// ReportCount is a field of KokuMetricsConfig to represent the number of reports in storage.
 	ReportCount *int64 `json:"number_reports_stored,omitempty"`
+
+	// AggregationLevel is a field of KokuMetricsConfig to represent the level of detail of the packaged reports.
+	AggregationLevel AggregationLevelType `json:"aggregation_level,omitempty"`
 }
 
 // UploadStatus defines the observed state of Upload object in the KokuMetricsConfigStatus.
@@ -368,11 +738,54 @@ type PrometheusStatus struct {
 	// +nullable
 	LastQuerySuccessTime metav1.Time `json:"last_query_success_time,omitempty"`
 
+	// CollectedThrough is a field of KokuMetricsConfigStatus to represent the end of the most recent hour for which reports were generated.
+	// +nullable
+	CollectedThrough metav1.Time `json:"collected_through,omitempty"`
+
 	// SvcAddress is the internal thanos-querier address.
 	SvcAddress string `json:"service_address,omitempty"`
 
 	// SkipTLSVerification is a field of KokuMetricsConfigStatus to represent if the thanos-querier endpoint must be certificate validated.
 	SkipTLSVerification *bool `json:"skip_tls_verification,omitempty"`
+
+	// MaxBackfillHours is a field of KokuMetricsConfigStatus to represent the maximum number of missed past hours that are collected.
+	MaxBackfillHours *int64 `json:"max_backfill_hours,omitempty"`
+
+	// QueryParallelism is a field of KokuMetricsConfigStatus to represent the maximum number of concurrent Prometheus queries.
+	QueryParallelism *int64 `json:"query_parallelism,omitempty"`
+
+	// QueryMode is a field of KokuMetricsConfigStatus to represent how the interval values are collected from Prometheus.
+	QueryMode QueryModeType `json:"query_mode,omitempty"`
+
+	// RemoteReadAddress is a field of KokuMetricsConfigStatus to represent the Prometheus remote read endpoint.
+	RemoteReadAddress string `json:"remote_read_address,omitempty"`
+
+	// CollectionIntervalMinutes is a field of KokuMetricsConfigStatus to represent the length of the interval covered by each report row.
+	CollectionIntervalMinutes *int64 `json:"collection_interval_minutes,omitempty"`
+
+	// QueryStepSeconds is a field of KokuMetricsConfigStatus to represent the resolution of the Prometheus samples within an interval.
+	QueryStepSeconds *int64 `json:"query_step_seconds,omitempty"`
+
+	// SettleDelayMinutes is a field of KokuMetricsConfigStatus to represent how long an interval must have ended before it is collected.
+	SettleDelayMinutes *int64 `json:"settle_delay_minutes,omitempty"`
+
+	// RecollectHours is a field of KokuMetricsConfigStatus to represent the number of collected hours that are collected again.
+	RecollectHours *int64 `json:"recollect_hours,omitempty"`
+
+	// Headers is a field of KokuMetricsConfigStatus to represent the HTTP headers added to every Prometheus request.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// QueryParameters is a field of KokuMetricsConfigStatus to represent the URL query parameters added to every Prometheus request.
+	QueryParameters map[string]string `json:"query_parameters,omitempty"`
+
+	// CredentialsSecretName is a field of KokuMetricsConfigStatus to represent the secret with the Prometheus credentials.
+	CredentialsSecretName string `json:"credentials_secret_name,omitempty"`
+
+	// ClientCertSecretName is a field of KokuMetricsConfigStatus to represent the secret with the Prometheus client certificate.
+	ClientCertSecretName string `json:"client_cert_secret_name,omitempty"`
+
+	// CABundleConfigMapName is a field of KokuMetricsConfigStatus to represent the configmap with the Prometheus CA bundle.
+	CABundleConfigMapName string `json:"ca_bundle_configmap_name,omitempty"`
 }
 
 // ReportsStatus defines the status for generating reports.
@@ -389,6 +802,14 @@ type ReportsStatus struct {
 
 	// DataCollectionMessage is a field of KokuMetricsConfigStatus to represent a message associated with the data_collected status.
 	DataCollectionMessage string `json:"data_collection_message,omitempty"`
+
+	// QueryRangeSplits is a field of KokuMetricsConfigStatus to represent the number of times a query time range was split into
+	// smaller ranges because Prometheus rejected the query or it timed out, for the last hour queried.
+	QueryRangeSplits int64 `json:"query_range_splits,omitempty"`
+
+	// SpilledRows is a field of KokuMetricsConfigStatus to represent the number of rows that were spilled to disk
+	// because a report had more than max_rows_in_memory rows, for the last hour queried.
+	SpilledRows int64 `json:"spilled_rows,omitempty"`
 }
 
 // StorageStatus defines the status for storage.
@@ -438,6 +859,30 @@ type KokuMetricsConfigStatus struct {
 	// Storage is a field
 	Storage StorageStatus `json:"storage,omitempty"`
 
+	// ReportSchema is a field of KokuMetricsConfigStatus to represent the layout of the generated reports.
+	ReportSchema ReportSchemaType `json:"report_schema,omitempty"`
+
+	// MetricsSource is a field of KokuMetricsConfigStatus to represent where the report metrics are collected from.
+	MetricsSource MetricsSourceType `json:"metrics_source,omitempty"`
+
+	// CustomQueries is a field of KokuMetricsConfigStatus to represent the user-defined query sets.
+	// +optional
+	CustomQueries []CustomQuerySetSpec `json:"custom_queries,omitempty"`
+
+	// NamespaceFilter is a field of KokuMetricsConfigStatus to represent the namespaces written to the reports.
+	// +optional
+	NamespaceFilter NamespaceFilterSpec `json:"namespace_filter,omitempty"`
+
+	// LabelPolicy is a field of KokuMetricsConfigStatus to represent the labels that are written to the reports verbatim.
+	// +optional
+	LabelPolicy LabelPolicySpec `json:"label_policy,omitempty"`
+
+	// AnonymizeIdentifiers is a field of KokuMetricsConfigStatus to represent if the identifiers in the reports are replaced with hashes.
+	AnonymizeIdentifiers *bool `json:"anonymize_identifiers,omitempty"`
+
+	// MaxRowsInMemory is a field of KokuMetricsConfigStatus to represent the maximum number of rows of a report kept in memory.
+	MaxRowsInMemory *int64 `json:"max_rows_in_memory,omitempty"`
+
 	// PersistentVolumeClaim is a field of KokuMetricsConfig to represent a PVC.
 	PersistentVolumeClaim *EmbeddedPersistentVolumeClaim `json:"persistent_volume_claim,omitempty"`
 }
@@ -10,6 +10,7 @@
 package v1beta1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -113,6 +114,62 @@ func (in *CloudDotRedHatSourceStatus) DeepCopy() *CloudDotRedHatSourceStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomQuerySetSpec) DeepCopyInto(out *CustomQuerySetSpec) {
+	*out = *in
+	if in.Queries != nil {
+		in, out := &in.Queries, &out.Queries
+		*out = make([]CustomQuerySpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomQuerySetSpec.
+func (in *CustomQuerySetSpec) DeepCopy() *CustomQuerySetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomQuerySetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomQuerySpec) DeepCopyInto(out *CustomQuerySpec) {
+	*out = *in
+	if in.RowKey != nil {
+		in, out := &in.RowKey, &out.RowKey
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StaticFields != nil {
+		in, out := &in.StaticFields, &out.StaticFields
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.RegexFields != nil {
+		in, out := &in.RegexFields, &out.RegexFields
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomQuerySpec.
+func (in *CustomQuerySpec) DeepCopy() *CustomQuerySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomQuerySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *EmbeddedObjectMetadata) DeepCopyInto(out *EmbeddedObjectMetadata) {
 	*out = *in
@@ -227,6 +284,25 @@ func (in *KokuMetricsConfigSpec) DeepCopyInto(out *KokuMetricsConfigSpec) {
 	in.Upload.DeepCopyInto(&out.Upload)
 	in.PrometheusConfig.DeepCopyInto(&out.PrometheusConfig)
 	in.Source.DeepCopyInto(&out.Source)
+	if in.CustomQueries != nil {
+		in, out := &in.CustomQueries, &out.CustomQueries
+		*out = make([]CustomQuerySetSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.NamespaceFilter.DeepCopyInto(&out.NamespaceFilter)
+	in.LabelPolicy.DeepCopyInto(&out.LabelPolicy)
+	if in.AnonymizeIdentifiers != nil {
+		in, out := &in.AnonymizeIdentifiers, &out.AnonymizeIdentifiers
+		*out = new(bool)
+		**out = **in
+	}
+	if in.MaxRowsInMemory != nil {
+		in, out := &in.MaxRowsInMemory, &out.MaxRowsInMemory
+		*out = new(int64)
+		**out = **in
+	}
 	if in.VolumeClaimTemplate != nil {
 		in, out := &in.VolumeClaimTemplate, &out.VolumeClaimTemplate
 		*out = new(EmbeddedPersistentVolumeClaim)
@@ -254,6 +330,25 @@ func (in *KokuMetricsConfigStatus) DeepCopyInto(out *KokuMetricsConfigStatus) {
 	out.Reports = in.Reports
 	in.Source.DeepCopyInto(&out.Source)
 	out.Storage = in.Storage
+	if in.CustomQueries != nil {
+		in, out := &in.CustomQueries, &out.CustomQueries
+		*out = make([]CustomQuerySetSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.NamespaceFilter.DeepCopyInto(&out.NamespaceFilter)
+	in.LabelPolicy.DeepCopyInto(&out.LabelPolicy)
+	if in.AnonymizeIdentifiers != nil {
+		in, out := &in.AnonymizeIdentifiers, &out.AnonymizeIdentifiers
+		*out = new(bool)
+		**out = **in
+	}
+	if in.MaxRowsInMemory != nil {
+		in, out := &in.MaxRowsInMemory, &out.MaxRowsInMemory
+		*out = new(int64)
+		**out = **in
+	}
 	if in.PersistentVolumeClaim != nil {
 		in, out := &in.PersistentVolumeClaim, &out.PersistentVolumeClaim
 		*out = new(EmbeddedPersistentVolumeClaim)
@@ -271,6 +366,66 @@ func (in *KokuMetricsConfigStatus) DeepCopy() *KokuMetricsConfigStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LabelPolicySpec) DeepCopyInto(out *LabelPolicySpec) {
+	*out = *in
+	if in.Allow != nil {
+		in, out := &in.Allow, &out.Allow
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Deny != nil {
+		in, out := &in.Deny, &out.Deny
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LabelPolicySpec.
+func (in *LabelPolicySpec) DeepCopy() *LabelPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(LabelPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamespaceFilterSpec) DeepCopyInto(out *NamespaceFilterSpec) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IncludeSelector != nil {
+		in, out := &in.IncludeSelector, &out.IncludeSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExcludeSelector != nil {
+		in, out := &in.ExcludeSelector, &out.ExcludeSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespaceFilterSpec.
+func (in *NamespaceFilterSpec) DeepCopy() *NamespaceFilterSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespaceFilterSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PackagingSpec) DeepCopyInto(out *PackagingSpec) {
 	*out = *in
@@ -330,6 +485,50 @@ func (in *PrometheusSpec) DeepCopyInto(out *PrometheusSpec) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.MaxBackfillHours != nil {
+		in, out := &in.MaxBackfillHours, &out.MaxBackfillHours
+		*out = new(int64)
+		**out = **in
+	}
+	if in.QueryParallelism != nil {
+		in, out := &in.QueryParallelism, &out.QueryParallelism
+		*out = new(int64)
+		**out = **in
+	}
+	if in.CollectionIntervalMinutes != nil {
+		in, out := &in.CollectionIntervalMinutes, &out.CollectionIntervalMinutes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.QueryStepSeconds != nil {
+		in, out := &in.QueryStepSeconds, &out.QueryStepSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.SettleDelayMinutes != nil {
+		in, out := &in.SettleDelayMinutes, &out.SettleDelayMinutes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.RecollectHours != nil {
+		in, out := &in.RecollectHours, &out.RecollectHours
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.QueryParameters != nil {
+		in, out := &in.QueryParameters, &out.QueryParameters
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusSpec.
@@ -347,11 +546,56 @@ func (in *PrometheusStatus) DeepCopyInto(out *PrometheusStatus) {
 	*out = *in
 	in.LastQueryStartTime.DeepCopyInto(&out.LastQueryStartTime)
 	in.LastQuerySuccessTime.DeepCopyInto(&out.LastQuerySuccessTime)
+	in.CollectedThrough.DeepCopyInto(&out.CollectedThrough)
 	if in.SkipTLSVerification != nil {
 		in, out := &in.SkipTLSVerification, &out.SkipTLSVerification
 		*out = new(bool)
 		**out = **in
 	}
+	if in.MaxBackfillHours != nil {
+		in, out := &in.MaxBackfillHours, &out.MaxBackfillHours
+		*out = new(int64)
+		**out = **in
+	}
+	if in.QueryParallelism != nil {
+		in, out := &in.QueryParallelism, &out.QueryParallelism
+		*out = new(int64)
+		**out = **in
+	}
+	if in.CollectionIntervalMinutes != nil {
+		in, out := &in.CollectionIntervalMinutes, &out.CollectionIntervalMinutes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.QueryStepSeconds != nil {
+		in, out := &in.QueryStepSeconds, &out.QueryStepSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.SettleDelayMinutes != nil {
+		in, out := &in.SettleDelayMinutes, &out.SettleDelayMinutes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.RecollectHours != nil {
+		in, out := &in.RecollectHours, &out.RecollectHours
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.QueryParameters != nil {
+		in, out := &in.QueryParameters, &out.QueryParameters
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusStatus.
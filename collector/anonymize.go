@@ -0,0 +1,150 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/project-koku/koku-metrics-operator/strset"
+)
+
+var (
+	// identifierColumns are the report columns with the workload identifiers that are pseudonymised. The resource and
+	// provider IDs contain the node name on some platforms, for example GCE and vSphere.
+	identifierColumns = map[string]bool{
+		"namespace":             true,
+		"pod":                   true,
+		"node":                  true,
+		"persistentvolumeclaim": true,
+		"persistentvolume":      true,
+		"resource_id":           true,
+		"provider_id":           true,
+	}
+
+	// identifierLabels are the labels whose values are workload identifiers. Their values are pseudonymised in the
+	// label columns, as are the values of any label that equals an identifier of the row.
+	identifierLabels = map[string]bool{
+		"label_kubernetes_io_hostname":             true,
+		"label_kubernetes_io_metadata_name":        true,
+		"label_statefulset_kubernetes_io_pod_name": true,
+	}
+
+	// anonymizationMapFile maps the hashes back to the identifiers. It is written to the parent directory, which is
+	// never packaged or uploaded.
+	anonymizationMapFile    = "anonymization-map.csv"
+	anonymizationMapHeaders = []string{"hash", "value"}
+)
+
+// anonymizer replaces the identifiers in the report rows with salted hashes and records the hashes in the map file.
+type anonymizer struct {
+	salt    []byte
+	path    string
+	known   *strset.Set
+	pending [][]string
+}
+
+// newAnonymizer reads the hashes that are already in the map file, so that each identifier is only recorded once.
+func newAnonymizer(salt []byte, dir string) (*anonymizer, error) {
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("anonymization requires a salt")
+	}
+	a := &anonymizer{salt: salt, path: filepath.Join(dir, anonymizationMapFile), known: strset.NewSet()}
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open anonymization map: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read anonymization map: %v", err)
+	}
+	for i, record := range records {
+		if i > 0 && len(record) > 0 {
+			a.known.Add(record[0])
+		}
+	}
+	return a, nil
+}
+
+// anonymizeRow returns a copy of the row values with the identifier columns replaced by their hashes. In the label
+// columns, the values of the identifier labels and of the labels that equal an identifier of the row are replaced too.
+func (a *anonymizer) anonymizeRow(headers, values []string) []string {
+	result := make([]string, len(values))
+	copy(result, values)
+	identifiers := map[string]bool{}
+	for i, header := range headers {
+		if i >= len(result) || !identifierColumns[header] || result[i] == "" {
+			continue
+		}
+		identifiers[result[i]] = true
+		result[i] = a.hash(result[i])
+	}
+	for i, header := range headers {
+		if i < len(result) && strings.HasSuffix(header, "_labels") && result[i] != "" {
+			result[i] = a.anonymizeLabels(result[i], identifiers)
+		}
+	}
+	return result
+}
+
+// anonymizeLabels replaces the identifier values in a label column, whose labels are written as `name:value` pairs
+// separated by `|`.
+func (a *anonymizer) anonymizeLabels(column string, identifiers map[string]bool) string {
+	pairs := strings.Split(column, "|")
+	for i, pair := range pairs {
+		sep := strings.Index(pair, ":")
+		if sep < 0 {
+			continue
+		}
+		name, value := pair[:sep], pair[sep+1:]
+		if value != "" && (identifierLabels[name] || identifiers[value]) {
+			pairs[i] = name + ":" + a.hash(value)
+		}
+	}
+	return strings.Join(pairs, "|")
+}
+
+// hash returns the hash of an identifier and records it for the map file.
+func (a *anonymizer) hash(value string) string {
+	hash := hashValue(a.salt, value)
+	if !a.known.Contains(hash) {
+		a.known.Add(hash)
+		a.pending = append(a.pending, []string{hash, value})
+	}
+	return hash
+}
+
+// flush appends the hashes recorded since the last flush to the map file.
+func (a *anonymizer) flush() error {
+	if len(a.pending) == 0 {
+		return nil
+	}
+	_, err := os.Stat(a.path)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open anonymization map: %v", err)
+	}
+	defer f.Close()
+	cw := csv.NewWriter(f)
+	if created {
+		if err := cw.Write(anonymizationMapHeaders); err != nil {
+			return fmt.Errorf("failed to write anonymization map: %v", err)
+		}
+	}
+	if err := cw.WriteAll(a.pending); err != nil {
+		return fmt.Errorf("failed to write anonymization map: %v", err)
+	}
+	a.pending = nil
+	return f.Sync()
+}
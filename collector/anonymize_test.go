@@ -0,0 +1,234 @@
+package collector
+
+import (
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+	"github.com/project-koku/koku-metrics-operator/strset"
+)
+
+func readAnonymizationMap(t *testing.T, dir string) [][]string {
+	f, err := os.Open(filepath.Join(dir, anonymizationMapFile))
+	if err != nil {
+		t.Fatalf("failed to open anonymization map: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read anonymization map: %v", err)
+	}
+	return records
+}
+
+func TestAnonymizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonymizer-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	salt := []byte("cluster-salt")
+
+	if _, err := newAnonymizer(nil, dir); err == nil {
+		t.Errorf("newAnonymizer without salt did not return an error")
+	}
+
+	a, err := newAnonymizer(salt, dir)
+	if err != nil {
+		t.Fatalf("newAnonymizer got unexpected error: %v", err)
+	}
+	headers := []string{"interval_start", "namespace", "pod", "node", "pod_labels"}
+	values := []string{"2020-11-06 18:00:00 +0000 UTC", "project", "web", "", "label_app:web|label_tier:frontend"}
+	got := a.anonymizeRow(headers, values)
+	want := []string{"2020-11-06 18:00:00 +0000 UTC", hashValue(salt, "project"), hashValue(salt, "web"), "", "label_app:" + hashValue(salt, "web") + "|label_tier:frontend"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("anonymizeRow got %v want %v", got, want)
+	}
+	if values[1] != "project" {
+		t.Errorf("anonymizeRow modified the row values")
+	}
+	if err := a.flush(); err != nil {
+		t.Fatalf("flush got unexpected error: %v", err)
+	}
+
+	// a new anonymizer only records the identifiers that are not in the map yet
+	a, err = newAnonymizer(salt, dir)
+	if err != nil {
+		t.Fatalf("newAnonymizer got unexpected error: %v", err)
+	}
+	a.anonymizeRow(headers, []string{"", "project", "db", "node-1", ""})
+	if err := a.flush(); err != nil {
+		t.Fatalf("flush got unexpected error: %v", err)
+	}
+	wantMap := [][]string{
+		anonymizationMapHeaders,
+		{hashValue(salt, "project"), "project"},
+		{hashValue(salt, "web"), "web"},
+		{hashValue(salt, "db"), "db"},
+		{hashValue(salt, "node-1"), "node-1"},
+	}
+	if got := readAnonymizationMap(t, dir); !reflect.DeepEqual(got, wantMap) {
+		t.Errorf("anonymization map got %v want %v", got, wantMap)
+	}
+}
+
+func TestGenerateReportsAnonymizeIdentifiers(t *testing.T) {
+	parentDir, err := ioutil.TempDir("", "anonymize-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: parentDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(parentDir, "data")},
+	}
+
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         newFakeKubeletClient(),
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), fakeTimeRange.Start); err != nil {
+		t.Fatalf("sample got unexpected error: %v", err)
+	}
+	salt := []byte("cluster-salt")
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.AnonymizeIdentifiers = &trueDef
+	if err := GenerateReports(kmCfg, dirCfg, col, nil); err == nil {
+		t.Errorf("GenerateReports without salt did not return an error")
+	}
+	// generating the reports twice writes neither duplicate rows nor duplicate map entries
+	for i := 0; i < 2; i++ {
+		if err := GenerateReports(kmCfg, dirCfg, col, salt); err != nil {
+			t.Fatalf("Failed to generate reports: %v", err)
+		}
+	}
+
+	yearMonth := fakeTimeRange.Start.Format("200601")
+	for _, prefix := range []string{nodeFilePrefix, podFilePrefix, volFilePrefix, namespaceFilePrefix} {
+		data, err := ioutil.ReadFile(filepath.Join(dirCfg.Reports.Path, prefix+yearMonth+".csv"))
+		if err != nil {
+			t.Fatalf("%s report was not generated: %v", prefix, err)
+		}
+		for _, name := range []string{"node-1,", "project,", ",web,", "pv-1"} {
+			if strings.Contains(string(data), name) {
+				t.Errorf("%s report contains the identifier %s:\n%s", prefix, name, data)
+			}
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 2 {
+			t.Errorf("%s report got %d lines want 2:\n%s", prefix, lines, data)
+		}
+	}
+	podReport, _ := ioutil.ReadFile(filepath.Join(dirCfg.Reports.Path, podFilePrefix+yearMonth+".csv"))
+	if !strings.Contains(string(podReport), hashValue(salt, "web")) {
+		t.Errorf("pod report does not contain the pod hash:\n%s", podReport)
+	}
+
+	got := map[string]string{}
+	for _, record := range readAnonymizationMap(t, parentDir)[1:] {
+		if _, ok := got[record[0]]; ok {
+			t.Errorf("anonymization map has a duplicate entry for %s", record[1])
+		}
+		got[record[0]] = record[1]
+	}
+	for _, name := range []string{"node-1", "project", "web", "data", "pv-1"} {
+		if got[hashValue(salt, name)] != name {
+			t.Errorf("anonymization map does not map %s: %v", name, got)
+		}
+	}
+}
+
+func TestAnonymizeLabels(t *testing.T) {
+	salt := []byte("cluster-salt")
+	a := &anonymizer{salt: salt, known: strset.NewSet()}
+	anonymizeLabelsTests := []struct {
+		name        string
+		column      string
+		identifiers map[string]bool
+		want        string
+	}{
+		{name: "no labels", column: "", want: ""},
+		{name: "other labels are kept", column: "label_app:shop|label_tier:web", want: "label_app:shop|label_tier:web"},
+		{
+			name:   "identifier labels are hashed",
+			column: "label_kubernetes_io_hostname:node-1|label_kubernetes_io_metadata_name:project|label_statefulset_kubernetes_io_pod_name:db-0",
+			want: "label_kubernetes_io_hostname:" + hashValue(salt, "node-1") +
+				"|label_kubernetes_io_metadata_name:" + hashValue(salt, "project") +
+				"|label_statefulset_kubernetes_io_pod_name:" + hashValue(salt, "db-0"),
+		},
+		{
+			name:        "labels with the value of an identifier are hashed",
+			column:      "label_app:db-0|label_tier:db",
+			identifiers: map[string]bool{"db-0": true},
+			want:        "label_app:" + hashValue(salt, "db-0") + "|label_tier:db",
+		},
+	}
+	for _, tt := range anonymizeLabelsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.anonymizeLabels(tt.column, tt.identifiers); got != tt.want {
+				t.Errorf("%s got %s want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateReportsAnonymizeProviderIDAndLabels(t *testing.T) {
+	parentDir, err := ioutil.TempDir("", "anonymize-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: parentDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(parentDir, "data")},
+	}
+
+	// on GCE the provider ID and the resource ID contain the node name
+	client := newFakeKubeletClient()
+	client.nodes[0].Name = "gke-node-7"
+	client.nodes[0].Spec.ProviderID = "gce://shop-project/us-west1-a/gke-node-7"
+	for i := range client.pods {
+		client.pods[i].Spec.NodeName = "gke-node-7"
+	}
+	client.pods[0].Labels = map[string]string{"app": "web", "kubernetes.io/hostname": "gke-node-7"}
+	client.summaries = map[string]*statsSummary{"gke-node-7": client.summaries["node-1"]}
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         client,
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), fakeTimeRange.Start); err != nil {
+		t.Fatalf("sample got unexpected error: %v", err)
+	}
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.AnonymizeIdentifiers = &trueDef
+	if err := GenerateReports(kmCfg, dirCfg, col, []byte("cluster-salt")); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	yearMonth := fakeTimeRange.Start.Format("200601")
+	for _, prefix := range []string{nodeFilePrefix, podFilePrefix} {
+		data, err := ioutil.ReadFile(filepath.Join(dirCfg.Reports.Path, prefix+yearMonth+".csv"))
+		if err != nil {
+			t.Fatalf("%s report was not generated: %v", prefix, err)
+		}
+		if strings.Contains(string(data), "gke-node-7") {
+			t.Errorf("%s report contains the node name:\n%s", prefix, data)
+		}
+		if strings.Contains(string(data), ":web") {
+			t.Errorf("%s report contains the pod name in a label:\n%s", prefix, data)
+		}
+	}
+}
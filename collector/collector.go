@@ -7,27 +7,52 @@ package collector
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/go-logr/logr"
 	"github.com/mitchellh/mapstructure"
 	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
 	"github.com/project-koku/koku-metrics-operator/dirconfig"
 	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 var (
-	podFilePrefix       = "cm-openshift-pod-usage-"
-	volFilePrefix       = "cm-openshift-storage-usage-"
-	nodeFilePrefix      = "cm-openshift-node-usage-"
-	namespaceFilePrefix = "cm-openshift-namespace-usage-"
+	podFilePrefix        = "cm-openshift-pod-usage-"
+	containerFilePrefix  = "cm-openshift-container-usage-"
+	resourceFilePrefix   = "cm-openshift-extended-resource-usage-"
+	networkFilePrefix    = "cm-openshift-network-usage-"
+	volFilePrefix        = "cm-openshift-storage-usage-"
+	nodeFilePrefix       = "cm-openshift-node-usage-"
+	namespaceFilePrefix  = "cm-openshift-namespace-usage-"
+	quotaFilePrefix      = "cm-openshift-resourcequota-usage-"
+	limitRangeFilePrefix = "cm-openshift-limitrange-usage-"
+	customFileFormat     = "cm-openshift-%s-usage-"
+
+	// rowKeySeparator joins the label values of composite row keys. It cannot appear in namespace or pod names.
+	rowKeySeparator = "/"
 
 	statusTimeFormat = "2006-01-02 15:04:05"
 )
 
+// MetricsSource provides the metrics written to the reports. GenerateReports collects the results of the report query
+// sets for the time series of the source.
+type MetricsSource interface {
+	// SetTimeSeries sets the time range of the next collection.
+	SetTimeSeries(ts *promv1.Range)
+
+	getTimeSeries() *promv1.Range
+	getLogger() logr.Logger
+	getQuerySetsResults(sets ...querySetResults) error
+	resetRangeSplits()
+	getRangeSplits() int64
+}
+
 type mappedCSVStruct map[string]csvStruct
 type mappedResults map[string]mappedValues
 type mappedValues map[string]interface{}
@@ -55,14 +80,79 @@ func sumSlice(array []model.SamplePair) float64 {
 	return float64(sum)
 }
 
-func getValue(query *saveQueryValue, array []model.SamplePair) float64 {
+func minSlice(array []model.SamplePair) float64 {
+	min := array[0].Value
+	for _, v := range array {
+		if v.Value < min {
+			min = v.Value
+		}
+	}
+	return float64(min)
+}
+
+func avgSlice(array []model.SamplePair) float64 {
+	return sumSlice(array) / float64(len(array))
+}
+
+func lastSlice(array []model.SamplePair) float64 {
+	return float64(array[len(array)-1].Value)
+}
+
+// quantileSlice computes the q-quantile the same way as the PromQL quantile_over_time function,
+// interpolating linearly between the two closest ranks.
+func quantileSlice(q float64, array []model.SamplePair) float64 {
+	values := make([]float64, len(array))
+	for i, v := range array {
+		values[i] = float64(v.Value)
+	}
+	sort.Float64s(values)
+
+	rank := q * float64(len(values)-1)
+	lowerIndex := math.Max(0, math.Floor(rank))
+	upperIndex := math.Min(float64(len(values)-1), lowerIndex+1)
+	weight := rank - math.Floor(rank)
+	return values[int(lowerIndex)]*(1-weight) + values[int(upperIndex)]*weight
+}
+
+// quantileMethods maps the percentile aggregation methods to their quantile.
+var quantileMethods = map[string]float64{
+	"p50": 0.5,
+	"p95": 0.95,
+	"p99": 0.99,
+}
+
+// checkMethod returns an error if the aggregation method is not supported.
+func checkMethod(method string) error {
+	switch method {
+	case "sum", "max", "min", "avg", "last":
+		return nil
+	}
+	if _, ok := quantileMethods[method]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown aggregation method: %s", method)
+}
+
+func getValue(query *saveQueryValue, array []model.SamplePair) (float64, error) {
+	if err := checkMethod(query.Method); err != nil {
+		return 0, err
+	}
+	if len(array) <= 0 {
+		return 0, nil
+	}
 	switch query.Method {
 	case "sum":
-		return sumSlice(array)
+		return sumSlice(array), nil
 	case "max":
-		return maxSlice(array)
+		return maxSlice(array), nil
+	case "min":
+		return minSlice(array), nil
+	case "avg":
+		return avgSlice(array), nil
+	case "last":
+		return lastSlice(array), nil
 	default:
-		return 0
+		return quantileSlice(quantileMethods[query.Method], array), nil
 	}
 }
 
@@ -74,55 +164,133 @@ func getStruct(val mappedValues, usage csvStruct, rowResults mappedCSVStruct, ke
 	return nil
 }
 
+// decodeRow decodes the results of a row into the row struct.
+func decodeRow(val mappedValues, row interface{}) error {
+	if err := mapstructure.Decode(val, row); err != nil {
+		return fmt.Errorf("decodeRow: failed to convert map to struct: %v", err)
+	}
+	return nil
+}
+
 func getResourceID(input string) string {
 	splitString := strings.Split(input, "/")
 	return splitString[len(splitString)-1]
 }
 
-func (r *mappedResults) iterateMatrix(matrix model.Matrix, q query) {
-	results := *r
+// getRowKey joins the values of the row key labels. Composite keys, such as namespace and pod, keep
+// same-named resources in different namespaces in separate rows.
+func getRowKey(metric model.Metric, labels []model.LabelName) string {
+	values := make([]string, len(labels))
+	for i, label := range labels {
+		values[i] = string(metric[label])
+	}
+	return strings.Join(values, rowKeySeparator)
+}
+
+func (r *mappedResults) iterateMatrix(matrix model.Matrix, q query) error {
 	for _, stream := range matrix {
-		obj := string(stream.Metric[q.RowKey])
-		if results[obj] == nil {
-			results[obj] = mappedValues{}
-		}
-		if q.MetricKey != nil {
-			for key, field := range q.MetricKey {
-				results[obj][key] = string(stream.Metric[field])
-			}
-		}
-		if q.MetricKeyRegex != nil {
-			for key, regexField := range q.MetricKeyRegex {
-				results[obj][key] = findFields(stream.Metric, regexField)
+		obj := r.addFields(stream.Metric, q)
+		if q.QueryValue != nil {
+			value, err := getValue(q.QueryValue, stream.Values)
+			if err != nil {
+				return fmt.Errorf("query: %s: %v", q.Name, err)
 			}
+			r.addValue(obj, q.QueryValue, value, len(stream.Values))
 		}
+	}
+	return nil
+}
+
+// iterateVector adds the results of a query that was aggregated by Prometheus. The counts are the number of samples
+// of each series over the hour, which the max method needs to compute the transformed value.
+func (r *mappedResults) iterateVector(vector model.Vector, counts map[model.Fingerprint]int, q query) {
+	for _, sample := range vector {
+		obj := r.addFields(sample.Metric, q)
 		if q.QueryValue != nil {
-			saveStruct := q.QueryValue
-			value := getValue(saveStruct, stream.Values)
-			results[obj][saveStruct.ValName] = floatToString(value)
-			if saveStruct.TransformedName != "" {
-				factor := saveStruct.Factor
-				if saveStruct.Method == "max" {
-					factor *= float64(len(stream.Values))
-				}
-				results[obj][saveStruct.TransformedName] = floatToString(value * factor)
-			}
+			r.addValue(obj, q.QueryValue, float64(sample.Value), counts[sample.Metric.Fingerprint()])
+		}
+	}
+}
+
+func (r *mappedResults) addFields(metric model.Metric, q query) string {
+	results := *r
+	obj := getRowKey(metric, q.RowKey)
+	if results[obj] == nil {
+		results[obj] = mappedValues{}
+	}
+	if q.MetricKey != nil {
+		for key, field := range q.MetricKey {
+			results[obj][key] = string(metric[field])
 		}
 	}
+	if q.MetricKeyRegex != nil {
+		for key, regexField := range q.MetricKeyRegex {
+			results[obj][key] = findFields(metric, regexField)
+		}
+	}
+	return obj
+}
+
+func (r *mappedResults) addValue(obj string, saveStruct *saveQueryValue, value float64, samples int) {
+	results := *r
+	results[obj][saveStruct.ValName] = floatToString(value)
+	if saveStruct.TransformedName != "" {
+		factor := saveStruct.Factor
+		// every method except sum yields a per-sample value which is multiplied by the number of samples
+		if saveStruct.Method != "sum" {
+			factor *= float64(samples)
+		}
+		results[obj][saveStruct.TransformedName] = floatToString(value * factor)
+	}
 }
 
-// GenerateReports is responsible for querying prometheus and writing to report files
-func GenerateReports(kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, dirCfg *dirconfig.DirectoryConfig, c *PromCollector) error {
-	log := c.Log.WithValues("kokumetricsconfig", "GenerateReports")
+// GenerateReports is responsible for querying the metrics source and writing to report files. The salt is only needed
+// by the hash label redaction and the identifier anonymization.
+func GenerateReports(kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, dirCfg *dirconfig.DirectoryConfig, c MetricsSource, salt []byte) (err error) {
+	log := c.getLogger().WithValues("kokumetricsconfig", "GenerateReports")
+	ts := c.getTimeSeries()
 
 	// yearMonth is used in filenames
-	yearMonth := c.TimeSeries.Start.Format("200601") // this corresponds to YYYYMM format
-	updateReportStatus(kmCfg, c.TimeSeries)
+	yearMonth := ts.Start.Format("200601") // this corresponds to YYYYMM format
+	updateReportStatus(kmCfg, ts)
+	c.resetRangeSplits()
+	defer func() { kmCfg.Status.Reports.QueryRangeSplits = c.getRangeSplits() }()
+	peak := &heapPeak{}
+	defer func() { reportPeakHeapBytes.Set(float64(peak.bytes)) }()
+
+	if err := pruneIndexes(dirCfg.Reports.Path); err != nil {
+		return err
+	}
+
+	customQuerySets, err := getCustomQuerySets(kmCfg.Spec.CustomQueries)
+	if err != nil {
+		return err
+	}
+	nsFilter, err := newNamespaceFilter(&kmCfg.Spec.NamespaceFilter)
+	if err != nil {
+		return err
+	}
+	policy, err := newLabelPolicy(&kmCfg.Spec.LabelPolicy, salt)
+	if err != nil {
+		return err
+	}
+	var anon *anonymizer
+	if kmCfg.Spec.AnonymizeIdentifiers != nil && *kmCfg.Spec.AnonymizeIdentifiers {
+		if anon, err = newAnonymizer(salt, dirCfg.Parent.Path); err != nil {
+			return err
+		}
+		// the map is written even when a later report fails, because the earlier reports contain its hashes
+		defer func() {
+			if flushErr := anon.flush(); flushErr != nil && err == nil {
+				err = flushErr
+			}
+		}()
+	}
 
 	// ################################################################################################################
 	log.Info("querying for node metrics")
 	nodeResults := mappedResults{}
-	if err := c.getQueryResults(nodeQueries, &nodeResults); err != nil {
+	if err := c.getQuerySetsResults(querySetResults{queries: nodeQueries, results: &nodeResults}); err != nil {
 		return err
 	}
 
@@ -137,140 +305,297 @@ func GenerateReports(kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, dirCfg *dir
 		resourceID := getResourceID(val["provider_id"].(string))
 		nodeResults[node]["resource_id"] = resourceID
 	}
+	if policy != nil {
+		policy.apply(&nodeResults)
+	}
 
 	nodeRows := make(mappedCSVStruct)
 	for node, val := range nodeResults {
-		usage := newNodeRow(c.TimeSeries)
+		usage := newNodeRow(ts)
 		if err := getStruct(val, &usage, nodeRows, node); err != nil {
 			return err
 		}
 	}
-	emptyNodeRow := newNodeRow(c.TimeSeries)
+	var emptyNodeRow csvStruct = newNodeRow(ts)
+	nodeReportRows := nodeRows
+	if kmCfg.Spec.ReportSchema == kokumetricscfgv1beta1.StandaloneNodeReportSchema {
+		emptyNodeRow = standaloneNodeRow{nodeRow: newNodeRow(ts)}
+		nodeReportRows = make(mappedCSVStruct)
+		for node, row := range nodeRows {
+			nodeReportRows[node] = standaloneNodeRow{nodeRow: *row.(*nodeRow)}
+		}
+	}
 	nodeReport := report{
 		file: &file{
 			name: nodeFilePrefix + yearMonth + ".csv",
 			path: dirCfg.Reports.Path,
 		},
+		index:         newReportIndex(dirCfg.Reports.Path, nodeFilePrefix+yearMonth+".csv"),
+		entityColumns: columnIndexes(emptyNodeRow.csvHeader(), "node"),
 		data: &data{
-			queryData: nodeRows,
-			headers:   emptyNodeRow.csvHeader(),
-			prefix:    emptyNodeRow.dateTimes.string(),
+			queryData:  nodeReportRows,
+			headers:    emptyNodeRow.csvHeader(),
+			prefix:     newDates(ts).string(),
+			anonymizer: anon,
 		},
 	}
-	c.Log.WithValues("kokumetricsconfig", "writeResults").Info("writing node results to file", "filename", nodeReport.file.getName())
+	c.getLogger().WithValues("kokumetricsconfig", "writeResults").Info("writing node results to file", "filename", nodeReport.file.getName())
 	if err := nodeReport.writeReport(); err != nil {
 		return fmt.Errorf("failed to write node report: %v", err)
 	}
+	if nodeReport.replacedRows > 0 {
+		log.Info("replaced node rows with re-collected rows", "filename", nodeReport.file.getName(), "replacedRows", nodeReport.replacedRows)
+	}
+	// a re-collected hour that ended before the last package and has no rows left in the node report was packaged
+	// already, so the rows written for it again are corrections of an earlier package
+	if ts.Start.Before(kmCfg.Status.Prometheus.CollectedThrough.Time) &&
+		ts.End.Before(kmCfg.Status.Packaging.LastSuccessfulPackagingTime.Time) && nodeReport.previousRows == 0 {
+		log.Info("re-collected hour was already packaged", "start", ts.Start)
+		if err := markCorrections(dirCfg.Reports.Path); err != nil {
+			return err
+		}
+	}
+	peak.sample()
 
 	//################################################################################################################
 
-	log.Info("querying for pod metrics")
-	podResults := mappedResults{}
-	if err := c.getQueryResults(podQueries, &podResults); err != nil {
-		return err
+	// the query sets of the remaining reports run together on the bounded worker pool. Each set spills its rows to disk
+	// once it holds more than maxRows of them, and the reports are written one partition at a time afterwards.
+	w := &reportWriter{
+		source:    c,
+		dirCfg:    dirCfg,
+		ts:        ts,
+		yearMonth: yearMonth,
+		maxRows:   kokumetricscfgv1beta1.DefaultMaxRowsInMemory,
+		nsFilter:  nsFilter,
+		policy:    policy,
+		anon:      anon,
+		peak:      peak,
 	}
+	if kmCfg.Spec.MaxRowsInMemory != nil {
+		w.maxRows = *kmCfg.Spec.MaxRowsInMemory
+	}
+	defer w.close()
+	defer func() {
+		kmCfg.Status.Reports.SpilledRows = w.spilledRows
+		reportSpilledRows.Add(float64(w.spilledRows))
+		if nsFilter != nil {
+			log.Info("applied the namespace filter", "removedRows", w.filteredRows)
+		}
+	}()
 
-	podRows := make(mappedCSVStruct)
-	for pod, val := range podResults {
-		usage := newPodRow(c.TimeSeries)
-		if err := getStruct(val, &usage, podRows, pod); err != nil {
-			return err
+	w.add("pod", podQueries, podFilePrefix, newPodRow(ts), []string{"namespace", "pod"}, func(val mappedValues) (csvStruct, error) {
+		usage := newPodRow(ts)
+		if err := decodeRow(val, &usage); err != nil {
+			return nil, err
 		}
 		if node, ok := val["node"]; ok {
-			// Add the Node usage to the pod.
+			// Add the Node usage to the pod. Node rows are keyed by the node name alone.
 			if row, ok := nodeRows[node.(string)]; ok {
 				usage.nodeRow = *row.(*nodeRow)
 			} else {
-				usage.nodeRow = newNodeRow(c.TimeSeries)
+				usage.nodeRow = newNodeRow(ts)
 			}
 		}
+		return &usage, nil
+	})
+
+	w.add("container", containerQueries, containerFilePrefix, newContainerRow(ts), []string{"namespace", "pod", "container"}, func(val mappedValues) (csvStruct, error) {
+		usage := newContainerRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	// the node capacity of the extended resources is only merged into the extended resource rows
+	nodeResourceResults := mappedResults{}
+	w.add("extended resource", podResourceQueries, resourceFilePrefix, newExtendedResourceRow(ts), []string{"namespace", "pod", "resource"}, func(val mappedValues) (csvStruct, error) {
+		// Add the Node capacity of the same resource to the pod. Node rows are keyed by node and resource.
+		node, _ := val["node"].(string)
+		resource, _ := val["resource"].(string)
+		for field, nodeVal := range nodeResourceResults[strings.Join([]string{node, resource}, rowKeySeparator)] {
+			val[field] = nodeVal
+		}
+		usage := newExtendedResourceRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	w.add("network", networkQueries, networkFilePrefix, newNetworkRow(ts), []string{"namespace", "pod"}, func(val mappedValues) (csvStruct, error) {
+		usage := newNetworkRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	w.add("volume", volQueries, volFilePrefix, newStorageRow(ts), []string{"namespace", "persistentvolumeclaim", "persistentvolume"}, func(val mappedValues) (csvStruct, error) {
+		usage := newStorageRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	w.add("resource quota", resourceQuotaQueries, quotaFilePrefix, newResourceQuotaRow(ts), []string{"namespace", "resourcequota", "resource"}, func(val mappedValues) (csvStruct, error) {
+		usage := newResourceQuotaRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	w.add("limit range", limitRangeQueries, limitRangeFilePrefix, newLimitRangeRow(ts), []string{"namespace", "limitrange", "type", "resource"}, func(val mappedValues) (csvStruct, error) {
+		usage := newLimitRangeRow(ts)
+		return &usage, decodeRow(val, &usage)
+	})
+
+	// custom reports have no namespace rollup, so they are not packaged at namespace level
+	if kmCfg.Spec.Packaging.AggregationLevel == kokumetricscfgv1beta1.NamespaceAggregationLevel && len(customQuerySets) > 0 {
+		log.Info("skipping custom queries at namespace aggregation level")
+		customQuerySets = nil
 	}
-	emptyPodRow := newPodRow(c.TimeSeries)
-	podReport := report{
-		file: &file{
-			name: podFilePrefix + yearMonth + ".csv",
-			path: dirCfg.Reports.Path,
-		},
-		data: &data{
-			queryData: podRows,
-			headers:   emptyPodRow.csvHeader(),
-			prefix:    emptyPodRow.dateTimes.string(),
-		},
-	}
-	c.Log.WithValues("kokumetricsconfig", "writeResults").Info("writing pod results to file", "filename", podReport.file.getName())
-	if err := podReport.writeReport(); err != nil {
-		return fmt.Errorf("failed to write pod report: %v", err)
+	for _, querySet := range customQuerySets {
+		columns := querySet.columns
+		w.add(querySet.name, querySet.queries, fmt.Sprintf(customFileFormat, querySet.name), newCustomRow(ts, columns), querySet.keyColumns, func(val mappedValues) (csvStruct, error) {
+			usage := newCustomRow(ts, columns)
+			usage.values = val
+			return usage, nil
+		})
 	}
 
-	//################################################################################################################
-
-	log.Info("querying for storage metrics")
-	volResults := mappedResults{}
-	if err := c.getQueryResults(volQueries, &volResults); err != nil {
+	log.Info("querying for namespace, pod, container, extended resource, network, storage, quota and custom metrics")
+	// the namespace labels stay in memory because the namespace filter needs them for every report
+	namespaceResults := mappedResults{}
+	if err := w.query(
+		querySetResults{queries: namespaceQueries, results: &namespaceResults},
+		querySetResults{queries: nodeResourceQueries, results: &nodeResourceResults},
+	); err != nil {
 		return err
 	}
+	w.nsLabels = namespaceLabels(namespaceResults)
 
-	volRows := make(mappedCSVStruct)
-	for pvc, val := range volResults {
-		usage := newStorageRow(c.TimeSeries)
-		if err := getStruct(val, &usage, volRows, pvc); err != nil {
+	for _, set := range w.sets {
+		if err := w.write(set.name, set.filePrefix, &set.results, set.spill, set.emptyRow, set.entity, set.newRow); err != nil {
 			return err
 		}
+		// the rows of a written report are released before the next report is written
+		set.results = nil
+		set.spill.close()
 	}
-	emptyVolRow := newStorageRow(c.TimeSeries)
-	volReport := report{
-		file: &file{
-			name: volFilePrefix + yearMonth + ".csv",
-			path: dirCfg.Reports.Path,
-		},
-		data: &data{
-			queryData: volRows,
-			headers:   emptyVolRow.csvHeader(),
-			prefix:    emptyVolRow.dateTimes.string(),
-		},
-	}
-	c.Log.WithValues("kokumetricsconfig", "writeResults").Info("writing volume results to file", "filename", volReport.file.getName())
-	if err := volReport.writeReport(); err != nil {
-		return fmt.Errorf("failed to write volume report: %v", err)
+
+	if err := w.write("namespace", namespaceFilePrefix, &namespaceResults, nil, newNamespaceRow(ts), []string{"namespace"}, func(val mappedValues) (csvStruct, error) {
+		usage := newNamespaceRow(ts)
+		return &usage, decodeRow(val, &usage)
+	}); err != nil {
+		return err
 	}
 
 	//################################################################################################################
 
-	log.Info("querying for namespaces")
-	namespaceResults := mappedResults{}
-	if err := c.getQueryResults(namespaceQueries, &namespaceResults); err != nil {
-		return err
+	kmCfg.Status.Reports.DataCollected = true
+	kmCfg.Status.Reports.DataCollectionMessage = ""
+
+	return nil
+}
+
+// reportSet is the query set of a report and its rows, which are spilled to disk once there are more than maxRows.
+type reportSet struct {
+	name       string
+	queries    *querys
+	filePrefix string
+	emptyRow   csvStruct
+	entity     []string
+	newRow     func(mappedValues) (csvStruct, error)
+	results    mappedResults
+	spill      *rowSpill
+}
+
+// reportWriter queries and writes the reports of one hour that follow the node report.
+type reportWriter struct {
+	source    MetricsSource
+	dirCfg    *dirconfig.DirectoryConfig
+	ts        *promv1.Range
+	yearMonth string
+	maxRows   int64
+	nsFilter  *namespaceFilter
+	nsLabels  map[string]labels.Set
+	policy    *labelPolicy
+	anon      *anonymizer
+	peak      *heapPeak
+	sets      []*reportSet
+
+	filteredRows int64
+	spilledRows  int64
+}
+
+// add adds the query set of a report to the next query.
+func (w *reportWriter) add(name string, queries *querys, filePrefix string, emptyRow csvStruct, entity []string, newRow func(mappedValues) (csvStruct, error)) {
+	w.sets = append(w.sets, &reportSet{
+		name:       name,
+		queries:    queries,
+		filePrefix: filePrefix,
+		emptyRow:   emptyRow,
+		entity:     entity,
+		newRow:     newRow,
+		results:    mappedResults{},
+		spill:      newRowSpill(w.dirCfg.Parent.Path, w.maxRows),
+	})
+}
+
+// query runs the query sets of the reports together with the other sets, so that the parallelism of the source spans
+// all of them.
+func (w *reportWriter) query(others ...querySetResults) error {
+	sets := others
+	for _, set := range w.sets {
+		sets = append(sets, querySetResults{queries: set.queries, results: &set.results, spill: set.spill})
 	}
+	err := w.source.getQuerySetsResults(sets...)
+	w.peak.sample()
+	return err
+}
 
-	namespaceRows := make(mappedCSVStruct)
-	for namespace, val := range namespaceResults {
-		usage := newNamespaceRow(c.TimeSeries)
-		if err := getStruct(val, &usage, namespaceRows, namespace); err != nil {
-			return err
-		}
+// close removes the spill files of the reports.
+func (w *reportWriter) close() {
+	for _, set := range w.sets {
+		set.spill.close()
 	}
-	emptyNameRow := newNamespaceRow(c.TimeSeries)
-	namespaceReport := report{
+}
+
+// write filters, redacts and writes the rows one partition at a time. The namespace filter matches the namespace
+// labels before they are redacted. The entity columns identify the rows that replace the rows of the hour that were
+// already written.
+func (w *reportWriter) write(name, filePrefix string, results *mappedResults, spill *rowSpill, emptyRow csvStruct, entity []string, newRow func(mappedValues) (csvStruct, error)) error {
+	w.peak.sample()
+	headers, prefix := emptyRow.csvHeader(), newDates(w.ts).string()
+	fileName := filePrefix + w.yearMonth + ".csv"
+	r := report{
 		file: &file{
-			name: namespaceFilePrefix + yearMonth + ".csv",
-			path: dirCfg.Reports.Path,
+			name: fileName,
+			path: w.dirCfg.Reports.Path,
 		},
+		index:         newReportIndex(w.dirCfg.Reports.Path, fileName),
+		entityColumns: columnIndexes(headers, entity...),
 		data: &data{
-			queryData: namespaceRows,
-			headers:   emptyNameRow.csvHeader(),
-			prefix:    emptyNameRow.dateTimes.string(),
+			headers: headers,
+			prefix:  prefix,
 		},
 	}
-	c.Log.WithValues("kokumetricsconfig", "writeResults").Info("writing namespace results to file", "filename", namespaceReport.file.getName())
-	if err := namespaceReport.writeReport(); err != nil {
-		return fmt.Errorf("failed to write namespace report: %v", err)
+	w.source.getLogger().WithValues("kokumetricsconfig", "writeResults").Info(fmt.Sprintf("writing %s results to file", name), "filename", r.file.getName())
+	err := r.writeReportChunks(func(write func(dataInterface) error) error {
+		return spill.forEachPartition(results, func(part mappedResults) error {
+			if w.nsFilter != nil {
+				w.filteredRows += int64(w.nsFilter.applyLabels(w.nsLabels, &part))
+			}
+			if w.policy != nil {
+				w.policy.apply(&part)
+			}
+			err := write(&data{
+				results:    part,
+				newRow:     newRow,
+				headers:    headers,
+				prefix:     prefix,
+				anonymizer: w.anon,
+			})
+			w.peak.sample()
+			return err
+		})
+	})
+	w.spilledRows += spill.spilledRows()
+	if err != nil {
+		return fmt.Errorf("failed to write %s report: %v", name, err)
+	}
+	if r.replacedRows > 0 {
+		w.source.getLogger().Info(fmt.Sprintf("replaced %s rows with re-collected rows", name), "filename", fileName, "replacedRows", r.replacedRows)
 	}
-
-	//################################################################################################################
-
-	kmCfg.Status.Reports.DataCollected = true
-	kmCfg.Status.Reports.DataCollectionMessage = ""
-
 	return nil
 }
 
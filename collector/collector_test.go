@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,6 +23,7 @@ import (
 	"github.com/project-koku/koku-metrics-operator/testutils"
 	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var testLogger = testutils.TestLogger{}
@@ -82,6 +86,10 @@ func getFiles(dir string, t *testing.T) map[string]*os.File {
 		t.Fatalf("Failed to read %s directory", dir)
 	}
 	for _, file := range filelist {
+		if file.IsDir() {
+			// the deduplication index of the reports
+			continue
+		}
 		f, err := os.Open(filepath.Join("test_files", dir, file.Name()))
 		if err != nil {
 			t.Fatalf("failed to open %s: %v", file.Name(), err)
@@ -125,7 +133,7 @@ func compareFiles(expected, generated *os.File) error {
 
 func TestGenerateReports(t *testing.T) {
 	mapResults := make(mappedMockPromResult)
-	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, volQueries}
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
 	for _, q := range queryList {
 		for _, query := range *q {
 			res := &model.Matrix{}
@@ -142,7 +150,7 @@ func TestGenerateReports(t *testing.T) {
 		TimeSeries: &fakeTimeRange,
 		Log:        testLogger,
 	}
-	if err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector); err != nil {
+	if err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector, nil); err != nil {
 		t.Errorf("Failed to generate reports: %v", err)
 	}
 
@@ -170,18 +178,16 @@ func TestGenerateReports(t *testing.T) {
 	}
 }
 
-func TestGenerateReportsQueryErrors(t *testing.T) {
-	mapResults := make(mappedMockPromResult)
-	fakeCollector := &PromCollector{
-		PromConn: mockPrometheusConnection{
-			mappedResults: &mapResults,
-			t:             t,
-		},
-		TimeSeries: &fakeTimeRange,
-		Log:        testLogger,
+func TestGenerateReportsInstantQueryMode(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
 	}
 
-	queryList := []*querys{nodeQueries, podQueries, volQueries}
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
 	for _, q := range queryList {
 		for _, query := range *q {
 			res := &model.Matrix{}
@@ -189,37 +195,79 @@ func TestGenerateReportsQueryErrors(t *testing.T) {
 			mapResults[query.QueryString] = &mockPromResult{value: *res}
 		}
 	}
-	namespaceError := "namespace error"
-	for _, q := range *namespaceQueries {
-		mapResults[q.QueryString] = &mockPromResult{err: errors.New(namespaceError)}
-	}
-	err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector)
-	if !strings.Contains(err.Error(), namespaceError) {
-		t.Errorf("GenerateReports %s was expected, got %v", namespaceError, err)
-	}
-	storageError := "storage error"
-	for _, q := range *volQueries {
-		mapResults[q.QueryString] = &mockPromResult{err: errors.New(storageError)}
-	}
-	err = GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector)
-	if !strings.Contains(err.Error(), storageError) {
-		t.Errorf("GenerateReports %s was expected, got %v", storageError, err)
+
+	fakeCollector := &PromCollector{
+		PromConn: aggregatingPrometheusConnection{
+			mappedResults: &mapResults,
+			t:             t,
+		},
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+		QueryMode:  kokumetricscfgv1beta1.InstantQueryMode,
 	}
-	podError := "pod error"
-	for _, q := range *podQueries {
-		mapResults[q.QueryString] = &mockPromResult{err: errors.New(podError)}
+	if err := GenerateReports(&kokumetricscfgv1beta1.KokuMetricsConfig{}, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
 	}
-	err = GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector)
-	if !strings.Contains(err.Error(), podError) {
-		t.Errorf("GenerateReports %s was expected, got %v", podError, err)
+
+	// server-side aggregation produces the same reports as the range queries
+	expectedMap := getFiles("expected_reports", t)
+	for expected, expectedinfo := range expectedMap {
+		generatedinfo, err := os.Open(filepath.Join(tempDir, expected))
+		if err != nil {
+			t.Errorf("%s report file was not generated", expected)
+			continue
+		}
+		if err := compareFiles(expectedinfo, generatedinfo); err != nil {
+			t.Errorf("%s files do not compare: error: %v", expected, err)
+		}
+		generatedinfo.Close()
 	}
-	nodeError := "node error"
-	for _, q := range *nodeQueries {
-		mapResults[q.QueryString] = &mockPromResult{err: errors.New(nodeError)}
+}
+
+func TestGenerateReportsQueryErrors(t *testing.T) {
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	queryErrorsTests := []struct {
+		name    string
+		queries *querys
+	}{
+		{name: "node error", queries: nodeQueries},
+		// the namespace labels are queried before the other reports
+		{name: "namespace error", queries: namespaceQueries},
+		{name: "pod error", queries: podQueries},
+		{name: "container error", queries: containerQueries},
+		{name: "node extended resource error", queries: nodeResourceQueries},
+		{name: "extended resource error", queries: podResourceQueries},
+		{name: "network error", queries: networkQueries},
+		{name: "storage error", queries: volQueries},
+		{name: "resource quota error", queries: resourceQuotaQueries},
+		{name: "limit range error", queries: limitRangeQueries},
 	}
-	err = GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector)
-	if !strings.Contains(err.Error(), nodeError) {
-		t.Errorf("GenerateReports %s was expected, got %v", nodeError, err)
+	for _, tt := range queryErrorsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapResults := make(mappedMockPromResult)
+			for _, q := range queryList {
+				for _, query := range *q {
+					res := &model.Matrix{}
+					Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+					mapResults[query.QueryString] = &mockPromResult{value: *res}
+				}
+			}
+			for _, q := range *tt.queries {
+				mapResults[q.QueryString] = &mockPromResult{err: errors.New(tt.name)}
+			}
+			fakeCollector := &PromCollector{
+				PromConn: mockPrometheusConnection{
+					mappedResults: &mapResults,
+					t:             t,
+				},
+				TimeSeries: &fakeTimeRange,
+				Log:        testLogger,
+			}
+			err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("GenerateReports %s was expected, got %v", tt.name, err)
+			}
+		})
 	}
 	if err := fakeDirCfg.Reports.RemoveContents(); err != nil {
 		t.Fatal("failed to cleanup reports directory")
@@ -244,7 +292,7 @@ func TestGenerateReportsNoNodeData(t *testing.T) {
 		TimeSeries: &fakeTimeRange,
 		Log:        testLogger,
 	}
-	if err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector); err != nil {
+	if err := GenerateReports(fakeKMCfg, fakeDirCfg, fakeCollector, nil); err != nil {
 		t.Errorf("Failed to generate reports: %v", err)
 	}
 	wanted := "No data to report for the hour queried."
@@ -260,6 +308,358 @@ func TestGenerateReportsNoNodeData(t *testing.T) {
 	}
 }
 
+func TestGenerateReportsStandaloneNodeSchema(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
+	}
+
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	for _, q := range queryList {
+		for _, query := range *q {
+			res := &model.Matrix{}
+			Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+			mapResults[query.QueryString] = &mockPromResult{value: *res}
+		}
+	}
+
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.ReportSchema = kokumetricscfgv1beta1.StandaloneNodeReportSchema
+
+	fakeCollector := &PromCollector{
+		PromConn: mockPrometheusConnection{
+			mappedResults: &mapResults,
+			t:             t,
+		},
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+	}
+	if err := GenerateReports(kmCfg, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(tempDir, "cm-openshift-node-usage-202011.csv"))
+	if err != nil {
+		t.Fatalf("node report was not generated: %v", err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read node report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+
+	wantHeader := strings.Join(standaloneNodeRow{}.csvHeader(), ",")
+	if lines[0] != wantHeader {
+		t.Errorf("node report header got %s want %s", lines[0], wantHeader)
+	}
+	wantRow := newDates(&fakeTimeRange).string() + ",ip-10-0-146-115.us-east-2.compute.internal," +
+		"8.000000,28800.000000,33237303296.000000,119654291865600.000000," +
+		"7.500000,27000.000000,32058703872.000000,115411333939200.000000," +
+		"i-0eb3a4cb7807fb144,aws:///us-east-2a/i-0eb3a4cb7807fb144,"
+	found := false
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, wantRow) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("node report does not contain row starting with %s:\n%s", wantRow, got)
+	}
+
+	// the pod report is the same in both schemas
+	podReport, err := ioutil.ReadFile(filepath.Join(tempDir, "cm-openshift-pod-usage-202011.csv"))
+	if err != nil {
+		t.Fatalf("pod report was not generated: %v", err)
+	}
+	wantPodHeader := strings.Join(podRow{}.csvHeader(), ",")
+	if !strings.HasPrefix(string(podReport), wantPodHeader+"\n") {
+		t.Errorf("pod report header changed, got %s", strings.SplitN(string(podReport), "\n", 2)[0])
+	}
+}
+
+func TestGenerateReportsCustomQueries(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
+	}
+
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	for _, q := range queryList {
+		for _, query := range *q {
+			res := &model.Matrix{}
+			Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+			mapResults[query.QueryString] = &mockPromResult{value: *res}
+		}
+	}
+	mapResults["gpu-usage-query"] = &mockPromResult{value: model.Matrix{
+		{
+			Metric: model.Metric{"pod": "pod-a", "namespace": "ns-a", "label_team": "ml"},
+			Values: []model.SamplePair{{Value: 1}, {Value: 2}, {Value: 3}},
+		},
+	}}
+	mapResults["gpu-limit-query"] = &mockPromResult{value: model.Matrix{
+		{
+			Metric: model.Metric{"pod": "pod-a", "namespace": "ns-a"},
+			Values: []model.SamplePair{{Value: 4}, {Value: 4}, {Value: 4}},
+		},
+	}}
+
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.CustomQueries = []kokumetricscfgv1beta1.CustomQuerySetSpec{
+		{
+			Name: "gpu",
+			Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+				{
+					Name:            "gpu_usage",
+					Query:           "gpu-usage-query",
+					RowKey:          []string{"namespace", "pod"},
+					RegexFields:     map[string]string{"pod_labels": "label_*"},
+					Method:          "sum",
+					TransformedName: "gpu_usage_seconds",
+				},
+				{
+					Name:   "gpu_limit",
+					Query:  "gpu-limit-query",
+					RowKey: []string{"namespace", "pod"},
+					Method: "max",
+				},
+			},
+		},
+	}
+
+	fakeCollector := &PromCollector{
+		PromConn: mockPrometheusConnection{
+			mappedResults: &mapResults,
+			t:             t,
+		},
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+	}
+	if err := GenerateReports(kmCfg, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(tempDir, "cm-openshift-gpu-usage-202011.csv"))
+	if err != nil {
+		t.Fatalf("custom report was not generated: %v", err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read custom report: %v", err)
+	}
+	dates := newDates(&fakeTimeRange).string()
+	want := "report_period_start,report_period_end,interval_start,interval_end,namespace,pod,pod_labels,gpu_usage,gpu_usage_seconds,gpu_limit\n" +
+		dates + ",ns-a,pod-a,label_team:ml,6.000000,360.000000,4.000000\n"
+	if string(got) != want {
+		t.Errorf("custom report got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGetCustomQuerySets(t *testing.T) {
+	getCustomQuerySetsTests := []struct {
+		name    string
+		specs   []kokumetricscfgv1beta1.CustomQuerySetSpec
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "no custom queries",
+			specs: nil,
+			want:  []string{},
+		},
+		{
+			name: "valid custom query",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}, Method: "sum"},
+					},
+				},
+			},
+			want: []string{"app"},
+		},
+		{
+			name: "reserved name",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "pod",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "name whose report starts with a reserved report",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "pod-usage",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "name whose report starts with another report",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "node-usage-x",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "names starting with a reserved name",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{Name: "nodejs", Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}}},
+				{Name: "podman", Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}}},
+				{Name: "networking", Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}}},
+				{Name: "storageclass-x", Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}}},
+				{Name: "namespaces-quota", Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}}},
+			},
+			want: []string{"nodejs", "podman", "networking", "storageclass-x", "namespaces-quota"},
+		},
+		{
+			name: "reserved row key column",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"interval_start"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "reserved static field column",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}, StaticFields: map[string]string{"report_period_start": "start"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "reserved value column",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "interval_end", Query: "app_requests", RowKey: []string{"service"}, Method: "sum"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "reserved transformed column",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}, Method: "sum", TransformedName: "report_period_end"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate name",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}},
+					},
+				},
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "errors", Query: "app_errors", RowKey: []string{"service"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing row key",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown method",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}, Method: "median"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "transformed name without method",
+			specs: []kokumetricscfgv1beta1.CustomQuerySetSpec{
+				{
+					Name: "app",
+					Queries: []kokumetricscfgv1beta1.CustomQuerySpec{
+						{Name: "requests", Query: "app_requests", RowKey: []string{"service"}, TransformedName: "request_seconds"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range getCustomQuerySetsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCustomQuerySets(tt.specs)
+			if tt.wantErr && err == nil {
+				t.Errorf("%s expected error but got nil", tt.name)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("%s got unexpected error: %v", tt.name, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			gotNames := []string{}
+			for _, qs := range got {
+				gotNames = append(gotNames, qs.name)
+			}
+			if !reflect.DeepEqual(gotNames, tt.want) {
+				t.Errorf("%s got %v want %v", tt.name, gotNames, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetResourceID(t *testing.T) {
 	getResourceIDTests := []struct {
 		name  string
@@ -280,11 +680,13 @@ func TestGetResourceID(t *testing.T) {
 }
 
 func TestGetValue(t *testing.T) {
+	samples := []model.SamplePair{{Value: 4}, {Value: 1}, {Value: 3}, {Value: 2}, {Value: 5}}
 	getValueTests := []struct {
-		name  string
-		query saveQueryValue
-		array []model.SamplePair
-		want  float64
+		name    string
+		query   saveQueryValue
+		array   []model.SamplePair
+		want    float64
+		wantErr bool
 	}{
 		{
 			name:  "sum",
@@ -311,15 +713,69 @@ func TestGetValue(t *testing.T) {
 			want:  math.Inf(1),
 		},
 		{
-			name:  "unknown",
-			query: saveQueryValue{Method: "unknown"},
-			array: []model.SamplePair{{Value: 1.3}, {Value: 2.3}, {Value: 3.3}},
+			name:  "min",
+			query: saveQueryValue{Method: "min"},
+			array: samples,
+			want:  1,
+		},
+		{
+			name:  "avg",
+			query: saveQueryValue{Method: "avg"},
+			array: samples,
+			want:  3,
+		},
+		{
+			name:  "last",
+			query: saveQueryValue{Method: "last"},
+			array: samples,
+			want:  5,
+		},
+		{
+			name:  "p50",
+			query: saveQueryValue{Method: "p50"},
+			array: samples,
+			want:  3,
+		},
+		{
+			name:  "p95",
+			query: saveQueryValue{Method: "p95"},
+			array: samples,
+			want:  4.8,
+		},
+		{
+			name:  "p99",
+			query: saveQueryValue{Method: "p99"},
+			array: samples,
+			want:  4.96,
+		},
+		{
+			name:  "p99 single sample",
+			query: saveQueryValue{Method: "p99"},
+			array: []model.SamplePair{{Value: 7}},
+			want:  7,
+		},
+		{
+			name:  "no samples",
+			query: saveQueryValue{Method: "avg"},
+			array: []model.SamplePair{},
 			want:  0,
 		},
+		{
+			name:    "unknown",
+			query:   saveQueryValue{Method: "unknown"},
+			array:   []model.SamplePair{{Value: 1.3}, {Value: 2.3}, {Value: 3.3}},
+			wantErr: true,
+		},
 	}
 	for _, tt := range getValueTests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := getValue(&tt.query, tt.array)
+			got, err := getValue(&tt.query, tt.array)
+			if tt.wantErr && err == nil {
+				t.Errorf("%s expected error but got nil", tt.name)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("%s got unexpected error: %v", tt.name, err)
+			}
 			if !nearlyEqual(got, tt.want) {
 				t.Errorf("%s got %f want %f", tt.name, got, tt.want)
 			}
@@ -416,7 +872,7 @@ func TestIterateMatrix(t *testing.T) {
 					Factor:          maxFactor,
 					TransformedName: "node-allocatable-cpu-core-seconds",
 				},
-				RowKey: "node",
+				RowKey: []model.LabelName{"node"},
 			},
 			matrix: model.Matrix{
 				{
@@ -449,7 +905,7 @@ func TestIterateMatrix(t *testing.T) {
 				Name:           "node-labels",
 				QueryString:    "kube_node_labels",
 				MetricKeyRegex: regexFields{"node_labels": "label_*"},
-				RowKey:         "node",
+				RowKey:         []model.LabelName{"node"},
 			},
 			matrix: model.Matrix{
 				{
@@ -492,7 +948,7 @@ func TestIterateMatrix(t *testing.T) {
 					Factor:          maxFactor,
 					TransformedName: "node-capacity-cpu-core-seconds",
 				},
-				RowKey: "node",
+				RowKey: []model.LabelName{"node"},
 			},
 			matrix: model.Matrix{
 				{
@@ -525,6 +981,48 @@ func TestIterateMatrix(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "composite row key query",
+			query: query{
+				Name:        "pod-limit-cpu-cores",
+				QueryString: "sum(kube_pod_container_resource_limits_cpu_cores) by (pod, namespace, node)",
+				MetricKey:   staticFields{"pod": "pod", "namespace": "namespace"},
+				QueryValue: &saveQueryValue{
+					ValName: "pod-limit-cpu-cores",
+					Method:  "max",
+					Factor:  maxFactor,
+				},
+				RowKey: []model.LabelName{"namespace", "pod"},
+			},
+			matrix: model.Matrix{
+				{
+					Metric: model.Metric{"namespace": "ns-a", "pod": "web"},
+					Values: []model.SamplePair{
+						{Timestamp: 1604339340, Value: 1},
+					},
+				},
+				{
+					Metric: model.Metric{"namespace": "ns-b", "pod": "web"},
+					Values: []model.SamplePair{
+						{Timestamp: 1604339340, Value: 2},
+					},
+				},
+			},
+			results: mappedResults{},
+			want: mappedResults{
+				// same-named pods in different namespaces are kept in separate rows
+				"ns-a/web": {
+					"pod":                 "web",
+					"namespace":           "ns-a",
+					"pod-limit-cpu-cores": "1.000000",
+				},
+				"ns-b/web": {
+					"pod":                 "web",
+					"namespace":           "ns-b",
+					"pod-limit-cpu-cores": "2.000000",
+				},
+			},
+		},
 	}
 	for _, tt := range iterateMatrixTests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -536,3 +1034,508 @@ func TestIterateMatrix(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateReportsRecollectedHour(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: tempDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(tempDir, "reports")},
+	}
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	for _, q := range queryList {
+		for _, query := range *q {
+			res := &model.Matrix{}
+			Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+			mapResults[query.QueryString] = &mockPromResult{value: *res}
+		}
+	}
+	fakeCollector := &PromCollector{
+		PromConn: mockPrometheusConnection{
+			mappedResults: &mapResults,
+			t:             t,
+		},
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+	}
+	correctionsFile := filepath.Join(dirCfg.Reports.Path, dirconfig.CorrectionsFile)
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+
+	recollectTests := []struct {
+		name            string
+		collected       bool
+		removed         bool
+		packaged        bool
+		wantCorrections bool
+	}{
+		{name: "new hour", wantCorrections: false},
+		{name: "re-collected hour in the reports", collected: true, wantCorrections: false},
+		{name: "re-collected hour removed without a package", collected: true, removed: true, wantCorrections: false},
+		{name: "re-collected hour that was packaged", collected: true, removed: true, packaged: true, wantCorrections: true},
+	}
+	for _, tt := range recollectTests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(correctionsFile)
+			if tt.removed {
+				files, _ := filepath.Glob(filepath.Join(dirCfg.Reports.Path, "*.csv"))
+				for _, f := range files {
+					os.Remove(f)
+				}
+			}
+			kmCfg.Status.Packaging.LastSuccessfulPackagingTime = metav1.Time{}
+			if tt.packaged {
+				kmCfg.Status.Packaging.LastSuccessfulPackagingTime = metav1.NewTime(fakeTimeRange.End.Add(time.Minute))
+			}
+			kmCfg.Status.Prometheus.CollectedThrough = metav1.Time{}
+			if tt.collected {
+				kmCfg.Status.Prometheus.CollectedThrough = metav1.NewTime(fakeTimeRange.End.Add(time.Second))
+			}
+			if err := GenerateReports(kmCfg, dirCfg, fakeCollector, nil); err != nil {
+				t.Fatalf("%s failed to generate reports: %v", tt.name, err)
+			}
+			_, err := os.Stat(correctionsFile)
+			if got := err == nil; got != tt.wantCorrections {
+				t.Errorf("%s got corrections marker %t want %t", tt.name, got, tt.wantCorrections)
+			}
+		})
+	}
+}
+
+// overlapPrometheusConnection answers from the mapped results and records whether queries of different report query
+// sets were running at the same time. Queries without a set are not recorded.
+type overlapPrometheusConnection struct {
+	mockPrometheusConnection
+	setOf map[string]string
+
+	mu      sync.Mutex
+	running map[string]int
+	overlap bool
+}
+
+func (m *overlapPrometheusConnection) QueryRange(ctx context.Context, query string, r promv1.Range) (model.Value, promv1.Warnings, error) {
+	set, ok := m.setOf[query]
+	if !ok {
+		return m.mockPrometheusConnection.QueryRange(ctx, query, r)
+	}
+	m.mu.Lock()
+	m.running[set]++
+	if len(m.running) > 1 {
+		m.overlap = true
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		if m.running[set]--; m.running[set] == 0 {
+			delete(m.running, set)
+		}
+		m.mu.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return m.mockPrometheusConnection.QueryRange(ctx, query, r)
+}
+
+func TestGenerateReportsRunsSetsConcurrently(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: tempDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(tempDir, "reports")},
+	}
+	mapResults := make(mappedMockPromResult)
+	setOf := map[string]string{}
+	// the node, namespace and node resource sets have no report of their own, so they are not recorded
+	querySets := []struct {
+		report  string
+		queries *querys
+	}{
+		{"", nodeQueries}, {"", namespaceQueries}, {"", nodeResourceQueries},
+		{"pod", podQueries}, {"container", containerQueries}, {"extended resource", podResourceQueries},
+		{"network", networkQueries}, {"volume", volQueries}, {"resource quota", resourceQuotaQueries},
+		{"limit range", limitRangeQueries},
+	}
+	for _, set := range querySets {
+		for _, query := range *set.queries {
+			res := &model.Matrix{}
+			Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+			mapResults[query.QueryString] = &mockPromResult{value: *res}
+			if set.report != "" {
+				setOf[query.QueryString] = set.report
+			}
+		}
+	}
+	conn := &overlapPrometheusConnection{
+		mockPrometheusConnection: mockPrometheusConnection{mappedResults: &mapResults, t: t},
+		setOf:                    setOf,
+		running:                  map[string]int{},
+	}
+	fakeCollector := &PromCollector{
+		PromConn:    conn,
+		TimeSeries:  &fakeTimeRange,
+		Log:         testLogger,
+		Parallelism: 4,
+	}
+	if err := GenerateReports(&kokumetricscfgv1beta1.KokuMetricsConfig{}, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+	if !conn.overlap {
+		t.Errorf("the query sets of the reports ran one after another")
+	}
+}
+
+// minuteSamples returns the values as samples taken every minute from the start of fakeTimeRange.
+func minuteSamples(values ...float64) []model.SamplePair {
+	samples := []model.SamplePair{}
+	for i, v := range values {
+		ts := fakeTimeRange.Start.Add(time.Duration(i) * time.Minute)
+		samples = append(samples, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: model.SampleValue(v)})
+	}
+	return samples
+}
+
+// repeat returns n copies of the value.
+func repeat(value float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func TestNetworkValues(t *testing.T) {
+	pod := func(namespace, name string) model.Metric {
+		return model.Metric{"namespace": model.LabelValue(namespace), "pod": model.LabelValue(name), "node": "node-1"}
+	}
+	networkValuesTests := []struct {
+		name    string
+		receive model.Matrix
+		want    mappedResults
+	}{
+		{
+			name:    "constant rate",
+			receive: model.Matrix{{Metric: pod("shop", "web-1"), Values: minuteSamples(repeat(100, 60)...)}},
+			want: mappedResults{"shop/web-1": {
+				"namespace":                            "shop",
+				"pod":                                  "web-1",
+				"node":                                 "node-1",
+				"pod-network-receive-bytes-per-second": "100.000000",
+				"pod-network-receive-bytes":            "360000.000000",
+			}},
+		},
+		{
+			name:    "changing rate",
+			receive: model.Matrix{{Metric: pod("shop", "web-1"), Values: minuteSamples(append(repeat(100, 30), repeat(300, 30)...)...)}},
+			want: mappedResults{"shop/web-1": {
+				"namespace":                            "shop",
+				"pod":                                  "web-1",
+				"node":                                 "node-1",
+				"pod-network-receive-bytes-per-second": "200.000000",
+				"pod-network-receive-bytes":            "720000.000000",
+			}},
+		},
+		{
+			name:    "pod running for half of the interval",
+			receive: model.Matrix{{Metric: pod("shop", "web-1"), Values: minuteSamples(repeat(100, 30)...)}},
+			want: mappedResults{"shop/web-1": {
+				"namespace":                            "shop",
+				"pod":                                  "web-1",
+				"node":                                 "node-1",
+				"pod-network-receive-bytes-per-second": "100.000000",
+				"pod-network-receive-bytes":            "180000.000000",
+			}},
+		},
+		{
+			name: "same pod name in two namespaces",
+			receive: model.Matrix{
+				{Metric: pod("shop", "web-1"), Values: minuteSamples(repeat(10, 30)...)},
+				{Metric: pod("staging", "web-1"), Values: minuteSamples(repeat(20, 60)...)},
+			},
+			want: mappedResults{
+				"shop/web-1": {
+					"namespace":                            "shop",
+					"pod":                                  "web-1",
+					"node":                                 "node-1",
+					"pod-network-receive-bytes-per-second": "10.000000",
+					"pod-network-receive-bytes":            "18000.000000",
+				},
+				"staging/web-1": {
+					"namespace":                            "staging",
+					"pod":                                  "web-1",
+					"node":                                 "node-1",
+					"pod-network-receive-bytes-per-second": "20.000000",
+					"pod-network-receive-bytes":            "72000.000000",
+				},
+			},
+		},
+	}
+	for _, tt := range networkValuesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapResults := mappedMockPromResult{}
+			for _, q := range *networkQueries {
+				mapResults[q.QueryString] = &mockPromResult{value: model.Matrix{}}
+			}
+			mapResults[(*networkQueries)[0].QueryString] = &mockPromResult{value: tt.receive}
+			col := PromCollector{
+				PromConn:   mockPrometheusConnection{mappedResults: &mapResults, t: t},
+				TimeSeries: &fakeTimeRange,
+				Log:        testLogger,
+			}
+			got := mappedResults{}
+			if err := col.getQueryResults(networkQueries, &got); err != nil {
+				t.Fatalf("getQueryResults got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got:\n\t%v\n  want:\n\t%v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// generateRows generates the reports from the matrices of the named queries, with an empty result for every other
+// query, and returns the sorted rows of the report with the file prefix, without the date columns. A node is added to
+// the node queries unless the matrices have one, because the reports are only written when there are nodes.
+func generateRows(t *testing.T, matrices map[string]model.Matrix, filePrefix string) []string {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: tempDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(tempDir, "reports")},
+	}
+	if _, ok := matrices["node-capacity-cpu-cores"]; !ok {
+		matrices["node-capacity-cpu-cores"] = model.Matrix{{
+			Metric: model.Metric{"node": "node-1", "provider_id": "aws:///us-east-2a/i-1"},
+			Values: minuteSamples(repeat(4, 60)...),
+		}}
+	}
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	for _, q := range queryList {
+		for _, query := range *q {
+			mapResults[query.QueryString] = &mockPromResult{value: model.Matrix{}}
+			if matrix, ok := matrices[query.Name]; ok {
+				mapResults[query.QueryString] = &mockPromResult{value: matrix}
+			}
+		}
+	}
+	fakeCollector := &PromCollector{
+		PromConn:   mockPrometheusConnection{mappedResults: &mapResults, t: t},
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+	}
+	if err := GenerateReports(&kokumetricscfgv1beta1.KokuMetricsConfig{}, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dirCfg.Reports.Path, filePrefix+"202011.csv"))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	rows := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		rows = append(rows, strings.Join(strings.Split(line, ",")[4:], ","))
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func TestContainerRows(t *testing.T) {
+	container := func(namespace, pod, name string) model.Metric {
+		return model.Metric{"namespace": model.LabelValue(namespace), "pod": model.LabelValue(pod), "container": model.LabelValue(name), "node": "node-1"}
+	}
+	containerRowsTests := []struct {
+		name     string
+		matrices map[string]model.Matrix
+		want     []string
+	}{
+		{
+			name: "usage and requests of a container are one row",
+			matrices: map[string]model.Matrix{
+				"container-usage-cpu-cores":   {{Metric: container("shop", "web-1", "app"), Values: minuteSamples(repeat(0.5, 60)...)}},
+				"container-request-cpu-cores": {{Metric: container("shop", "web-1", "app"), Values: minuteSamples(repeat(1, 60)...)}},
+			},
+			want: []string{"node-1,shop,web-1,app,1800.000000,3600.000000,,,,"},
+		},
+		{
+			name: "containers of a pod",
+			matrices: map[string]model.Matrix{
+				"container-usage-cpu-cores": {
+					{Metric: container("shop", "web-1", "app"), Values: minuteSamples(repeat(1, 60)...)},
+					{Metric: container("shop", "web-1", "proxy"), Values: minuteSamples(repeat(0.25, 60)...)},
+				},
+			},
+			want: []string{
+				"node-1,shop,web-1,app,3600.000000,,,,,",
+				"node-1,shop,web-1,proxy,900.000000,,,,,",
+			},
+		},
+		{
+			name: "same container and pod names in other pods and namespaces",
+			matrices: map[string]model.Matrix{
+				"container-usage-memory-bytes": {
+					{Metric: container("shop", "web-1", "app"), Values: minuteSamples(repeat(1, 60)...)},
+					{Metric: container("shop", "web-2", "app"), Values: minuteSamples(repeat(2, 60)...)},
+					{Metric: container("staging", "web-1", "app"), Values: minuteSamples(repeat(3, 60)...)},
+				},
+			},
+			want: []string{
+				"node-1,shop,web-1,app,,,,3600.000000,,",
+				"node-1,shop,web-2,app,,,,7200.000000,,",
+				"node-1,staging,web-1,app,,,,10800.000000,,",
+			},
+		},
+	}
+	for _, tt := range containerRowsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateRows(t, tt.matrices, containerFilePrefix)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got:\n\t%v\n  want:\n\t%v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendedResourceRows(t *testing.T) {
+	pod := func(pod, node, resource string) model.Metric {
+		return model.Metric{"namespace": "shop", "pod": model.LabelValue(pod), "node": model.LabelValue(node), "resource": model.LabelValue(resource), "unit": "integer"}
+	}
+	node := func(node, resource string) model.Metric {
+		return model.Metric{"node": model.LabelValue(node), "resource": model.LabelValue(resource), "unit": "integer"}
+	}
+	extendedResourceRowsTests := []struct {
+		name     string
+		matrices map[string]model.Matrix
+		want     []string
+	}{
+		{
+			name: "capacity of the node of each pod",
+			matrices: map[string]model.Matrix{
+				"pod-request-extended-resources": {
+					{Metric: pod("web-1", "node-1", "nvidia_com_gpu"), Values: minuteSamples(repeat(1, 60)...)},
+					{Metric: pod("web-2", "node-2", "nvidia_com_gpu"), Values: minuteSamples(repeat(2, 60)...)},
+				},
+				"node-capacity-extended-resources": {
+					{Metric: node("node-1", "nvidia_com_gpu"), Values: minuteSamples(repeat(4, 60)...)},
+					{Metric: node("node-2", "nvidia_com_gpu"), Values: minuteSamples(repeat(8, 60)...)},
+				},
+			},
+			want: []string{
+				"node-1,shop,web-1,nvidia_com_gpu,integer,3600.000000,,4.000000,14400.000000,",
+				"node-2,shop,web-2,nvidia_com_gpu,integer,7200.000000,,8.000000,28800.000000,",
+			},
+		},
+		{
+			name: "capacity of the same resource",
+			matrices: map[string]model.Matrix{
+				"pod-limit-extended-resources": {
+					{Metric: pod("web-1", "node-1", "xilinx_com_fpga"), Values: minuteSamples(repeat(1, 60)...)},
+				},
+				"node-capacity-extended-resources": {
+					{Metric: node("node-1", "nvidia_com_gpu"), Values: minuteSamples(repeat(4, 60)...)},
+					{Metric: node("node-1", "xilinx_com_fpga"), Values: minuteSamples(repeat(2, 60)...)},
+				},
+				"node-allocatable-extended-resources": {
+					{Metric: node("node-1", "nvidia_com_gpu"), Values: minuteSamples(repeat(3, 60)...)},
+					{Metric: node("node-1", "xilinx_com_fpga"), Values: minuteSamples(repeat(1, 60)...)},
+				},
+			},
+			want: []string{"node-1,shop,web-1,xilinx_com_fpga,integer,,3600.000000,2.000000,7200.000000,3600.000000"},
+		},
+		{
+			name: "node without capacity",
+			matrices: map[string]model.Matrix{
+				"pod-request-extended-resources": {
+					{Metric: pod("web-1", "node-3", "nvidia_com_gpu"), Values: minuteSamples(repeat(1, 60)...)},
+				},
+				"node-capacity-extended-resources": {
+					{Metric: node("node-1", "nvidia_com_gpu"), Values: minuteSamples(repeat(4, 60)...)},
+				},
+			},
+			want: []string{"node-3,shop,web-1,nvidia_com_gpu,integer,3600.000000,,,,"},
+		},
+	}
+	for _, tt := range extendedResourceRowsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateRows(t, tt.matrices, resourceFilePrefix)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got:\n\t%v\n  want:\n\t%v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceQuotaAndLimitRangeRows(t *testing.T) {
+	quota := func(namespace, resource string) model.Metric {
+		return model.Metric{"namespace": model.LabelValue(namespace), "resourcequota": "compute", "resource": model.LabelValue(resource)}
+	}
+	limit := func(limitType, resource string) model.Metric {
+		return model.Metric{"namespace": "shop", "limitrange": "limits", "type": model.LabelValue(limitType), "resource": model.LabelValue(resource)}
+	}
+	rowsTests := []struct {
+		name       string
+		matrices   map[string]model.Matrix
+		filePrefix string
+		want       []string
+	}{
+		{
+			name: "hard and used of a quota resource are one row",
+			matrices: map[string]model.Matrix{
+				"resourcequota-hard": {{Metric: quota("shop", "requests.cpu"), Values: minuteSamples(repeat(10, 60)...)}},
+				"resourcequota-used": {{Metric: quota("shop", "requests.cpu"), Values: minuteSamples(repeat(4, 60)...)}},
+			},
+			filePrefix: quotaFilePrefix,
+			want:       []string{"shop,compute,requests.cpu,10.000000,4.000000"},
+		},
+		{
+			name: "quota resources and namespaces",
+			matrices: map[string]model.Matrix{
+				"resourcequota-hard": {
+					{Metric: quota("shop", "requests.cpu"), Values: minuteSamples(append(repeat(10, 30), repeat(20, 30)...)...)},
+					{Metric: quota("shop", "requests.memory"), Values: minuteSamples(repeat(1024, 60)...)},
+					{Metric: quota("staging", "requests.cpu"), Values: minuteSamples(repeat(2, 60)...)},
+				},
+			},
+			filePrefix: quotaFilePrefix,
+			want: []string{
+				"shop,compute,requests.cpu,20.000000,",
+				"shop,compute,requests.memory,1024.000000,",
+				"staging,compute,requests.cpu,2.000000,",
+			},
+		},
+		{
+			name: "constraints of a limit range item are one row",
+			matrices: map[string]model.Matrix{
+				"limitrange-min":     {{Metric: limit("Container", "cpu"), Values: minuteSamples(repeat(0.1, 60)...)}},
+				"limitrange-max":     {{Metric: limit("Container", "cpu"), Values: minuteSamples(repeat(2, 60)...)}},
+				"limitrange-default": {{Metric: limit("Container", "cpu"), Values: minuteSamples(repeat(0.5, 60)...)}},
+			},
+			filePrefix: limitRangeFilePrefix,
+			want:       []string{"shop,limits,Container,cpu,0.100000,2.000000,0.500000,,"},
+		},
+		{
+			name: "limit range types and resources",
+			matrices: map[string]model.Matrix{
+				"limitrange-max": {
+					{Metric: limit("Container", "cpu"), Values: minuteSamples(repeat(2, 60)...)},
+					{Metric: limit("Pod", "cpu"), Values: minuteSamples(repeat(4, 60)...)},
+					{Metric: limit("Container", "memory"), Values: minuteSamples(repeat(1024, 60)...)},
+				},
+			},
+			filePrefix: limitRangeFilePrefix,
+			want: []string{
+				"shop,limits,Container,cpu,,2.000000,,,",
+				"shop,limits,Container,memory,,1024.000000,,,",
+				"shop,limits,Pod,cpu,,4.000000,,,",
+			},
+		},
+	}
+	for _, tt := range rowsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateRows(t, tt.matrices, tt.filePrefix)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got:\n\t%v\n  want:\n\t%v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/project-koku/koku-metrics-operator/strset"
+)
+
+var (
+	// indexDir is the hidden directory in the reports directory that keeps the deduplication index of every report.
+	// Packaging only moves the CSV files, so the index stays behind and is rebuilt when the report file is recreated.
+	indexDir = ".index"
+
+	indexStateFile = "state"
+
+	// removedFile keeps the keys of the rows replaced by re-collected rows until RemoveReplacedRows removes them from
+	// the report file. It is kept when the index is rebuilt.
+	removedFile = "removed"
+
+	// rowKeySize is the size of a row key, which is the 64-bit FNV-1a hash of the row. An index entry is the key of the
+	// entity of a row followed by the key of the row.
+	rowKeySize = 8
+	entrySize  = 2 * rowKeySize
+)
+
+// rowKey returns the key of a row in the index.
+func rowKey(line string) string {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return string(h.Sum(nil))
+}
+
+// columnIndexes returns the positions of the columns in the headers.
+func columnIndexes(headers []string, columns ...string) []int {
+	indexes := []int{}
+	for _, col := range columns {
+		for i, header := range headers {
+			if header == col {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// writtenRows maps the entity of every row of an interval in the report file to the key of the row. A row is
+// identified by its interval and the values of the entity columns, so a re-collected row of an entity replaces the row
+// that was written for it before instead of being added next to it.
+type writtenRows struct {
+	entityColumns []int
+	rows          map[string]string
+	replaced      *strset.Set
+}
+
+func newWrittenRows(entityColumns []int) *writtenRows {
+	return &writtenRows{entityColumns: entityColumns, rows: map[string]string{}, replaced: strset.NewSet()}
+}
+
+// entityKey returns the key of the entity of a row. Without entity columns every row is its own entity, so rows are
+// only ever added.
+func (w *writtenRows) entityKey(values []string, line string) string {
+	if len(w.entityColumns) == 0 {
+		return rowKey(line)
+	}
+	entity := make([]string, 0, len(w.entityColumns))
+	for _, i := range w.entityColumns {
+		if i < len(values) {
+			entity = append(entity, values[i])
+		}
+	}
+	return rowKey(strings.Join(entity, ","))
+}
+
+// add records the row of its entity and reports whether the row has to be written. The key of a row it replaces is
+// kept in replaced, so that the old row can be removed from the report file.
+func (w *writtenRows) add(values []string, line string) bool {
+	return w.set(w.entityKey(values, line), rowKey(line))
+}
+
+func (w *writtenRows) set(entity, key string) bool {
+	old, ok := w.rows[entity]
+	if ok && old == key {
+		return false
+	}
+	if ok {
+		w.replaced.Add(old)
+	}
+	w.rows[entity] = key
+	return true
+}
+
+// reportIndex keeps the keys of the rows written to a report file in one file per interval, so that a write only reads
+// the keys of its own interval no matter how large the report grows. The state file records the size and modification
+// time of the report file after the last indexed write. An index whose state does not match the report file, because
+// the report was packaged, recreated or written without the index, is rebuilt from the report file.
+type reportIndex struct {
+	dir string
+}
+
+func newReportIndex(reportsPath, reportName string) *reportIndex {
+	return &reportIndex{dir: filepath.Join(reportsPath, indexDir, reportName)}
+}
+
+func (idx *reportIndex) intervalPath(prefix string) string {
+	return filepath.Join(idx.dir, hex.EncodeToString([]byte(rowKey(prefix)))+".idx")
+}
+
+func stateOf(info os.FileInfo) string {
+	return strconv.FormatInt(info.Size(), 10) + " " + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+}
+
+// current reports whether the index matches the report file.
+func (idx *reportIndex) current(info os.FileInfo) bool {
+	state, err := ioutil.ReadFile(filepath.Join(idx.dir, indexStateFile))
+	return err == nil && string(state) == stateOf(info)
+}
+
+// load returns the rows of the interval, rebuilding the index from the report file first if it is missing or stale.
+// When an entity has more than one row in the interval, which happens to reports written before rows were replaced,
+// the earlier rows are returned as replaced so that the next write removes them.
+func (idx *reportIndex) load(csvFile *os.File, prefix string, entityColumns []int) (*writtenRows, error) {
+	info, err := csvFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("load index: %v", err)
+	}
+	if !idx.current(info) {
+		if err := idx.rebuild(csvFile, info, entityColumns); err != nil {
+			return nil, err
+		}
+	}
+	rows := newWrittenRows(entityColumns)
+	entries, err := ioutil.ReadFile(idx.intervalPath(prefix))
+	if os.IsNotExist(err) {
+		return rows, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load index: %v", err)
+	}
+	for i := 0; i+entrySize <= len(entries); i += entrySize {
+		rows.set(string(entries[i:i+rowKeySize]), string(entries[i+rowKeySize:i+entrySize]))
+	}
+	return rows, nil
+}
+
+// linePrefix returns the dates at the start of a report row, which identify its interval.
+func linePrefix(line string) string {
+	end := 0
+	for i := 0; i < 4; i++ {
+		next := strings.IndexByte(line[end:], ',')
+		if next < 0 {
+			return line
+		}
+		end += next + 1
+	}
+	return line[:end-1]
+}
+
+// rebuild indexes every row of the report file. The rows of an interval are not always adjacent, because re-collected
+// rows are appended after the rows of later intervals, so the keys of every run of rows are appended to the file of
+// its interval and only the keys of one run are held in memory at a time.
+func (idx *reportIndex) rebuild(handle io.Reader, info os.FileInfo, entityColumns []int) error {
+	if err := os.MkdirAll(idx.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("rebuild index: %v", err)
+	}
+	files, err := ioutil.ReadDir(idx.dir)
+	if err != nil {
+		return fmt.Errorf("rebuild index: %v", err)
+	}
+	for _, f := range files {
+		if f.Name() == removedFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(idx.dir, f.Name())); err != nil {
+			return fmt.Errorf("rebuild index: %v", err)
+		}
+	}
+	var prefix string
+	var keys []byte
+	rows := newWrittenRows(entityColumns)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		f, err := os.OpenFile(idx.intervalPath(prefix), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("rebuild index: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.Write(keys); err != nil {
+			return fmt.Errorf("rebuild index: %v", err)
+		}
+		keys = keys[:0]
+		return nil
+	}
+	reader := newCSVReader(handle)
+	for first := true; ; first = false {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("rebuild index: failed to read csv: %v", err)
+		}
+		if first {
+			continue // skip headers
+		}
+		line := strings.Join(values, ",")
+		if p := linePrefix(line); p != prefix {
+			if err := flush(); err != nil {
+				return err
+			}
+			prefix = p
+		}
+		keys = append(keys, rows.entityKey(values, line)...)
+		keys = append(keys, rowKey(line)...)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(idx.dir, indexStateFile), []byte(stateOf(info)))
+}
+
+// save replaces the rows of the interval and records the state of the report file after the write.
+func (idx *reportIndex) save(prefix string, rows *writtenRows, info os.FileInfo) error {
+	if err := os.MkdirAll(idx.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("save index: %v", err)
+	}
+	keys := make([]byte, 0, len(rows.rows)*entrySize)
+	for entity, key := range rows.rows {
+		keys = append(keys, entity...)
+		keys = append(keys, key...)
+	}
+	if err := writeFileAtomic(idx.intervalPath(prefix), keys); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(idx.dir, indexStateFile), []byte(stateOf(info)))
+}
+
+func newCSVReader(handle io.Reader) *csv.Reader {
+	reader := csv.NewReader(handle)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return reader
+}
+
+// remove records the rows of the interval that were replaced, so that RemoveReplacedRows removes them from the report
+// file. An entry is the key of the interval followed by the key of the row.
+func (idx *reportIndex) remove(prefix string, keys *strset.Set) error {
+	if err := os.MkdirAll(idx.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("remove rows: %v", err)
+	}
+	entries := make([]byte, 0, keys.Len()*entrySize)
+	for key := range keys.Range() {
+		entries = append(entries, rowKey(prefix)...)
+		entries = append(entries, key...)
+	}
+	f, err := os.OpenFile(filepath.Join(idx.dir, removedFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("remove rows: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(entries); err != nil {
+		return fmt.Errorf("remove rows: %v", err)
+	}
+	return f.Sync()
+}
+
+// removeKey returns the key of a row in the removed rows, which is the key of its interval followed by its own key.
+func removeKey(line string) string {
+	return rowKey(linePrefix(line)) + rowKey(line)
+}
+
+// RemoveReplacedRows removes the rows that were replaced by re-collected rows from the report files. The removals of
+// all intervals written since the last call are done in a single rewrite of each report file, and the rewritten file
+// keeps its index current. It returns the number of rows that were removed.
+func RemoveReplacedRows(reportsPath string) (int, error) {
+	indexes, err := ioutil.ReadDir(filepath.Join(reportsPath, indexDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("RemoveReplacedRows: %v", err)
+	}
+	removed := 0
+	for _, index := range indexes {
+		idx := newReportIndex(reportsPath, index.Name())
+		removedPath := filepath.Join(idx.dir, removedFile)
+		entries, err := ioutil.ReadFile(removedPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("RemoveReplacedRows: %v", err)
+		}
+		keys := strset.NewSet()
+		for i := 0; i+entrySize <= len(entries); i += entrySize {
+			keys.Add(string(entries[i : i+entrySize]))
+		}
+		path := filepath.Join(reportsPath, index.Name())
+		info, err := os.Stat(path)
+		if err == nil {
+			current := idx.current(info)
+			n, err := removeRows(path, keys)
+			if err != nil {
+				return removed, err
+			}
+			removed += n
+			// the index already holds the rows that replaced the removed ones
+			if info, err = os.Stat(path); err == nil && current {
+				err = writeFileAtomic(filepath.Join(idx.dir, indexStateFile), []byte(stateOf(info)))
+			}
+			if err != nil {
+				return removed, fmt.Errorf("RemoveReplacedRows: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return removed, fmt.Errorf("RemoveReplacedRows: %v", err)
+		}
+		if err := os.Remove(removedPath); err != nil {
+			return removed, fmt.Errorf("RemoveReplacedRows: %v", err)
+		}
+	}
+	return removed, nil
+}
+
+// removeRows rewrites the report file without the removed rows. A replaced row is always written before the row that
+// replaced it, so only the first row with a removed key is removed, in case the same row was re-collected again
+// later. It returns the number of rows that were removed.
+func removeRows(path string, keys *strset.Set) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("removeRows: %v", err)
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("removeRows: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if err := out.Chmod(0644); err != nil {
+		return 0, fmt.Errorf("removeRows: %v", err)
+	}
+
+	removed := 0
+	reader, cw := newCSVReader(in), csv.NewWriter(out)
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("removeRows: failed to read csv: %v", err)
+		}
+		if key := removeKey(strings.Join(values, ",")); keys.Contains(key) {
+			keys.Remove(key)
+			removed++
+			continue
+		}
+		if err := cw.Write(values); err != nil {
+			return 0, fmt.Errorf("removeRows: failed to write csv: %v", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return 0, fmt.Errorf("removeRows: failed to write csv: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return 0, fmt.Errorf("removeRows: %v", err)
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, fmt.Errorf("removeRows: %v", err)
+	}
+	return removed, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("save index: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("save index: %v", err)
+	}
+	return nil
+}
+
+// pruneIndexes removes the indexes of report files that are no longer in the reports directory.
+func pruneIndexes(reportsPath string) error {
+	root := filepath.Join(reportsPath, indexDir)
+	indexes, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("pruneIndexes: %v", err)
+	}
+	for _, index := range indexes {
+		if _, err := os.Stat(filepath.Join(reportsPath, index.Name())); os.IsNotExist(err) {
+			if err := os.RemoveAll(filepath.Join(root, index.Name())); err != nil {
+				return fmt.Errorf("pruneIndexes: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+)
+
+func TestLinePrefix(t *testing.T) {
+	linePrefixTests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "report row",
+			line: "2020-11-01 00:00:00 +0000 UTC,2020-12-01 00:00:00 +0000 UTC,2020-11-06 18:00:00 +0000 UTC,2020-11-06 18:59:59 +0000 UTC,node-1,label_a:b",
+			want: "2020-11-01 00:00:00 +0000 UTC,2020-12-01 00:00:00 +0000 UTC,2020-11-06 18:00:00 +0000 UTC,2020-11-06 18:59:59 +0000 UTC",
+		},
+		{name: "dates only", line: "a,b,c,d", want: "a,b,c,d"},
+		{name: "short row", line: "a,b", want: "a,b"},
+	}
+	for _, tt := range linePrefixTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := linePrefix(tt.line); got != tt.want {
+				t.Errorf("%s got %q want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+type indexTestRow struct{ values []string }
+
+func (r indexTestRow) csvHeader() []string {
+	return []string{"report_period_start", "report_period_end", "interval_start", "interval_end", "node"}
+}
+func (r indexTestRow) csvRow() []string { return r.values }
+func (r indexTestRow) string() string   { return strings.Join(r.values, ",") }
+
+func TestReportIndex(t *testing.T) {
+	hour1 := "p1,p2,h1-start,h1-end"
+	hour2 := "p1,p2,h2-start,h2-end"
+	newReport := func(dir, prefix string, nodes ...string) *report {
+		rows := mappedCSVStruct{}
+		for _, node := range nodes {
+			rows[node] = indexTestRow{values: append(strings.Split(prefix, ","), node)}
+		}
+		return &report{
+			file:  &file{name: "cm-openshift-node-usage-202011.csv", path: dir},
+			index: newReportIndex(dir, "cm-openshift-node-usage-202011.csv"),
+			data: &data{
+				queryData: rows,
+				headers:   indexTestRow{}.csvHeader(),
+				prefix:    prefix,
+			},
+		}
+	}
+	rowCount := func(t *testing.T, dir string) int {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cm-openshift-node-usage-202011.csv"))
+		if err != nil {
+			t.Fatalf("failed to read report: %v", err)
+		}
+		return strings.Count(string(data), "\n") - 1
+	}
+
+	indexTests := []struct {
+		name     string
+		prepare  func(t *testing.T, dir string)
+		nodes    []string
+		wantRows int
+	}{
+		{
+			name:     "new report",
+			nodes:    []string{"node-1", "node-2"},
+			wantRows: 2,
+		},
+		{
+			name: "written rows are skipped",
+			prepare: func(t *testing.T, dir string) {
+				if err := newReport(dir, hour1, "node-1", "node-2").writeReport(); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+			},
+			nodes:    []string{"node-1", "node-2", "node-3"},
+			wantRows: 3,
+		},
+		{
+			name: "rows of other intervals are not duplicates",
+			prepare: func(t *testing.T, dir string) {
+				if err := newReport(dir, hour2, "node-1").writeReport(); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+			},
+			nodes:    []string{"node-1"},
+			wantRows: 2,
+		},
+		{
+			name: "missing index is rebuilt",
+			prepare: func(t *testing.T, dir string) {
+				if err := newReport(dir, hour1, "node-1").writeReport(); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+				if err := os.RemoveAll(filepath.Join(dir, indexDir)); err != nil {
+					t.Fatalf("failed to remove index: %v", err)
+				}
+			},
+			nodes:    []string{"node-1", "node-2"},
+			wantRows: 2,
+		},
+		{
+			name: "stale index is rebuilt",
+			prepare: func(t *testing.T, dir string) {
+				if err := newReport(dir, hour1, "node-1").writeReport(); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+				// a row appended without the index
+				f, err := os.OpenFile(filepath.Join(dir, "cm-openshift-node-usage-202011.csv"), os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatalf("failed to open report: %v", err)
+				}
+				f.WriteString(hour1 + ",node-2\n")
+				f.Close()
+			},
+			nodes:    []string{"node-1", "node-2"},
+			wantRows: 2,
+		},
+		{
+			name: "recreated report is not deduplicated against the old index",
+			prepare: func(t *testing.T, dir string) {
+				if err := newReport(dir, hour1, "node-1").writeReport(); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+				// packaging moves the report away
+				if err := os.Remove(filepath.Join(dir, "cm-openshift-node-usage-202011.csv")); err != nil {
+					t.Fatalf("failed to remove report: %v", err)
+				}
+			},
+			nodes:    []string{"node-1"},
+			wantRows: 1,
+		},
+	}
+	for _, tt := range indexTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "index")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			if tt.prepare != nil {
+				tt.prepare(t, dir)
+			}
+			r := newReport(dir, hour1, tt.nodes...)
+			if err := r.writeReport(); err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if got := rowCount(t, dir); got != tt.wantRows {
+				t.Errorf("%s got %d rows want %d", tt.name, got, tt.wantRows)
+			}
+			// the index matches the report after the write, so writing again adds nothing
+			info, err := os.Stat(filepath.Join(dir, "cm-openshift-node-usage-202011.csv"))
+			if err != nil {
+				t.Fatalf("failed to stat report: %v", err)
+			}
+			if !r.index.current(info) {
+				t.Errorf("%s index is stale after the write", tt.name)
+			}
+			if err := newReport(dir, hour1, tt.nodes...).writeReport(); err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if got := rowCount(t, dir); got != tt.wantRows {
+				t.Errorf("%s second write got %d rows want %d", tt.name, got, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestReportIndexSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	csvFile, err := os.Create(filepath.Join(dir, "report.csv"))
+	if err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+	defer csvFile.Close()
+	info, _ := csvFile.Stat()
+
+	idx := newReportIndex(dir, "report.csv")
+	entity := []int{4}
+	rows := newWrittenRows(entity)
+	for _, line := range []string{"a,b,c,d,row-1,1", "a,b,c,d,row-2,1"} {
+		rows.add(strings.Split(line, ","), line)
+	}
+	if err := idx.save("a,b,c,d", rows, info); err != nil {
+		t.Fatalf("save got unexpected error: %v", err)
+	}
+	entries, err := ioutil.ReadFile(idx.intervalPath("a,b,c,d"))
+	if err != nil {
+		t.Fatalf("failed to read interval: %v", err)
+	}
+	if len(entries) != 2*entrySize {
+		t.Errorf("interval has %d bytes want %d", len(entries), 2*entrySize)
+	}
+	got, err := idx.load(csvFile, "a,b,c,d", entity)
+	if err != nil {
+		t.Fatalf("load got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.rows, rows.rows) {
+		t.Errorf("load got %d rows want the 2 saved rows", len(got.rows))
+	}
+	if got.add([]string{"a", "b", "c", "d", "row-1", "1"}, "a,b,c,d,row-1,1") {
+		t.Errorf("a saved row is written again")
+	}
+	if !got.add([]string{"a", "b", "c", "d", "row-1", "2"}, "a,b,c,d,row-1,2") || !got.replaced.Contains(rowKey("a,b,c,d,row-1,1")) {
+		t.Errorf("a changed row does not replace the saved row")
+	}
+}
+
+type upsertTestRow struct{ values []string }
+
+func (r upsertTestRow) csvHeader() []string {
+	return []string{"report_period_start", "report_period_end", "interval_start", "interval_end", "node", "node_labels"}
+}
+func (r upsertTestRow) csvRow() []string { return r.values }
+func (r upsertTestRow) string() string   { return strings.Join(r.values, ",") }
+
+func TestReportUpsert(t *testing.T) {
+	hour1 := "p1,p2,h1-start,h1-end"
+	hour2 := "p1,p2,h2-start,h2-end"
+	reportName := "cm-openshift-node-usage-202011.csv"
+	// newReport writes a row with the labels for each node
+	newReport := func(dir, prefix string, labels map[string]string) *report {
+		rows := mappedCSVStruct{}
+		for node, label := range labels {
+			rows[node] = upsertTestRow{values: append(strings.Split(prefix, ","), node, label)}
+		}
+		headers := upsertTestRow{}.csvHeader()
+		return &report{
+			file:          &file{name: reportName, path: dir},
+			index:         newReportIndex(dir, reportName),
+			entityColumns: columnIndexes(headers, "node"),
+			data: &data{
+				queryData: rows,
+				headers:   headers,
+				prefix:    prefix,
+			},
+		}
+	}
+	write := func(t *testing.T, dir, prefix string, labels map[string]string) *report {
+		r := newReport(dir, prefix, labels)
+		if err := r.writeReport(); err != nil {
+			t.Fatalf("failed to write report: %v", err)
+		}
+		return r
+	}
+	readRows := func(t *testing.T, dir string) []string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, reportName))
+		if err != nil {
+			t.Fatalf("failed to read report: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")[1:]
+		sort.Strings(lines)
+		return lines
+	}
+
+	upsertTests := []struct {
+		name         string
+		prepare      func(t *testing.T, dir string)
+		labels       map[string]string
+		wantRows     []string
+		wantReplaced int
+	}{
+		{
+			name:     "unchanged rows are not replaced",
+			prepare:  func(t *testing.T, dir string) { write(t, dir, hour1, map[string]string{"node-1": "a"}) },
+			labels:   map[string]string{"node-1": "a"},
+			wantRows: []string{hour1 + ",node-1,a"},
+		},
+		{
+			name:         "re-collected rows replace the written rows",
+			prepare:      func(t *testing.T, dir string) { write(t, dir, hour1, map[string]string{"node-1": "a", "node-2": "a"}) },
+			labels:       map[string]string{"node-1": "b", "node-2": "a", "node-3": "a"},
+			wantRows:     []string{hour1 + ",node-1,b", hour1 + ",node-2,a", hour1 + ",node-3,a"},
+			wantReplaced: 1,
+		},
+		{
+			name: "rows of other intervals are kept",
+			prepare: func(t *testing.T, dir string) {
+				write(t, dir, hour1, map[string]string{"node-1": "a"})
+				write(t, dir, hour2, map[string]string{"node-1": "a"})
+			},
+			labels:       map[string]string{"node-1": "b"},
+			wantRows:     []string{hour1 + ",node-1,b", hour2 + ",node-1,a"},
+			wantReplaced: 1,
+		},
+		{
+			name: "rows are replaced after the index is rebuilt",
+			prepare: func(t *testing.T, dir string) {
+				write(t, dir, hour1, map[string]string{"node-1": "a"})
+				if err := os.RemoveAll(filepath.Join(dir, indexDir)); err != nil {
+					t.Fatalf("failed to remove index: %v", err)
+				}
+			},
+			labels:       map[string]string{"node-1": "b"},
+			wantRows:     []string{hour1 + ",node-1,b"},
+			wantReplaced: 1,
+		},
+		{
+			name: "duplicate rows of an entity are removed",
+			prepare: func(t *testing.T, dir string) {
+				content := "report_period_start,report_period_end,interval_start,interval_end,node,node_labels\n" +
+					hour1 + ",node-1,a\n" + hour1 + ",node-1,b\n"
+				if err := ioutil.WriteFile(filepath.Join(dir, reportName), []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write report: %v", err)
+				}
+			},
+			labels:       map[string]string{"node-1": "b"},
+			wantRows:     []string{hour1 + ",node-1,b"},
+			wantReplaced: 1,
+		},
+	}
+	for _, tt := range upsertTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "upsert")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			tt.prepare(t, dir)
+
+			r := write(t, dir, hour1, tt.labels)
+			if r.replacedRows != tt.wantReplaced {
+				t.Errorf("%s got %d replaced rows want %d", tt.name, r.replacedRows, tt.wantReplaced)
+			}
+			removed, err := RemoveReplacedRows(dir)
+			if err != nil {
+				t.Fatalf("%s failed to remove replaced rows: %v", tt.name, err)
+			}
+			if removed != tt.wantReplaced {
+				t.Errorf("%s got %d removed rows want %d", tt.name, removed, tt.wantReplaced)
+			}
+			if got := readRows(t, dir); !reflect.DeepEqual(got, tt.wantRows) {
+				t.Errorf("%s got rows %v want %v", tt.name, got, tt.wantRows)
+			}
+			if _, err := os.Stat(filepath.Join(dir, dirconfig.CorrectionsFile)); err == nil {
+				t.Errorf("%s replacing rows that were not packaged marked corrections", tt.name)
+			}
+			info, err := os.Stat(filepath.Join(dir, reportName))
+			if err != nil {
+				t.Fatalf("failed to stat report: %v", err)
+			}
+			if !r.index.current(info) {
+				t.Errorf("%s index is stale after the write", tt.name)
+			}
+			// writing the same rows again changes nothing
+			if r := write(t, dir, hour1, tt.labels); r.replacedRows != 0 {
+				t.Errorf("%s second write replaced %d rows", tt.name, r.replacedRows)
+			}
+			if got := readRows(t, dir); !reflect.DeepEqual(got, tt.wantRows) {
+				t.Errorf("%s second write got rows %v want %v", tt.name, got, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestRemoveReplacedRows(t *testing.T) {
+	hour1 := "p1,p2,h1-start,h1-end"
+	hour2 := "p1,p2,h2-start,h2-end"
+	reportName := "cm-openshift-node-usage-202011.csv"
+	write := func(t *testing.T, dir, prefix, node, label string) {
+		headers := upsertTestRow{}.csvHeader()
+		r := &report{
+			file:          &file{name: reportName, path: dir},
+			index:         newReportIndex(dir, reportName),
+			entityColumns: columnIndexes(headers, "node"),
+			data: &data{
+				queryData: mappedCSVStruct{node: upsertTestRow{values: append(strings.Split(prefix, ","), node, label)}},
+				headers:   headers,
+				prefix:    prefix,
+			},
+		}
+		if err := r.writeReport(); err != nil {
+			t.Fatalf("failed to write report: %v", err)
+		}
+	}
+	readRows := func(t *testing.T, dir string) []string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, reportName))
+		if err != nil {
+			t.Fatalf("failed to read report: %v", err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")[1:]
+	}
+
+	removeTests := []struct {
+		name        string
+		writes      [][3]string
+		wantPending int
+		wantRows    []string
+	}{
+		{
+			name:        "replaced rows of every interval are removed together",
+			writes:      [][3]string{{hour1, "node-1", "a"}, {hour2, "node-1", "a"}, {hour1, "node-1", "b"}, {hour2, "node-1", "b"}},
+			wantPending: 4,
+			wantRows:    []string{hour1 + ",node-1,b", hour2 + ",node-1,b"},
+		},
+		{
+			name:        "a row re-collected again with its first value is kept",
+			writes:      [][3]string{{hour1, "node-1", "a"}, {hour1, "node-1", "b"}, {hour1, "node-1", "a"}},
+			wantPending: 3,
+			wantRows:    []string{hour1 + ",node-1,a"},
+		},
+	}
+	for _, tt := range removeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "remove")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			for _, w := range tt.writes {
+				write(t, dir, w[0], w[1], w[2])
+			}
+			// the replaced rows stay in the report until they are removed
+			if got := readRows(t, dir); len(got) != tt.wantPending {
+				t.Errorf("%s got %d rows before the removal want %d", tt.name, len(got), tt.wantPending)
+			}
+			if _, err := RemoveReplacedRows(dir); err != nil {
+				t.Fatalf("%s failed to remove replaced rows: %v", tt.name, err)
+			}
+			got := readRows(t, dir)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantRows) {
+				t.Errorf("%s got rows %v want %v", tt.name, got, tt.wantRows)
+			}
+			info, err := os.Stat(filepath.Join(dir, reportName))
+			if err != nil {
+				t.Fatalf("failed to stat report: %v", err)
+			}
+			if !newReportIndex(dir, reportName).current(info) {
+				t.Errorf("%s index is stale after the removal", tt.name)
+			}
+			if _, err := os.Stat(filepath.Join(dir, indexDir, reportName, removedFile)); !os.IsNotExist(err) {
+				t.Errorf("%s removed rows were kept after the removal", tt.name)
+			}
+		})
+	}
+}
+
+func TestPruneIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := pruneIndexes(dir); err != nil {
+		t.Fatalf("pruneIndexes without an index got unexpected error: %v", err)
+	}
+	for _, name := range []string{"kept.csv", "packaged.csv"} {
+		if err := os.MkdirAll(filepath.Join(dir, indexDir, name), os.ModePerm); err != nil {
+			t.Fatalf("failed to create index: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kept.csv"), []byte("header\n"), 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	if err := pruneIndexes(dir); err != nil {
+		t.Fatalf("pruneIndexes got unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, indexDir, "kept.csv")); err != nil {
+		t.Errorf("index of an existing report was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, indexDir, "packaged.csv")); !os.IsNotExist(err) {
+		t.Errorf("index of a packaged report was kept: %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// KubeletRetention is how long the samples are kept. Older intervals cannot be collected from the kubelet source.
+	KubeletRetention = 2 * time.Hour
+
+	podMetricsPath = "/apis/metrics.k8s.io/v1beta1/pods"
+
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// KubeletCollector samples the Kubernetes metrics API and the kubelet summary API of every node on an internal schedule.
+// The samples are stored as series named after the queries of the node, pod and storage reports, so the same rows are
+// produced as with Prometheus. All other query sets return no results.
+type KubeletCollector struct {
+	TimeSeries *promv1.Range
+	Log        logr.Logger
+	// SampleInterval is the time between samples. It is used as the step of the stored series.
+	SampleInterval time.Duration
+
+	client kubeletClient
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	samples sampleStore
+}
+
+// NewKubeletCollector returns a KubeletCollector that reads the cluster through the clientset.
+func NewKubeletCollector(clientset kubernetes.Interface, log logr.Logger, interval time.Duration) *KubeletCollector {
+	return &KubeletCollector{
+		Log:            log,
+		SampleInterval: interval,
+		client:         &kubeAPIClient{clientset: clientset},
+		samples:        sampleStore{},
+	}
+}
+
+// Start samples the cluster every SampleInterval until Stop is called.
+func (c *KubeletCollector) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.sample(ctx, time.Now()); err != nil {
+			c.Log.WithValues("kokumetricsconfig", "KubeletCollector").Error(err, "failed to sample kubelet metrics")
+		}
+	}, c.SampleInterval)
+}
+
+// Stop stops sampling the cluster.
+func (c *KubeletCollector) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// SetTimeSeries sets the time range of the next collection.
+func (c *KubeletCollector) SetTimeSeries(ts *promv1.Range) { c.TimeSeries = ts }
+
+func (c *KubeletCollector) getTimeSeries() *promv1.Range { return c.TimeSeries }
+
+func (c *KubeletCollector) getLogger() logr.Logger { return c.Log }
+
+// the kubelet source never splits a query range
+func (c *KubeletCollector) resetRangeSplits() {}
+
+func (c *KubeletCollector) getRangeSplits() int64 { return 0 }
+
+// getQuerySetsResults merges the stored series of each query into the results of its set. The range step is replaced by
+// the sample interval so that the transformed values are computed from the samples that were actually taken.
+func (c *KubeletCollector) getQuerySetsResults(sets ...querySetResults) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, set := range sets {
+		for _, q := range *set.queries {
+			matrix := c.samples.matrix(q.Name, c.TimeSeries.Start, c.TimeSeries.End)
+			if err := set.results.iterateMatrix(matrix, scaleFactor(q, c.SampleInterval)); err != nil {
+				return err
+			}
+			if err := set.spill.spillIfFull(set.results); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sample stores one sample of every series and drops the samples older than the retention.
+func (c *KubeletCollector) sample(ctx context.Context, now time.Time) error {
+	nodes, err := c.client.listNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	pods, err := c.client.listPods(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+	pvcs, err := c.client.listPersistentVolumeClaims(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list persistentvolumeclaims: %v", err)
+	}
+	pvs, err := c.client.listPersistentVolumes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list persistentvolumes: %v", err)
+	}
+	namespaces, err := c.client.listNamespaces(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %v", err)
+	}
+	podMetrics, err := c.client.getPodMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get pod metrics: %v", err)
+	}
+	// a node whose kubelet does not answer only misses its volume usage, so the other nodes are still sampled
+	summaries := map[string]*statsSummary{}
+	for _, node := range nodes {
+		summary, err := c.client.getSummary(ctx, node.Name)
+		if err != nil {
+			c.Log.WithValues("kokumetricsconfig", "KubeletCollector").Error(err, "failed to get stats summary", "node", node.Name)
+			continue
+		}
+		summaries[node.Name] = summary
+	}
+
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples.addNodes(ts, nodes)
+	c.samples.addPods(ts, pods, podMetrics)
+	c.samples.addVolumes(ts, pods, pvcs, pvs, summaries)
+	c.samples.addNamespaces(ts, namespaces)
+	c.samples.prune(model.TimeFromUnixNano(now.Add(-KubeletRetention).UnixNano()))
+	return nil
+}
+
+// sampleStore holds the sampled series of each query name.
+type sampleStore map[string]map[model.Fingerprint]*model.SampleStream
+
+func (s sampleStore) add(name string, metric model.Metric, ts model.Time, value float64) {
+	if s[name] == nil {
+		s[name] = map[model.Fingerprint]*model.SampleStream{}
+	}
+	fp := metric.Fingerprint()
+	if s[name][fp] == nil {
+		s[name][fp] = &model.SampleStream{Metric: metric}
+	}
+	s[name][fp].Values = append(s[name][fp].Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(value)})
+}
+
+// matrix returns the samples of the series of the query name that were taken within the range.
+func (s sampleStore) matrix(name string, start, end time.Time) model.Matrix {
+	from, to := model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano())
+	matrix := model.Matrix{}
+	for _, stream := range s[name] {
+		var values []model.SamplePair
+		for _, v := range stream.Values {
+			if !v.Timestamp.Before(from) && !v.Timestamp.After(to) {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			matrix = append(matrix, &model.SampleStream{Metric: stream.Metric, Values: values})
+		}
+	}
+	sort.Sort(matrix)
+	return matrix
+}
+
+// prune drops the samples taken before the time and the series without samples.
+func (s sampleStore) prune(before model.Time) {
+	for name, streams := range s {
+		for fp, stream := range streams {
+			i := 0
+			for i < len(stream.Values) && stream.Values[i].Timestamp.Before(before) {
+				i++
+			}
+			stream.Values = stream.Values[i:]
+			if len(stream.Values) == 0 {
+				delete(streams, fp)
+			}
+		}
+		if len(streams) == 0 {
+			delete(s, name)
+		}
+	}
+}
+
+// addLabels adds the labels to the metric the same way kube-state-metrics names them.
+func addLabels(metric model.Metric, labels map[string]string) model.Metric {
+	for key, value := range labels {
+		metric[model.LabelName("label_"+invalidLabelChars.ReplaceAllString(key, "_"))] = model.LabelValue(value)
+	}
+	return metric
+}
+
+// quantityCores returns the CPU quantity in cores.
+func quantityCores(q *resource.Quantity) float64 { return float64(q.MilliValue()) / 1000 }
+
+// quantityBytes returns the memory or storage quantity in bytes.
+func quantityBytes(q *resource.Quantity) float64 { return float64(q.Value()) }
+
+func (s sampleStore) addNodes(ts model.Time, nodes []corev1.Node) {
+	for _, node := range nodes {
+		metric := model.Metric{"node": model.LabelValue(node.Name), "provider_id": model.LabelValue(node.Spec.ProviderID)}
+		s.add("node-allocatable-cpu-cores", metric, ts, quantityCores(node.Status.Allocatable.Cpu()))
+		s.add("node-allocatable-memory-bytes", metric, ts, quantityBytes(node.Status.Allocatable.Memory()))
+		s.add("node-capacity-cpu-cores", metric, ts, quantityCores(node.Status.Capacity.Cpu()))
+		s.add("node-capacity-memory-bytes", metric, ts, quantityBytes(node.Status.Capacity.Memory()))
+		s.add("node-labels", addLabels(model.Metric{"node": model.LabelValue(node.Name)}, node.Labels), ts, 1)
+	}
+}
+
+func (s sampleStore) addNamespaces(ts model.Time, namespaces []corev1.Namespace) {
+	for _, ns := range namespaces {
+		s.add("namespace-labels", addLabels(model.Metric{"namespace": model.LabelValue(ns.Name)}, ns.Labels), ts, 1)
+	}
+}
+
+// isRunning reports whether the pod is scheduled and not terminated, which are the pods kube-state-metrics reports
+// resources for.
+func isRunning(pod corev1.Pod) bool {
+	return pod.Spec.NodeName != "" && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+func (s sampleStore) addPods(ts model.Time, pods []corev1.Pod, metrics []podMetrics) {
+	usage := map[string]corev1.ResourceList{}
+	for _, m := range metrics {
+		cpu, memory := resource.Quantity{}, resource.Quantity{}
+		for _, container := range m.Containers {
+			cpu.Add(*container.Usage.Cpu())
+			memory.Add(*container.Usage.Memory())
+		}
+		usage[m.Namespace+rowKeySeparator+m.Name] = corev1.ResourceList{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}
+	}
+	for _, pod := range pods {
+		if !isRunning(pod) {
+			continue
+		}
+		metric := model.Metric{
+			"namespace": model.LabelValue(pod.Namespace),
+			"pod":       model.LabelValue(pod.Name),
+			"node":      model.LabelValue(pod.Spec.NodeName),
+		}
+		var limitCPU, limitMemory, requestCPU, requestMemory float64
+		for _, container := range pod.Spec.Containers {
+			limitCPU += quantityCores(container.Resources.Limits.Cpu())
+			limitMemory += quantityBytes(container.Resources.Limits.Memory())
+			requestCPU += quantityCores(container.Resources.Requests.Cpu())
+			requestMemory += quantityBytes(container.Resources.Requests.Memory())
+		}
+		s.add("pod-limit-cpu-cores", metric, ts, limitCPU)
+		s.add("pod-limit-memory-bytes", metric, ts, limitMemory)
+		s.add("pod-request-cpu-cores", metric, ts, requestCPU)
+		s.add("pod-request-memory-bytes", metric, ts, requestMemory)
+		// the metrics API reports the pod once its containers were scraped
+		if podUsage, ok := usage[pod.Namespace+rowKeySeparator+pod.Name]; ok {
+			s.add("pod-usage-cpu-cores", metric, ts, quantityCores(podUsage.Cpu()))
+			s.add("pod-usage-memory-bytes", metric, ts, quantityBytes(podUsage.Memory()))
+		}
+		s.add("pod-labels", addLabels(model.Metric{"namespace": metric["namespace"], "pod": metric["pod"]}, pod.Labels), ts, 1)
+	}
+}
+
+// addVolumes stores the series of the bound persistent volume claims. The claims are keyed by the name of their volume.
+func (s sampleStore) addVolumes(ts model.Time, pods []corev1.Pod, pvcs []corev1.PersistentVolumeClaim, pvs []corev1.PersistentVolume, summaries map[string]*statsSummary) {
+	volumes := map[string]string{}
+	for _, pvc := range pvcs {
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+		volumes[pvc.Namespace+rowKeySeparator+pvc.Name] = pvc.Spec.VolumeName
+		volume := model.LabelValue(pvc.Spec.VolumeName)
+		s.add("persistentvolumeclaim-request-bytes", model.Metric{"volumename": volume}, ts, quantityBytes(pvc.Spec.Resources.Requests.Storage()))
+		metric := model.Metric{
+			"namespace":             model.LabelValue(pvc.Namespace),
+			"persistentvolumeclaim": model.LabelValue(pvc.Name),
+			"volumename":            volume,
+		}
+		s.add("persistentvolumeclaim-labels", addLabels(metric, pvc.Labels), ts, 1)
+	}
+	for _, pv := range pvs {
+		metric := model.Metric{
+			"persistentvolume": model.LabelValue(pv.Name),
+			"storageclass":     model.LabelValue(pv.Spec.StorageClassName),
+		}
+		s.add("persistentvolume-labels", addLabels(metric, pv.Labels), ts, 1)
+	}
+	for _, pod := range pods {
+		if !isRunning(pod) {
+			continue
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim == nil {
+				continue
+			}
+			if volume, ok := volumes[pod.Namespace+rowKeySeparator+v.PersistentVolumeClaim.ClaimName]; ok {
+				metric := model.Metric{
+					"namespace":  model.LabelValue(pod.Namespace),
+					"pod":        model.LabelValue(pod.Name),
+					"volumename": model.LabelValue(volume),
+				}
+				s.add("persistentvolume_pod_info", metric, ts, 1)
+			}
+		}
+	}
+	for _, summary := range summaries {
+		for _, pod := range summary.Pods {
+			for _, v := range pod.Volumes {
+				if v.PVCRef == nil {
+					continue
+				}
+				volume, ok := volumes[v.PVCRef.Namespace+rowKeySeparator+v.PVCRef.Name]
+				if !ok {
+					continue
+				}
+				metric := model.Metric{"volumename": model.LabelValue(volume)}
+				if v.CapacityBytes != nil {
+					s.add("persistentvolumeclaim-capacity-bytes", metric, ts, float64(*v.CapacityBytes))
+				}
+				if v.UsedBytes != nil {
+					s.add("persistentvolumeclaim-usage-bytes", metric, ts, float64(*v.UsedBytes))
+				}
+			}
+		}
+	}
+}
+
+// podMetrics is the subset of the metrics.k8s.io PodMetrics that is sampled.
+type podMetrics struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Containers        []containerMetrics `json:"containers"`
+}
+
+type containerMetrics struct {
+	Name  string              `json:"name"`
+	Usage corev1.ResourceList `json:"usage"`
+}
+
+type podMetricsList struct {
+	Items []podMetrics `json:"items"`
+}
+
+// statsSummary is the subset of the kubelet /stats/summary response that is sampled.
+type statsSummary struct {
+	Pods []podStats `json:"pods"`
+}
+
+type podStats struct {
+	Volumes []volumeStats `json:"volume,omitempty"`
+}
+
+type volumeStats struct {
+	Name          string        `json:"name"`
+	PVCRef        *pvcReference `json:"pvcRef,omitempty"`
+	CapacityBytes *uint64       `json:"capacityBytes,omitempty"`
+	UsedBytes     *uint64       `json:"usedBytes,omitempty"`
+}
+
+type pvcReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// kubeletClient reads the objects and metrics sampled by the KubeletCollector.
+type kubeletClient interface {
+	listNodes(ctx context.Context) ([]corev1.Node, error)
+	listNamespaces(ctx context.Context) ([]corev1.Namespace, error)
+	listPods(ctx context.Context) ([]corev1.Pod, error)
+	listPersistentVolumeClaims(ctx context.Context) ([]corev1.PersistentVolumeClaim, error)
+	listPersistentVolumes(ctx context.Context) ([]corev1.PersistentVolume, error)
+	getPodMetrics(ctx context.Context) ([]podMetrics, error)
+	getSummary(ctx context.Context, node string) (*statsSummary, error)
+}
+
+// kubeAPIClient reads the kubelet summaries through the API server node proxy.
+type kubeAPIClient struct {
+	clientset kubernetes.Interface
+}
+
+func (k *kubeAPIClient) listNodes(ctx context.Context) ([]corev1.Node, error) {
+	list, err := k.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) listNamespaces(ctx context.Context) ([]corev1.Namespace, error) {
+	list, err := k.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) listPods(ctx context.Context) ([]corev1.Pod, error) {
+	list, err := k.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) listPersistentVolumeClaims(ctx context.Context) ([]corev1.PersistentVolumeClaim, error) {
+	list, err := k.clientset.CoreV1().PersistentVolumeClaims("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) listPersistentVolumes(ctx context.Context) ([]corev1.PersistentVolume, error) {
+	list, err := k.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) getPodMetrics(ctx context.Context) ([]podMetrics, error) {
+	body, err := k.clientset.CoreV1().RESTClient().Get().AbsPath(podMetricsPath).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := podMetricsList{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode pod metrics: %v", err)
+	}
+	return list.Items, nil
+}
+
+func (k *kubeAPIClient) getSummary(ctx context.Context, node string) (*statsSummary, error) {
+	body, err := k.clientset.CoreV1().RESTClient().Get().Resource("nodes").Name(node).SubResource("proxy", "stats", "summary").DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	summary := &statsSummary{}
+	if err := json.Unmarshal(body, summary); err != nil {
+		return nil, fmt.Errorf("failed to decode stats summary: %v", err)
+	}
+	return summary, nil
+}
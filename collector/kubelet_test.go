@@ -0,0 +1,269 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeKubeletClient struct {
+	nodes      []corev1.Node
+	namespaces []corev1.Namespace
+	pods       []corev1.Pod
+	pvcs       []corev1.PersistentVolumeClaim
+	pvs        []corev1.PersistentVolume
+	podMetrics []podMetrics
+	summaries  map[string]*statsSummary
+	err        error
+	// summaryErr fails the stats summary of the nodes
+	summaryErr map[string]error
+}
+
+func (f *fakeKubeletClient) listNodes(ctx context.Context) ([]corev1.Node, error) {
+	return f.nodes, f.err
+}
+func (f *fakeKubeletClient) listNamespaces(ctx context.Context) ([]corev1.Namespace, error) {
+	return f.namespaces, nil
+}
+func (f *fakeKubeletClient) listPods(ctx context.Context) ([]corev1.Pod, error) { return f.pods, nil }
+func (f *fakeKubeletClient) listPersistentVolumeClaims(ctx context.Context) ([]corev1.PersistentVolumeClaim, error) {
+	return f.pvcs, nil
+}
+func (f *fakeKubeletClient) listPersistentVolumes(ctx context.Context) ([]corev1.PersistentVolume, error) {
+	return f.pvs, nil
+}
+func (f *fakeKubeletClient) getPodMetrics(ctx context.Context) ([]podMetrics, error) {
+	return f.podMetrics, nil
+}
+func (f *fakeKubeletClient) getSummary(ctx context.Context, node string) (*statsSummary, error) {
+	if err := f.summaryErr[node]; err != nil {
+		return nil, err
+	}
+	return f.summaries[node], nil
+}
+
+func resources(cpu, memory string) corev1.ResourceList {
+	return corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu), corev1.ResourceMemory: resource.MustParse(memory)}
+}
+
+func newFakeKubeletClient() *fakeKubeletClient {
+	capacity, used := uint64(10737418240), uint64(1073741824)
+	container := corev1.Container{Resources: corev1.ResourceRequirements{Requests: resources("250m", "1Gi"), Limits: resources("1", "2Gi")}}
+
+	return &fakeKubeletClient{
+		nodes: []corev1.Node{{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"node-role.kubernetes.io/worker": ""}},
+			Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123"},
+			Status:     corev1.NodeStatus{Capacity: resources("4", "16Gi"), Allocatable: resources("3500m", "15Gi")},
+		}},
+		namespaces: []corev1.Namespace{{
+			ObjectMeta: metav1.ObjectMeta{Name: "project", Labels: map[string]string{"team": "payments"}},
+		}},
+		pods: []corev1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "project", Labels: map[string]string{"app": "web"}},
+				Spec: corev1.PodSpec{
+					NodeName:   "node-1",
+					Containers: []corev1.Container{container, container},
+					Volumes: []corev1.Volume{{
+						Name:         "data",
+						VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}},
+					}},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "project"},
+				Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{container}},
+				Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+			},
+		},
+		pvcs: []corev1.PersistentVolumeClaim{{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "project"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName: "pv-1",
+				Resources:  corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+			},
+		}},
+		pvs: []corev1.PersistentVolume{{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec:       corev1.PersistentVolumeSpec{StorageClassName: "gp2"},
+		}},
+		podMetrics: []podMetrics{{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "project"},
+			Containers: []containerMetrics{{Name: "web", Usage: resources("500m", "512Mi")}},
+		}},
+		summaries: map[string]*statsSummary{"node-1": {Pods: []podStats{{Volumes: []volumeStats{{
+			Name:          "data",
+			PVCRef:        &pvcReference{Name: "data", Namespace: "project"},
+			CapacityBytes: &capacity,
+			UsedBytes:     &used,
+		}}}}}},
+	}
+}
+
+func TestKubeletCollectorQuerySetsResults(t *testing.T) {
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         newFakeKubeletClient(),
+		samples:        sampleStore{},
+	}
+	// two samples in the range and one before it
+	for _, ts := range []time.Time{fakeTimeRange.Start.Add(-time.Minute), fakeTimeRange.Start, fakeTimeRange.Start.Add(time.Minute)} {
+		if err := col.sample(context.Background(), ts); err != nil {
+			t.Fatalf("sample got unexpected error: %v", err)
+		}
+	}
+
+	nodeResults, podResults, volResults := mappedResults{}, mappedResults{}, mappedResults{}
+	err := col.getQuerySetsResults(
+		querySetResults{queries: nodeQueries, results: &nodeResults},
+		querySetResults{queries: podQueries, results: &podResults},
+		querySetResults{queries: volQueries, results: &volResults},
+	)
+	if err != nil {
+		t.Fatalf("getQuerySetsResults got unexpected error: %v", err)
+	}
+
+	kubeletTests := []struct {
+		name    string
+		results mappedResults
+		row     string
+		field   string
+		want    string
+	}{
+		{name: "node capacity", results: nodeResults, row: "node-1", field: "node-capacity-cpu-core-seconds", want: "480.000000"},
+		{name: "node allocatable", results: nodeResults, row: "node-1", field: "node-allocatable-cpu-cores", want: "3.500000"},
+		{name: "node provider id", results: nodeResults, row: "node-1", field: "provider_id", want: "aws:///us-east-1a/i-0123"},
+		{name: "node labels", results: nodeResults, row: "node-1", field: "node_labels", want: "label_node_role_kubernetes_io_worker:"},
+		{name: "pod node", results: podResults, row: "project/web", field: "node", want: "node-1"},
+		{name: "pod usage", results: podResults, row: "project/web", field: "pod-usage-cpu-core-seconds", want: "60.000000"},
+		{name: "pod request", results: podResults, row: "project/web", field: "pod-request-cpu-core-seconds", want: "60.000000"},
+		{name: "pod limit", results: podResults, row: "project/web", field: "pod-limit-memory-byte-seconds", want: "515396075520.000000"},
+		{name: "pod labels", results: podResults, row: "project/web", field: "pod_labels", want: "label_app:web"},
+		{name: "volume pod", results: volResults, row: "pv-1", field: "pod", want: "web"},
+		{name: "volume claim", results: volResults, row: "pv-1", field: "persistentvolumeclaim", want: "data"},
+		{name: "volume storage class", results: volResults, row: "pv-1", field: "storageclass", want: "gp2"},
+		{name: "volume usage", results: volResults, row: "pv-1", field: "persistentvolumeclaim-usage-byte-seconds", want: "128849018880.000000"},
+		{name: "volume request", results: volResults, row: "pv-1", field: "persistentvolumeclaim-request-bytes", want: "10737418240.000000"},
+	}
+	for _, tt := range kubeletTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.results[tt.row][tt.field]
+			if !ok {
+				t.Fatalf("%s row %s has no field %s: %v", tt.name, tt.row, tt.field, tt.results[tt.row])
+			}
+			if got != tt.want {
+				t.Errorf("%s got %v want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+	if _, ok := podResults["project/job"]; ok {
+		t.Errorf("completed pod was sampled")
+	}
+}
+
+func TestKubeletCollectorSampleError(t *testing.T) {
+	col := &KubeletCollector{
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         &fakeKubeletClient{err: errTest},
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), time.Now()); err == nil {
+		t.Errorf("sample did not return the client error")
+	}
+	if len(col.samples) != 0 {
+		t.Errorf("failed sample stored series: %v", col.samples)
+	}
+}
+
+func TestKubeletCollectorSampleNodeError(t *testing.T) {
+	client := newFakeKubeletClient()
+	down := client.nodes[0]
+	down.Name = "node-2"
+	client.nodes = append(client.nodes, down)
+	client.summaryErr = map[string]error{"node-2": errTest}
+	col := &KubeletCollector{
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         client,
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), time.Now()); err != nil {
+		t.Fatalf("sample got unexpected error for a failing node: %v", err)
+	}
+	// both nodes are sampled, only the volume usage of the failing node is missing
+	if got := len(col.samples["node-capacity-cpu-cores"]); got != 2 {
+		t.Errorf("sample stored %d nodes want 2", got)
+	}
+	if len(col.samples["persistentvolumeclaim-usage-bytes"]) == 0 {
+		t.Errorf("sample did not store the volume usage of the other node")
+	}
+}
+
+func TestSampleStorePrune(t *testing.T) {
+	s := sampleStore{}
+	s.add("old", model.Metric{"id": "1"}, 1000, 1)
+	s.add("mixed", model.Metric{"id": "1"}, 1000, 1)
+	s.add("mixed", model.Metric{"id": "1"}, 3000, 2)
+	s.prune(2000)
+	if _, ok := s["old"]; ok {
+		t.Errorf("series without samples was not dropped")
+	}
+	values := s["mixed"][model.Metric{"id": "1"}.Fingerprint()].Values
+	if len(values) != 1 || values[0].Timestamp != 3000 {
+		t.Errorf("prune got %v want the sample at 3000", values)
+	}
+}
+
+func TestGenerateReportsKubeletSource(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "kubelet-reports-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
+	}
+
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         newFakeKubeletClient(),
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), fakeTimeRange.Start); err != nil {
+		t.Fatalf("sample got unexpected error: %v", err)
+	}
+	if err := GenerateReports(&kokumetricscfgv1beta1.KokuMetricsConfig{}, dirCfg, col, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	yearMonth := fakeTimeRange.Start.Format("200601")
+	for prefix, want := range map[string]string{nodeFilePrefix: "node-1", podFilePrefix: "project,web", volFilePrefix: "pv-1", namespaceFilePrefix: "label_team:payments"} {
+		data, err := ioutil.ReadFile(filepath.Join(tempDir, prefix+yearMonth+".csv"))
+		if err != nil {
+			t.Errorf("%s report was not generated: %v", prefix, err)
+			continue
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s report does not contain %s:\n%s", prefix, want, data)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+)
+
+var (
+	// labelFields are the report fields with the pod, node, namespace, persistentvolume and persistentvolumeclaim
+	// labels that the label policy applies to.
+	labelFields = []string{"node_labels", "pod_labels", "namespace_labels", "persistentvolume_labels", "persistentvolumeclaim_labels"}
+
+	labelMask = "********"
+)
+
+// labelPolicy redacts the labels that may not be written to the reports verbatim.
+type labelPolicy struct {
+	allow, deny []*regexp.Regexp
+	redaction   kokumetricscfgv1beta1.LabelRedactionType
+	salt        []byte
+}
+
+// newLabelPolicy compiles the regular expressions of the spec. It returns nil when every label is written verbatim.
+func newLabelPolicy(spec *kokumetricscfgv1beta1.LabelPolicySpec, salt []byte) (*labelPolicy, error) {
+	if len(spec.Allow) == 0 && len(spec.Deny) == 0 {
+		return nil, nil
+	}
+	p := &labelPolicy{redaction: spec.Redaction, salt: salt}
+	var err error
+	if p.allow, err = compileFullMatchRegexes(spec.Allow); err != nil {
+		return nil, fmt.Errorf("invalid label policy: %v", err)
+	}
+	if p.deny, err = compileFullMatchRegexes(spec.Deny); err != nil {
+		return nil, fmt.Errorf("invalid label policy: %v", err)
+	}
+	if p.redaction == kokumetricscfgv1beta1.HashLabelRedaction && len(salt) == 0 {
+		return nil, fmt.Errorf("invalid label policy: the hash redaction requires a salt")
+	}
+	return p, nil
+}
+
+// redacted reports whether the label, named as in the reports without the `label_` prefix, is redacted.
+func (p *labelPolicy) redacted(name string) bool {
+	if matchesAny(p.deny, name) {
+		return true
+	}
+	return len(p.allow) > 0 && !matchesAny(p.allow, name)
+}
+
+// hashValue returns the first 128 bits of the HMAC-SHA256 of the value, so that equal values have equal hashes
+// within a cluster but cannot be looked up without the salt.
+func hashValue(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// redactField applies the policy to a field written by findFields, such as `label_a:x|label_b:y`. Label names and
+// values cannot contain `:` or `|`, so the field is split without ambiguity.
+func (p *labelPolicy) redactField(field string) string {
+	if field == "" {
+		return field
+	}
+	result := []string{}
+	for _, pair := range strings.Split(field, "|") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || !p.redacted(strings.TrimPrefix(parts[0], "label_")) {
+			result = append(result, pair)
+			continue
+		}
+		switch p.redaction {
+		case kokumetricscfgv1beta1.HashLabelRedaction:
+			result = append(result, parts[0]+":"+hashValue(p.salt, parts[1]))
+		case kokumetricscfgv1beta1.MaskLabelRedaction:
+			result = append(result, parts[0]+":"+labelMask)
+		}
+	}
+	return strings.Join(result, "|")
+}
+
+// apply redacts the label fields of every row of the results.
+func (p *labelPolicy) apply(results ...*mappedResults) {
+	for _, r := range results {
+		for _, val := range *r {
+			for _, field := range labelFields {
+				if labels, ok := val[field].(string); ok {
+					val[field] = p.redactField(labels)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewLabelPolicy(t *testing.T) {
+	newPolicyTests := []struct {
+		name    string
+		spec    kokumetricscfgv1beta1.LabelPolicySpec
+		salt    []byte
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "empty spec", spec: kokumetricscfgv1beta1.LabelPolicySpec{Redaction: kokumetricscfgv1beta1.HashLabelRedaction}, wantNil: true},
+		{name: "deny", spec: kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer.*"}}},
+		{name: "invalid regex", spec: kokumetricscfgv1beta1.LabelPolicySpec{Allow: []string{"app("}}, wantErr: true},
+		{
+			name:    "hash without salt",
+			spec:    kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer.*"}, Redaction: kokumetricscfgv1beta1.HashLabelRedaction},
+			wantErr: true,
+		},
+		{
+			name: "hash with salt",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer.*"}, Redaction: kokumetricscfgv1beta1.HashLabelRedaction},
+			salt: []byte("salt"),
+		},
+	}
+	for _, tt := range newPolicyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newLabelPolicy(&tt.spec, tt.salt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s got error %v, wanted error %t", tt.name, err, tt.wantErr)
+			}
+			if !tt.wantErr && (got == nil) != tt.wantNil {
+				t.Errorf("%s got policy %v, wanted nil %t", tt.name, got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestLabelPolicyRedactField(t *testing.T) {
+	salt := []byte("cluster-salt")
+	field := "label_app:web|label_customer_name:acme|label_ticket_id:INC-123"
+	redactTests := []struct {
+		name string
+		spec kokumetricscfgv1beta1.LabelPolicySpec
+		want string
+	}{
+		{
+			name: "deny drops by default",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer_.*", "ticket_id"}},
+			want: "label_app:web",
+		},
+		{
+			name: "allow redacts every other label",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Allow: []string{"app"}, Redaction: kokumetricscfgv1beta1.MaskLabelRedaction},
+			want: "label_app:web|label_customer_name:********|label_ticket_id:********",
+		},
+		{
+			name: "deny takes precedence over allow",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Allow: []string{".*"}, Deny: []string{"ticket_id"}, Redaction: kokumetricscfgv1beta1.DropLabelRedaction},
+			want: "label_app:web|label_customer_name:acme",
+		},
+		{
+			name: "deny must match the whole name",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer"}},
+			want: field,
+		},
+		{
+			name: "hash",
+			spec: kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"customer_name"}, Redaction: kokumetricscfgv1beta1.HashLabelRedaction},
+			want: "label_app:web|label_customer_name:" + hashValue(salt, "acme") + "|label_ticket_id:INC-123",
+		},
+	}
+	for _, tt := range redactTests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newLabelPolicy(&tt.spec, salt)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if got := p.redactField(field); got != tt.want {
+				t.Errorf("%s got %s want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashValue(t *testing.T) {
+	if hashValue([]byte("a"), "acme") != hashValue([]byte("a"), "acme") {
+		t.Errorf("hashValue is not consistent")
+	}
+	if hashValue([]byte("a"), "acme") == hashValue([]byte("b"), "acme") {
+		t.Errorf("hashValue does not depend on the salt")
+	}
+	if got := len(hashValue([]byte("a"), "acme")); got != 32 {
+		t.Errorf("hashValue got length %d want 32", got)
+	}
+}
+
+func TestGenerateReportsLabelPolicy(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "label-policy-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
+	}
+
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         newFakeKubeletClient(),
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), fakeTimeRange.Start); err != nil {
+		t.Fatalf("sample got unexpected error: %v", err)
+	}
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.LabelPolicy = kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"app", "team"}, Redaction: kokumetricscfgv1beta1.MaskLabelRedaction}
+	// the namespace filter matches the labels before they are redacted
+	kmCfg.Spec.NamespaceFilter.IncludeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}
+	if err := GenerateReports(kmCfg, dirCfg, col, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	yearMonth := fakeTimeRange.Start.Format("200601")
+	for prefix, want := range map[string]string{podFilePrefix: "label_app:********", namespaceFilePrefix: "label_team:********"} {
+		data, err := ioutil.ReadFile(filepath.Join(tempDir, prefix+yearMonth+".csv"))
+		if err != nil {
+			t.Fatalf("%s report was not generated: %v", prefix, err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s report does not contain %s:\n%s", prefix, want, data)
+		}
+	}
+}
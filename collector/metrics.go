@@ -0,0 +1,41 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	reportPeakHeapBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "koku_metrics_operator_report_peak_heap_inuse_bytes",
+		Help: "Highest heap in use sampled while the reports of the last hour queried were generated.",
+	})
+	reportSpilledRows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "koku_metrics_operator_report_spilled_rows_total",
+		Help: "Number of report rows spilled to disk because a query set had more than max_rows_in_memory rows.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(reportPeakHeapBytes, reportSpilledRows)
+}
+
+// heapPeak keeps the highest heap in use of the samples taken while the reports are generated.
+type heapPeak struct {
+	bytes uint64
+}
+
+func (p *heapPeak) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapInuse > p.bytes {
+		p.bytes = m.HeapInuse
+	}
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+)
+
+// namespaceFilter decides which namespaces are written to the reports.
+type namespaceFilter struct {
+	include, exclude                 []*regexp.Regexp
+	includeSelector, excludeSelector labels.Selector
+}
+
+// newNamespaceFilter compiles the regular expressions and label selectors of the spec. It returns nil when the spec
+// filters nothing.
+func newNamespaceFilter(spec *kokumetricscfgv1beta1.NamespaceFilterSpec) (*namespaceFilter, error) {
+	if len(spec.Include) == 0 && len(spec.Exclude) == 0 && spec.IncludeSelector == nil && spec.ExcludeSelector == nil {
+		return nil, nil
+	}
+	f := &namespaceFilter{}
+	var err error
+	if f.include, err = compileFullMatchRegexes(spec.Include); err != nil {
+		return nil, fmt.Errorf("invalid namespace filter: %v", err)
+	}
+	if f.exclude, err = compileFullMatchRegexes(spec.Exclude); err != nil {
+		return nil, fmt.Errorf("invalid namespace filter: %v", err)
+	}
+	if f.includeSelector, err = namespaceLabelSelector(spec.IncludeSelector); err != nil {
+		return nil, err
+	}
+	if f.excludeSelector, err = namespaceLabelSelector(spec.ExcludeSelector); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compileFullMatchRegexes anchors the expressions so that they match the whole name, as Prometheus label matchers do.
+func compileFullMatchRegexes(exprs []string) ([]*regexp.Regexp, error) {
+	var regexes []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("regex %q: %v", expr, err)
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes, nil
+}
+
+// namespaceLabelSelector converts the selector to one that matches the label names of `kube_namespace_labels`, which
+// are prefixed with `label_` and have every invalid character replaced by an underscore.
+func namespaceLabelSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	promSelector := &metav1.LabelSelector{MatchLabels: map[string]string{}}
+	for key, value := range selector.MatchLabels {
+		promSelector.MatchLabels[promLabelName(key)] = value
+	}
+	for _, expr := range selector.MatchExpressions {
+		expr.Key = promLabelName(expr.Key)
+		promSelector.MatchExpressions = append(promSelector.MatchExpressions, expr)
+	}
+	s, err := metav1.LabelSelectorAsSelector(promSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace filter selector: %v", err)
+	}
+	return s, nil
+}
+
+func promLabelName(key string) string {
+	return "label_" + invalidLabelChars.ReplaceAllString(key, "_")
+}
+
+// parseLabelsField returns the labels of a field written by findFields, such as `label_a:x|label_b:y`.
+func parseLabelsField(field string) labels.Set {
+	set := labels.Set{}
+	for _, pair := range strings.Split(field, "|") {
+		if name := strings.SplitN(pair, ":", 2); len(name) == 2 {
+			set[name[0]] = name[1]
+		}
+	}
+	return set
+}
+
+func matchesAny(regexes []*regexp.Regexp, name string) bool {
+	for _, re := range regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the namespace with the labels is written to the reports.
+func (f *namespaceFilter) allowed(namespace string, nsLabels labels.Set) bool {
+	if matchesAny(f.exclude, namespace) || (f.excludeSelector != nil && f.excludeSelector.Matches(nsLabels)) {
+		return false
+	}
+	if len(f.include) == 0 && f.includeSelector == nil {
+		return true
+	}
+	return matchesAny(f.include, namespace) || (f.includeSelector != nil && f.includeSelector.Matches(nsLabels))
+}
+
+// apply removes the rows of filtered namespaces from the results. The namespace labels are read from the results of
+// the namespace query set. Rows without a namespace are kept. It returns the number of removed rows.
+func (f *namespaceFilter) apply(namespaceResults mappedResults, results ...*mappedResults) int {
+	return f.applyLabels(namespaceLabels(namespaceResults), results...)
+}
+
+// namespaceLabels returns the labels of every namespace in the results of the namespace query set.
+func namespaceLabels(namespaceResults mappedResults) map[string]labels.Set {
+	nsLabels := map[string]labels.Set{}
+	for _, val := range namespaceResults {
+		namespace, _ := val["namespace"].(string)
+		field, _ := val["namespace_labels"].(string)
+		nsLabels[namespace] = parseLabelsField(field)
+	}
+	return nsLabels
+}
+
+// applyLabels removes the rows of filtered namespaces from the results using the namespace labels.
+func (f *namespaceFilter) applyLabels(nsLabels map[string]labels.Set, results ...*mappedResults) int {
+	decisions := map[string]bool{}
+	removed := 0
+	for _, r := range results {
+		for key, val := range *r {
+			namespace, _ := val["namespace"].(string)
+			if namespace == "" {
+				continue
+			}
+			allowed, ok := decisions[namespace]
+			if !ok {
+				allowed = f.allowed(namespace, nsLabels[namespace])
+				decisions[namespace] = allowed
+			}
+			if !allowed {
+				delete(*r, key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewNamespaceFilter(t *testing.T) {
+	newFilterTests := []struct {
+		name    string
+		spec    kokumetricscfgv1beta1.NamespaceFilterSpec
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "empty spec", wantNil: true},
+		{name: "regexes", spec: kokumetricscfgv1beta1.NamespaceFilterSpec{Include: []string{"project-.*"}, Exclude: []string{"openshift-.*"}}},
+		{name: "invalid regex", spec: kokumetricscfgv1beta1.NamespaceFilterSpec{Exclude: []string{"openshift-("}}, wantErr: true},
+		{
+			name: "invalid selector",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{ExcludeSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Between"}},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range newFilterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newNamespaceFilter(&tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s got error %v, wanted error %t", tt.name, err, tt.wantErr)
+			}
+			if !tt.wantErr && (got == nil) != tt.wantNil {
+				t.Errorf("%s got filter %v, wanted nil %t", tt.name, got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestNamespaceFilterApply(t *testing.T) {
+	namespaceResults := mappedResults{
+		"project-a":     {"namespace": "project-a", "namespace_labels": "label_team:payments"},
+		"project-b":     {"namespace": "project-b", "namespace_labels": "label_sandbox_example_com_enabled:true|label_team:search"},
+		"openshift-dns": {"namespace": "openshift-dns", "namespace_labels": ""},
+	}
+	newResults := func() mappedResults {
+		return mappedResults{
+			"project-a/web":     {"namespace": "project-a", "pod": "web"},
+			"project-b/db":      {"namespace": "project-b", "pod": "db"},
+			"openshift-dns/dns": {"namespace": "openshift-dns", "pod": "dns"},
+			"legacy/app":        {"namespace": "legacy", "pod": "app"},
+			"pv-1":              {"persistentvolume": "pv-1"},
+		}
+	}
+	applyTests := []struct {
+		name string
+		spec kokumetricscfgv1beta1.NamespaceFilterSpec
+		want []string
+	}{
+		{
+			name: "exclude regex",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{Exclude: []string{"openshift-.*"}},
+			want: []string{"legacy/app", "project-a/web", "project-b/db", "pv-1"},
+		},
+		{
+			name: "include regex must match the whole name",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{Include: []string{"project"}},
+			want: []string{"pv-1"},
+		},
+		{
+			name: "include regex and exclude selector",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{
+				Include:         []string{"project-.*"},
+				ExcludeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"sandbox.example.com/enabled": "true"}},
+			},
+			want: []string{"project-a/web", "pv-1"},
+		},
+		{
+			name: "include selector",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{IncludeSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: metav1.LabelSelectorOpExists}},
+			}},
+			want: []string{"project-a/web", "project-b/db", "pv-1"},
+		},
+		{
+			name: "include regex or include selector",
+			spec: kokumetricscfgv1beta1.NamespaceFilterSpec{
+				Include:         []string{"legacy"},
+				IncludeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			},
+			want: []string{"legacy/app", "project-a/web", "pv-1"},
+		},
+	}
+	for _, tt := range applyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newNamespaceFilter(&tt.spec)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			results := newResults()
+			removed := f.apply(namespaceResults, &results)
+			got := []string{}
+			for _, key := range []string{"legacy/app", "openshift-dns/dns", "project-a/web", "project-b/db", "pv-1"} {
+				if _, ok := results[key]; ok {
+					got = append(got, key)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got rows %v want %v", tt.name, got, tt.want)
+			}
+			if removed != 5-len(tt.want) {
+				t.Errorf("%s removed %d rows, want %d", tt.name, removed, 5-len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGenerateReportsNamespaceFilter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "namespace-filter-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: "."},
+		Reports: dirconfig.Directory{Path: tempDir},
+	}
+
+	col := &KubeletCollector{
+		TimeSeries:     &fakeTimeRange,
+		Log:            testLogger,
+		SampleInterval: time.Minute,
+		client:         newFakeKubeletClient(),
+		samples:        sampleStore{},
+	}
+	if err := col.sample(context.Background(), fakeTimeRange.Start); err != nil {
+		t.Fatalf("sample got unexpected error: %v", err)
+	}
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.NamespaceFilter.ExcludeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}
+	if err := GenerateReports(kmCfg, dirCfg, col, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+
+	yearMonth := fakeTimeRange.Start.Format("200601")
+	for prefix, want := range map[string]bool{nodeFilePrefix: true, podFilePrefix: false, volFilePrefix: false, namespaceFilePrefix: false} {
+		data, err := ioutil.ReadFile(filepath.Join(tempDir, prefix+yearMonth+".csv"))
+		if err != nil {
+			t.Errorf("%s report was not generated: %v", prefix, err)
+			continue
+		}
+		if got := strings.Count(string(data), "\n") > 1; got != want {
+			t.Errorf("%s report has rows %t want %t:\n%s", prefix, got, want, data)
+		}
+	}
+}
@@ -7,11 +7,17 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -25,12 +31,23 @@ import (
 )
 
 var (
-	promSpec *kokumetricscfgv1beta1.PrometheusSpec
+	promSpec  *kokumetricscfgv1beta1.PrometheusSpec
+	promCreds *PrometheusCredentials
+	promTLS   *PrometheusTLS
+
+	// maxRangeSplitDepth limits how often a failed query range is halved, which allows up to 16 sub-ranges.
+	maxRangeSplitDepth = 4
 
 	certKey  = "service-ca.crt"
 	tokenKey = "token"
 
 	serviceaccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// tlsPath is where the CA bundle and client certificate are written for the round tripper, which reads files.
+	tlsPath        = filepath.Join(os.TempDir(), "koku-metrics-operator-tls")
+	caBundleFile   = "ca-bundle.crt"
+	clientCertFile = "tls.crt"
+	clientKeyFile  = "tls.key"
 )
 
 type PromCollector struct {
@@ -39,6 +56,18 @@ type PromCollector struct {
 	TimeSeries *promv1.Range
 	Log        logr.Logger
 	InCluster  bool
+	// Parallelism is the maximum number of concurrent queries. Values below 1 run the queries sequentially.
+	Parallelism int
+	// QueryMode selects whether the interval values are aggregated by the operator or by Prometheus.
+	QueryMode kokumetricscfgv1beta1.QueryModeType
+	// RemoteRead reads the raw series of selector queries in the remote-read query mode.
+	RemoteRead remoteReadClient
+	// Credentials replace the service account token when the PrometheusSpec names a credentials Secret.
+	Credentials *PrometheusCredentials
+	// TLS holds the CA bundle and client certificate when the PrometheusSpec names them.
+	TLS *PrometheusTLS
+
+	rangeSplits int64
 }
 
 type prometheusConnection interface {
@@ -54,8 +83,81 @@ type PrometheusConfig struct {
 	BearerToken config.Secret
 	// CAFile is the ca file
 	CAFile string
+	// CertFile is the client certificate file for mTLS
+	CertFile string
+	// KeyFile is the client key file for mTLS
+	KeyFile string
 	// SkipTLS skips cert verification
 	SkipTLS bool
+	// RemoteReadAddress is the URL of the remote read endpoint
+	RemoteReadAddress string
+	// BasicAuthUser is the basic auth user, used instead of the bearer token
+	BasicAuthUser string
+	// BasicAuthPassword is the basic auth password
+	BasicAuthPassword config.Secret
+	// Headers are added to every request, for example the tenant header of a multi-tenant backend
+	Headers map[string]string
+	// QueryParameters are added to every request URL
+	QueryParameters map[string]string
+}
+
+// PrometheusCredentials are read from the credentials Secret. Either the bearer token or the username and password
+// are set.
+type PrometheusCredentials struct {
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+// PrometheusTLS is read from the CA bundle ConfigMap and the client certificate Secret. Empty values keep the service
+// CA and disable the client certificate.
+type PrometheusTLS struct {
+	CABundle   []byte
+	ClientCert []byte
+	ClientKey  []byte
+}
+
+// writeTLSFiles writes the CA bundle and client certificate to dir, removing the files that are no longer configured.
+func writeTLSFiles(dir string, t *PrometheusTLS) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{caBundleFile: t.CABundle, clientCertFile: t.ClientCert, clientKeyFile: t.ClientKey} {
+		path := filepath.Join(dir, name)
+		if len(data) == 0 {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantRoundTripper adds the configured headers and query parameters to every request.
+type tenantRoundTripper struct {
+	next            http.RoundTripper
+	headers         map[string]string
+	queryParameters map[string]string
+}
+
+func (rt *tenantRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for name, value := range rt.headers {
+		req.Header.Set(name, value)
+	}
+	if len(rt.queryParameters) > 0 {
+		query := req.URL.Query()
+		for name, value := range rt.queryParameters {
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return rt.next.RoundTrip(req)
 }
 
 func getBearerToken(tokenFile string) (config.Secret, error) {
@@ -66,7 +168,7 @@ func getBearerToken(tokenFile string) (config.Secret, error) {
 	return config.Secret(encodedSecret), nil
 }
 
-func getPrometheusConfig(kmCfg *kokumetricscfgv1beta1.PrometheusSpec, inCluster bool) (*PrometheusConfig, error) {
+func getPrometheusConfig(kmCfg *kokumetricscfgv1beta1.PrometheusSpec, inCluster bool, creds *PrometheusCredentials, tls *PrometheusTLS) (*PrometheusConfig, error) {
 	if !inCluster {
 		val, ok := os.LookupEnv("SECRET_ABSPATH")
 		if ok {
@@ -74,9 +176,35 @@ func getPrometheusConfig(kmCfg *kokumetricscfgv1beta1.PrometheusSpec, inCluster
 		}
 	}
 	promCfg := &PrometheusConfig{
-		Address: kmCfg.SvcAddress,
-		CAFile:  filepath.Join(serviceaccountPath, certKey),
-		SkipTLS: *kmCfg.SkipTLSVerification,
+		Address:           kmCfg.SvcAddress,
+		CAFile:            filepath.Join(serviceaccountPath, certKey),
+		SkipTLS:           *kmCfg.SkipTLSVerification,
+		RemoteReadAddress: kmCfg.RemoteReadAddress,
+		Headers:           kmCfg.Headers,
+		QueryParameters:   kmCfg.QueryParameters,
+	}
+	if promCfg.RemoteReadAddress == "" {
+		promCfg.RemoteReadAddress = strings.TrimSuffix(kmCfg.SvcAddress, "/") + "/api/v1/read"
+	}
+
+	if tls != nil {
+		if err := writeTLSFiles(tlsPath, tls); err != nil {
+			return nil, fmt.Errorf("cannot write tls files: %v", err)
+		}
+		if len(tls.CABundle) > 0 {
+			promCfg.CAFile = filepath.Join(tlsPath, caBundleFile)
+		}
+		if len(tls.ClientCert) > 0 {
+			promCfg.CertFile = filepath.Join(tlsPath, clientCertFile)
+			promCfg.KeyFile = filepath.Join(tlsPath, clientKeyFile)
+		}
+	}
+
+	if creds != nil {
+		promCfg.BearerToken = config.Secret(creds.BearerToken)
+		promCfg.BasicAuthUser = creds.Username
+		promCfg.BasicAuthPassword = config.Secret(creds.Password)
+		return promCfg, nil
 	}
 
 	tokenFile := filepath.Join(serviceaccountPath, tokenKey)
@@ -89,15 +217,35 @@ func getPrometheusConfig(kmCfg *kokumetricscfgv1beta1.PrometheusSpec, inCluster
 	return promCfg, nil
 }
 
-func getPrometheusConnFromCfg(cfg *PrometheusConfig) (promv1.API, error) {
+func getRoundTripper(cfg *PrometheusConfig) (http.RoundTripper, error) {
 	promconf := config.HTTPClientConfig{
 		BearerToken: cfg.BearerToken,
-		TLSConfig:   config.TLSConfig{CAFile: cfg.CAFile, InsecureSkipVerify: cfg.SkipTLS},
+		TLSConfig: config.TLSConfig{
+			CAFile:             cfg.CAFile,
+			CertFile:           cfg.CertFile,
+			KeyFile:            cfg.KeyFile,
+			InsecureSkipVerify: cfg.SkipTLS,
+		},
+	}
+	if cfg.BasicAuthUser != "" {
+		promconf.BearerToken = ""
+		promconf.BasicAuth = &config.BasicAuth{Username: cfg.BasicAuthUser, Password: cfg.BasicAuthPassword}
 	}
 	roundTripper, err := config.NewRoundTripperFromConfig(promconf, "promconf", false, false)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create roundTripper: %v", err)
 	}
+	if len(cfg.Headers) > 0 || len(cfg.QueryParameters) > 0 {
+		roundTripper = &tenantRoundTripper{next: roundTripper, headers: cfg.Headers, queryParameters: cfg.QueryParameters}
+	}
+	return roundTripper, nil
+}
+
+func getPrometheusConnFromCfg(cfg *PrometheusConfig) (promv1.API, error) {
+	roundTripper, err := getRoundTripper(cfg)
+	if err != nil {
+		return nil, err
+	}
 	client, err := promapi.NewClient(promapi.Config{
 		Address:      cfg.Address,
 		RoundTripper: roundTripper,
@@ -146,13 +294,16 @@ func (c *PromCollector) GetPromConn(kmCfg *kokumetricscfgv1beta1.KokuMetricsConf
 
 	updated := true
 	if promSpec != nil {
-		updated = !reflect.DeepEqual(*promSpec, kmCfg.Spec.PrometheusConfig)
+		updated = !reflect.DeepEqual(*promSpec, kmCfg.Spec.PrometheusConfig) ||
+			!reflect.DeepEqual(promCreds, c.Credentials) || !reflect.DeepEqual(promTLS, c.TLS)
 	}
 	promSpec = kmCfg.Spec.PrometheusConfig.DeepCopy()
+	promCreds = c.Credentials
+	promTLS = c.TLS
 
 	if updated || c.PromCfg == nil || kmCfg.Status.Prometheus.ConfigError != "" {
 		log.Info("getting prometheus configuration")
-		c.PromCfg, err = getPrometheusConfig(&kmCfg.Spec.PrometheusConfig, c.InCluster)
+		c.PromCfg, err = getPrometheusConfig(&kmCfg.Spec.PrometheusConfig, c.InCluster, c.Credentials, c.TLS)
 		statusHelper(kmCfg, "configuration", err)
 		if err != nil {
 			return fmt.Errorf("cannot get prometheus configuration: %v", err)
@@ -168,6 +319,15 @@ func (c *PromCollector) GetPromConn(kmCfg *kokumetricscfgv1beta1.KokuMetricsConf
 		}
 	}
 
+	c.RemoteRead = nil
+	if c.QueryMode == kokumetricscfgv1beta1.RemoteReadQueryMode {
+		c.RemoteRead, err = getRemoteReadClientFromCfg(c.PromCfg)
+		statusHelper(kmCfg, "configuration", err)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Info("testing the ability to query prometheus")
 	err = testPrometheusConnection(c.PromConn)
 	statusHelper(kmCfg, "connection", err)
@@ -179,25 +339,290 @@ func (c *PromCollector) GetPromConn(kmCfg *kokumetricscfgv1beta1.KokuMetricsConf
 	return nil
 }
 
+// SetTimeSeries sets the time range of the next collection.
+func (c *PromCollector) SetTimeSeries(ts *promv1.Range) { c.TimeSeries = ts }
+
+func (c *PromCollector) getTimeSeries() *promv1.Range { return c.TimeSeries }
+
+func (c *PromCollector) getLogger() logr.Logger { return c.Log }
+
+// querySetResults pairs a set of queries with the results the query matrices are merged into. When spill is set, the
+// results are spilled to disk after a merge leaves them with too many rows.
+type querySetResults struct {
+	queries *querys
+	results *mappedResults
+	spill   *rowSpill
+}
+
 func (c *PromCollector) getQueryResults(queries *querys, results *mappedResults) error {
-	log := c.Log.WithValues("kokumetricsconfig", "getQueryResults")
-	for _, query := range *queries {
-		ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
-		defer cancel()
+	return c.getQuerySetsResults(querySetResults{queries: queries, results: results})
+}
+
+// mergeFunc adds the result of a query to the results of its query set.
+type mergeFunc func(results *mappedResults) error
+
+// getQuerySetsResults runs the queries of all sets using at most c.Parallelism concurrent queries. The first error
+// cancels the remaining queries. Each query result is merged as soon as the queries before it in its set are merged,
+// in the same order as a sequential run, so that the merge into the results of a set does not need to be synchronized
+// and the sets do not wait for each other. A query keeps its slot until its result is merged, which bounds the number
+// of query results held in memory by c.Parallelism.
+func (c *PromCollector) getQuerySetsResults(sets ...querySetResults) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	parallelism := c.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+queue:
+	for _, set := range sets {
+		var previous chan struct{}
+		for _, q := range *set.queries {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break queue
+			}
+			done := make(chan struct{})
+			wg.Add(1)
+			go func(set querySetResults, q query, previous, done chan struct{}) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer close(done)
+				merge, err := c.runQuery(ctx, q)
+				if err == nil && previous != nil {
+					select {
+					case <-previous:
+					case <-ctx.Done():
+					}
+				}
+				if err == nil && ctx.Err() == nil {
+					if err = merge(set.results); err == nil {
+						err = set.spill.spillIfFull(set.results)
+					}
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}(set, q, previous, done)
+			previous = done
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (c *PromCollector) runQuery(ctx context.Context, q query) (mergeFunc, error) {
+	q = scaleFactor(q, c.TimeSeries.Step)
+	if c.QueryMode == kokumetricscfgv1beta1.InstantQueryMode {
+		vector, counts, err := c.getQueryVector(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		return func(results *mappedResults) error {
+			results.iterateVector(vector, counts, q)
+			return nil
+		}, nil
+	}
+	matrix, err := c.getQueryMatrix(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return func(results *mappedResults) error { return results.iterateMatrix(matrix, q) }, nil
+}
+
+// scaleFactor returns a copy of the query whose factor matches the step of the range. The query sets are shared, so
+// the value definition is copied before it is changed.
+func scaleFactor(q query, step time.Duration) query {
+	if q.QueryValue == nil || step <= 0 || step == factorStep {
+		return q
+	}
+	value := *q.QueryValue
+	value.Factor *= step.Seconds() / factorStep.Seconds()
+	q.QueryValue = &value
+	return q
+}
+
+// overTimeQuery wraps the query in a subquery that aggregates the samples of the range at the range step. Evaluated at
+// the end of the range, the subquery selects the same samples as a range query.
+func overTimeQuery(function, query string, r promv1.Range, params ...string) string {
+	window := r.End.Sub(r.Start)
+	if r.Step > 0 {
+		window = (window + r.Step - 1) / r.Step * r.Step
+	}
+	subquery := fmt.Sprintf("(%s)[%ds:%ds]", query, int64(window.Seconds()), int64(r.Step.Seconds()))
+	return fmt.Sprintf("%s(%s)", function, strings.Join(append(params, subquery), ", "))
+}
 
-		queryResult, warnings, err := c.PromConn.QueryRange(ctx, query.QueryString, *c.TimeSeries)
+// aggregateQuery returns the server-side aggregation of the query for the method. Queries without a value only
+// need the label sets of the hour.
+func aggregateQuery(q query, r promv1.Range) (string, error) {
+	if q.QueryValue == nil {
+		return overTimeQuery("max_over_time", q.QueryString, r), nil
+	}
+	if err := checkMethod(q.QueryValue.Method); err != nil {
+		return "", err
+	}
+	if quantile, ok := quantileMethods[q.QueryValue.Method]; ok {
+		return overTimeQuery("quantile_over_time", q.QueryString, r, strconv.FormatFloat(quantile, 'g', -1, 64)), nil
+	}
+	return overTimeQuery(q.QueryValue.Method+"_over_time", q.QueryString, r), nil
+}
+
+// getQueryVector evaluates the query with server-side aggregation. Every method except sum also needs the number of
+// samples to compute the transformed value.
+func (c *PromCollector) getQueryVector(ctx context.Context, q query) (model.Vector, map[model.Fingerprint]int, error) {
+	queryString, err := aggregateQuery(q, *c.TimeSeries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query: %s: %v", q.Name, err)
+	}
+	vector, err := c.queryInstant(ctx, queryString)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query: %s: error querying prometheus: %v", q.QueryString, err)
+	}
+
+	counts := map[model.Fingerprint]int{}
+	if q.QueryValue != nil && q.QueryValue.Method != "sum" && q.QueryValue.TransformedName != "" {
+		countVector, err := c.queryInstant(ctx, overTimeQuery("count_over_time", q.QueryString, *c.TimeSeries))
 		if err != nil {
-			return fmt.Errorf("query: %s: error querying prometheus: %v", query.QueryString, err)
+			return nil, nil, fmt.Errorf("query: %s: error querying prometheus: %v", q.QueryString, err)
 		}
-		if len(warnings) > 0 {
-			log.Info("query warnings", "Warnings", warnings)
+		for _, sample := range countVector {
+			counts[sample.Metric.Fingerprint()] = int(sample.Value)
 		}
-		matrix, ok := queryResult.(model.Matrix)
-		if !ok {
-			return fmt.Errorf("expected a matrix in response to query, got a %v", queryResult.Type())
+	}
+	return vector, counts, nil
+}
+
+func (c *PromCollector) queryInstant(ctx context.Context, queryString string) (model.Vector, error) {
+	log := c.Log.WithValues("kokumetricsconfig", "getQueryResults")
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+
+	queryResult, warnings, err := c.PromConn.Query(ctx, queryString, c.TimeSeries.End)
+	if err != nil {
+		return nil, err
+	}
+	if len(warnings) > 0 {
+		log.Info("query warnings", "Warnings", warnings)
+	}
+	vector, ok := queryResult.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("expected a vector in response to query, got a %v", queryResult.Type())
+	}
+	return vector, nil
+}
+
+func (c *PromCollector) getQueryMatrix(ctx context.Context, query query) (model.Matrix, error) {
+	if c.QueryMode == kokumetricscfgv1beta1.RemoteReadQueryMode && c.RemoteRead != nil {
+		if expr, err := parseQuery(query.QueryString); err == nil {
+			return c.getRemoteReadMatrix(ctx, query, expr)
 		}
+	}
+	return c.getRangeMatrix(ctx, query, *c.TimeSeries, 0)
+}
 
-		results.iterateMatrix(matrix, query)
+// getRangeMatrix queries the range. If Prometheus rejects the query because it loads too many samples, or the query
+// times out, the range is split in two and the matrices of the sub-ranges are stitched back together.
+func (c *PromCollector) getRangeMatrix(ctx context.Context, query query, r promv1.Range, depth int) (model.Matrix, error) {
+	matrix, err := c.queryRange(ctx, query, r)
+	if err == nil {
+		return matrix, nil
 	}
-	return nil
+	first, second, ok := splitRange(r)
+	if !ok || depth >= maxRangeSplitDepth || ctx.Err() != nil || !isSplittableError(err) {
+		return nil, fmt.Errorf("query: %s: error querying prometheus: %v", query.QueryString, err)
+	}
+
+	atomic.AddInt64(&c.rangeSplits, 1)
+	c.Log.WithValues("kokumetricsconfig", "getQueryResults").Info("splitting query range", "query", query.Name, "start", r.Start, "end", r.End, "error", err.Error())
+	firstMatrix, err := c.getRangeMatrix(ctx, query, first, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	secondMatrix, err := c.getRangeMatrix(ctx, query, second, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return stitchMatrices(firstMatrix, secondMatrix), nil
+}
+
+func (c *PromCollector) queryRange(ctx context.Context, query query, r promv1.Range) (model.Matrix, error) {
+	log := c.Log.WithValues("kokumetricsconfig", "getQueryResults")
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+
+	queryResult, warnings, err := c.PromConn.QueryRange(ctx, query.QueryString, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(warnings) > 0 {
+		log.Info("query warnings", "Warnings", warnings)
+	}
+	matrix, ok := queryResult.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("expected a matrix in response to query, got a %v", queryResult.Type())
+	}
+	return matrix, nil
+}
+
+// isSplittableError returns true for errors that a query over a shorter range may avoid.
+func isSplittableError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr *promv1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type == promv1.ErrTimeout || strings.Contains(apiErr.Msg, "too many samples")
+	}
+	return false
+}
+
+// splitRange splits the range into two ranges on a step boundary. It returns false if the range has only one step.
+func splitRange(r promv1.Range) (promv1.Range, promv1.Range, bool) {
+	if r.Step <= 0 {
+		return r, r, false
+	}
+	steps := int64(r.End.Sub(r.Start)/r.Step) + 1
+	if steps < 2 {
+		return r, r, false
+	}
+	mid := r.Start.Add(time.Duration(steps/2) * r.Step)
+	first := promv1.Range{Start: r.Start, End: mid.Add(-r.Step), Step: r.Step}
+	second := promv1.Range{Start: mid, End: r.End, Step: r.Step}
+	return first, second, true
+}
+
+// stitchMatrices appends the samples of the second matrix to the streams of the first matrix with the same labels.
+func stitchMatrices(first, second model.Matrix) model.Matrix {
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	result := model.Matrix{}
+	for _, matrix := range []model.Matrix{first, second} {
+		for _, stream := range matrix {
+			fp := stream.Metric.Fingerprint()
+			if existing, ok := streams[fp]; ok {
+				existing.Values = append(existing.Values, stream.Values...)
+				continue
+			}
+			stitched := &model.SampleStream{Metric: stream.Metric, Values: append([]model.SamplePair{}, stream.Values...)}
+			streams[fp] = stitched
+			result = append(result, stitched)
+		}
+	}
+	return result
 }
+
+// getRangeSplits returns the number of query range splits since the last reset.
+func (c *PromCollector) getRangeSplits() int64 { return atomic.LoadInt64(&c.rangeSplits) }
+
+func (c *PromCollector) resetRangeSplits() { atomic.StoreInt64(&c.rangeSplits, 0) }
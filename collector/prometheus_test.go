@@ -7,9 +7,23 @@ package collector
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -50,6 +64,125 @@ func (m mockPrometheusConnection) QueryRange(ctx context.Context, query string,
 	return res.value, res.warnings, res.err
 }
 
+// concurrentPrometheusConnection records the number of concurrent queries. Queries in failing return an error, and
+// queries in blocking wait until their context is cancelled.
+type concurrentPrometheusConnection struct {
+	mu       sync.Mutex
+	running  int
+	maxSeen  int
+	failing  map[string]bool
+	blocking map[string]bool
+}
+
+func (m *concurrentPrometheusConnection) QueryRange(ctx context.Context, query string, r promv1.Range) (model.Value, promv1.Warnings, error) {
+	m.mu.Lock()
+	m.running++
+	if m.running > m.maxSeen {
+		m.maxSeen = m.running
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.running--
+		m.mu.Unlock()
+	}()
+
+	if m.failing[query] {
+		return nil, nil, errTest
+	}
+	if m.blocking[query] {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	time.Sleep(10 * time.Millisecond)
+	return model.Matrix{
+		{
+			Metric: model.Metric{"id": model.LabelValue(query)},
+			Values: []model.SamplePair{{Timestamp: 1604339340, Value: 1}},
+		},
+	}, nil, nil
+}
+
+func (m *concurrentPrometheusConnection) Query(ctx context.Context, query string, ts time.Time) (model.Value, promv1.Warnings, error) {
+	return nil, nil, nil
+}
+
+// aggregatingPrometheusConnection evaluates the `*_over_time` subqueries of the instant query mode against the range
+// query results, the same way Prometheus would.
+type aggregatingPrometheusConnection struct {
+	mappedResults *mappedMockPromResult
+	t             *testing.T
+}
+
+func (m aggregatingPrometheusConnection) QueryRange(ctx context.Context, query string, r promv1.Range) (model.Value, promv1.Warnings, error) {
+	m.t.Fatalf("unexpected range query in instant query mode: %s", query)
+	return nil, nil, nil
+}
+
+func (m aggregatingPrometheusConnection) Query(ctx context.Context, query string, ts time.Time) (model.Value, promv1.Warnings, error) {
+	function := query[:strings.Index(query, "(")]
+	var res *mockPromResult
+	for inner, result := range *m.mappedResults {
+		if strings.Contains(query, "("+inner+")[") {
+			res = result
+		}
+	}
+	if res == nil {
+		m.t.Fatalf("Could not find test result for %s!", query)
+	}
+	if res.err != nil {
+		return nil, res.warnings, res.err
+	}
+	vector := model.Vector{}
+	for _, stream := range res.value.(model.Matrix) {
+		var value float64
+		switch function {
+		case "sum_over_time":
+			value = sumSlice(stream.Values)
+		case "max_over_time":
+			value = maxSlice(stream.Values)
+		case "min_over_time":
+			value = minSlice(stream.Values)
+		case "avg_over_time":
+			value = avgSlice(stream.Values)
+		case "last_over_time":
+			value = lastSlice(stream.Values)
+		case "count_over_time":
+			value = float64(len(stream.Values))
+		case "quantile_over_time":
+			quantile, _ := strconv.ParseFloat(query[len(function)+1:strings.Index(query, ",")], 64)
+			value = quantileSlice(quantile, stream.Values)
+		default:
+			m.t.Fatalf("unexpected function %s", function)
+		}
+		metric := stream.Metric.Clone()
+		delete(metric, model.MetricNameLabel)
+		vector = append(vector, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: model.TimeFromUnixNano(ts.UnixNano())})
+	}
+	return vector, res.warnings, nil
+}
+
+// splittingPrometheusConnection returns err for ranges with more than maxSteps steps and otherwise one sample per step.
+type splittingPrometheusConnection struct {
+	maxSteps int
+	err      error
+}
+
+func (m splittingPrometheusConnection) QueryRange(ctx context.Context, query string, r promv1.Range) (model.Value, promv1.Warnings, error) {
+	values := []model.SamplePair{}
+	for ts := r.Start; !ts.After(r.End); ts = ts.Add(r.Step) {
+		values = append(values, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: 1})
+	}
+	if len(values) > m.maxSteps {
+		return nil, nil, m.err
+	}
+	return model.Matrix{{Metric: model.Metric{"id": "1"}, Values: values}}, nil, nil
+}
+
+func (m splittingPrometheusConnection) Query(ctx context.Context, query string, ts time.Time) (model.Value, promv1.Warnings, error) {
+	return nil, nil, nil
+}
+
 func (m mockPrometheusConnection) Query(ctx context.Context, query string, ts time.Time) (model.Value, promv1.Warnings, error) {
 	res := m.singleResult
 	return res.value, res.warnings, res.err
@@ -80,7 +213,7 @@ func TestGetQueryResultsSuccess(t *testing.T) {
 						Factor:          maxFactor,
 						TransformedName: "usage-cpu-core-seconds",
 					},
-					RowKey: "id",
+					RowKey: []model.LabelName{"id"},
 				},
 				query{
 					Name:        "capacity-cpu-cores",
@@ -92,13 +225,13 @@ func TestGetQueryResultsSuccess(t *testing.T) {
 						Factor:          maxFactor,
 						TransformedName: "capacity-cpu-core-seconds",
 					},
-					RowKey: "id",
+					RowKey: []model.LabelName{"id"},
 				},
 				query{
 					Name:           "labels",
 					QueryString:    "query3",
 					MetricKeyRegex: regexFields{"labels": "label_*"},
-					RowKey:         "id",
+					RowKey:         []model.LabelName{"id"},
 				},
 			},
 			queriesResult: mappedMockPromResult{
@@ -260,6 +393,364 @@ func TestGetQueryResultsError(t *testing.T) {
 	}
 }
 
+func TestGetQuerySetsResultsConcurrency(t *testing.T) {
+	newQuerys := func(names ...string) *querys {
+		qs := querys{}
+		for _, name := range names {
+			qs = append(qs, query{
+				Name:        name,
+				QueryString: name,
+				MetricKey:   staticFields{"id": "id"},
+				QueryValue:  &saveQueryValue{ValName: "value", Method: "sum", Factor: sumFactor},
+				RowKey:      []model.LabelName{"id"},
+			})
+		}
+		return &qs
+	}
+	getQuerySetsResultsTests := []struct {
+		name        string
+		parallelism int
+		failing     map[string]bool
+		blocking    map[string]bool
+		wantMax     int
+		wantRows    []int
+		wantedError error
+	}{
+		{
+			name:        "sequential",
+			parallelism: 0,
+			wantMax:     1,
+			wantRows:    []int{3, 2},
+		},
+		{
+			name:        "bounded by parallelism",
+			parallelism: 2,
+			wantMax:     2,
+			wantRows:    []int{3, 2},
+		},
+		{
+			name:        "error cancels the remaining queries",
+			parallelism: 5,
+			failing:     map[string]bool{"a2": true},
+			blocking:    map[string]bool{"a1": true, "a3": true, "b1": true, "b2": true},
+			wantedError: errTest,
+		},
+	}
+	for _, tt := range getQuerySetsResultsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &concurrentPrometheusConnection{failing: tt.failing, blocking: tt.blocking}
+			col := PromCollector{
+				PromConn:    conn,
+				TimeSeries:  &promv1.Range{},
+				Log:         testLogger,
+				Parallelism: tt.parallelism,
+			}
+			results := []mappedResults{{}, {}}
+			done := make(chan error)
+			go func() {
+				done <- col.getQuerySetsResults(
+					querySetResults{queries: newQuerys("a1", "a2", "a3"), results: &results[0]},
+					querySetResults{queries: newQuerys("b1", "b2"), results: &results[1]},
+				)
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s did not return, the remaining queries were not cancelled", tt.name)
+			}
+			if tt.wantedError != nil {
+				if err == nil || !strings.Contains(err.Error(), tt.wantedError.Error()) {
+					t.Errorf("%s got error %v want %v", tt.name, err, tt.wantedError)
+				}
+				if len(results[0]) != 0 || len(results[1]) != 0 {
+					t.Errorf("%s results were merged after an error: %v", tt.name, results)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s got unexpected error: %v", tt.name, err)
+			}
+			if conn.maxSeen != tt.wantMax {
+				t.Errorf("%s got %d concurrent queries want %d", tt.name, conn.maxSeen, tt.wantMax)
+			}
+			for i, want := range tt.wantRows {
+				if len(results[i]) != want {
+					t.Errorf("%s set %d got %d rows want %d", tt.name, i, len(results[i]), want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetQueryResultsRangeSplitting(t *testing.T) {
+	tooManySamples := &promv1.Error{Type: promv1.ErrExec, Msg: "query processing would load too many samples into memory in query execution"}
+	getQueryResultsSplitTests := []struct {
+		name       string
+		conn       splittingPrometheusConnection
+		wantSplits int64
+		wantErr    bool
+	}{
+		{
+			name:       "no split needed",
+			conn:       splittingPrometheusConnection{maxSteps: 60, err: tooManySamples},
+			wantSplits: 0,
+		},
+		{
+			name:       "too many samples",
+			conn:       splittingPrometheusConnection{maxSteps: 16, err: tooManySamples},
+			wantSplits: 3,
+		},
+		{
+			name:       "timeout",
+			conn:       splittingPrometheusConnection{maxSteps: 30, err: &promv1.Error{Type: promv1.ErrTimeout, Msg: "query timed out"}},
+			wantSplits: 1,
+		},
+		{
+			name:       "context deadline",
+			conn:       splittingPrometheusConnection{maxSteps: 30, err: context.DeadlineExceeded},
+			wantSplits: 1,
+		},
+		{
+			name:       "split depth exceeded",
+			conn:       splittingPrometheusConnection{maxSteps: 1, err: tooManySamples},
+			wantSplits: int64(maxRangeSplitDepth),
+			wantErr:    true,
+		},
+		{
+			name:       "error is not splittable",
+			conn:       splittingPrometheusConnection{maxSteps: 1, err: &promv1.Error{Type: promv1.ErrBadData, Msg: "parse error"}},
+			wantSplits: 0,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range getQueryResultsSplitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			col := PromCollector{
+				PromConn: tt.conn,
+				TimeSeries: &promv1.Range{
+					Start: time.Date(2020, 11, 6, 18, 0, 0, 0, time.UTC),
+					End:   time.Date(2020, 11, 6, 18, 59, 59, 0, time.UTC),
+					Step:  time.Minute,
+				},
+				Log: testLogger,
+			}
+			q := query{
+				Name:        "usage",
+				QueryString: "usage",
+				MetricKey:   staticFields{"id": "id"},
+				QueryValue:  &saveQueryValue{ValName: "usage", Method: "sum", Factor: sumFactor},
+				RowKey:      []model.LabelName{"id"},
+			}
+			got := mappedResults{}
+			err := col.getQueryResults(&querys{q}, &got)
+			if tt.wantErr && err == nil {
+				t.Errorf("%s expected error but got nil", tt.name)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("%s got unexpected error: %v", tt.name, err)
+			}
+			if splits := col.getRangeSplits(); splits != tt.wantSplits {
+				t.Errorf("%s got %d splits want %d", tt.name, splits, tt.wantSplits)
+			}
+			if tt.wantErr {
+				return
+			}
+			// the stitched matrix contains every sample of the hour exactly once
+			if got["1"]["usage"] != "60.000000" {
+				t.Errorf("%s got usage %v want 60.000000", tt.name, got["1"]["usage"])
+			}
+		})
+	}
+}
+
+func TestScaleFactor(t *testing.T) {
+	scaleFactorTests := []struct {
+		name string
+		q    query
+		step time.Duration
+		want float64
+	}{
+		{
+			name: "default step",
+			q:    query{QueryValue: &saveQueryValue{Factor: maxFactor}},
+			step: time.Minute,
+			want: 60,
+		},
+		{
+			name: "half minute step",
+			q:    query{QueryValue: &saveQueryValue{Factor: maxFactor}},
+			step: 30 * time.Second,
+			want: 30,
+		},
+		{
+			name: "quarter minute step",
+			q:    query{QueryValue: &saveQueryValue{Factor: sumFactor}},
+			step: 15 * time.Second,
+			want: 15,
+		},
+	}
+	for _, tt := range scaleFactorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scaleFactor(tt.q, tt.step)
+			if got.QueryValue.Factor != tt.want {
+				t.Errorf("%s got factor %v want %v", tt.name, got.QueryValue.Factor, tt.want)
+			}
+			if tt.q.QueryValue.Factor != maxFactor {
+				t.Errorf("%s changed the factor of the shared query to %v", tt.name, tt.q.QueryValue.Factor)
+			}
+		})
+	}
+	if got := scaleFactor(query{Name: "labels"}, 30*time.Second); got.QueryValue != nil {
+		t.Errorf("query without value got value %v", got.QueryValue)
+	}
+}
+
+func TestAggregateQuery(t *testing.T) {
+	start := time.Date(2020, 11, 6, 18, 0, 0, 0, time.UTC)
+	hour := promv1.Range{Start: start, End: start.Add(59*time.Minute + 59*time.Second), Step: time.Minute}
+	aggregateQueryTests := []struct {
+		name    string
+		q       query
+		r       promv1.Range
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "labels only",
+			q:    query{QueryString: "up"},
+			r:    hour,
+			want: "max_over_time((up)[3600s:60s])",
+		},
+		{
+			name: "sum",
+			q:    query{QueryString: "up", QueryValue: &saveQueryValue{Method: "sum"}},
+			r:    hour,
+			want: "sum_over_time((up)[3600s:60s])",
+		},
+		{
+			name: "max with five minute step",
+			q:    query{QueryString: "up", QueryValue: &saveQueryValue{Method: "max"}},
+			r:    promv1.Range{Start: hour.Start, End: hour.End, Step: 5 * time.Minute},
+			want: "max_over_time((up)[3600s:300s])",
+		},
+		{
+			name: "p95",
+			q:    query{QueryString: "up", QueryValue: &saveQueryValue{Method: "p95"}},
+			r:    hour,
+			want: "quantile_over_time(0.95, (up)[3600s:60s])",
+		},
+		{
+			name:    "unknown method",
+			q:       query{QueryString: "up", QueryValue: &saveQueryValue{Method: "median"}},
+			r:       hour,
+			wantErr: true,
+		},
+	}
+	for _, tt := range aggregateQueryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := aggregateQuery(tt.q, tt.r)
+			if tt.wantErr && err == nil {
+				t.Errorf("%s expected error but got nil", tt.name)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("%s got unexpected error: %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("%s got %s want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetQueryResultsInstantMode(t *testing.T) {
+	values := []model.SamplePair{}
+	for i := 0; i < 60; i++ {
+		values = append(values, model.SamplePair{Timestamp: model.Time(1604685600000 + i*60000), Value: model.SampleValue(i % 7)})
+	}
+	matrix := model.Matrix{{Metric: model.Metric{"__name__": "usage", "id": "1"}, Values: values}}
+
+	for _, method := range []string{"sum", "max", "min", "avg", "last", "p50", "p95", "p99"} {
+		t.Run(method, func(t *testing.T) {
+			queries := &querys{query{
+				Name:        "usage",
+				QueryString: "usage",
+				MetricKey:   staticFields{"id": "id"},
+				QueryValue:  &saveQueryValue{ValName: "usage", Method: method, Factor: maxFactor, TransformedName: "usage-seconds"},
+				RowKey:      []model.LabelName{"id"},
+			}}
+			mapResults := mappedMockPromResult{"usage": &mockPromResult{value: matrix}}
+
+			rangeCol := PromCollector{
+				PromConn:   mockPrometheusConnection{mappedResults: &mapResults, t: t},
+				TimeSeries: &fakeTimeRange,
+				Log:        testLogger,
+			}
+			want := mappedResults{}
+			if err := rangeCol.getQueryResults(queries, &want); err != nil {
+				t.Fatalf("range query got unexpected error: %v", err)
+			}
+
+			instantCol := PromCollector{
+				PromConn:   aggregatingPrometheusConnection{mappedResults: &mapResults, t: t},
+				TimeSeries: &fakeTimeRange,
+				Log:        testLogger,
+				QueryMode:  kokumetricscfgv1beta1.InstantQueryMode,
+			}
+			got := mappedResults{}
+			if err := instantCol.getQueryResults(queries, &got); err != nil {
+				t.Fatalf("instant query got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s instant mode got:\n\t%s\n  want:\n\t%s", method, got, want)
+			}
+		})
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	start := time.Date(2020, 11, 6, 18, 0, 0, 0, time.UTC)
+	splitRangeTests := []struct {
+		name       string
+		r          promv1.Range
+		wantFirst  promv1.Range
+		wantSecond promv1.Range
+		wantOK     bool
+	}{
+		{
+			name:       "hour",
+			r:          promv1.Range{Start: start, End: start.Add(59*time.Minute + 59*time.Second), Step: time.Minute},
+			wantFirst:  promv1.Range{Start: start, End: start.Add(29 * time.Minute), Step: time.Minute},
+			wantSecond: promv1.Range{Start: start.Add(30 * time.Minute), End: start.Add(59*time.Minute + 59*time.Second), Step: time.Minute},
+			wantOK:     true,
+		},
+		{
+			name:   "single step",
+			r:      promv1.Range{Start: start, End: start.Add(59 * time.Second), Step: time.Minute},
+			wantOK: false,
+		},
+		{
+			name:   "no step",
+			r:      promv1.Range{Start: start, End: start.Add(time.Hour)},
+			wantOK: false,
+		},
+	}
+	for _, tt := range splitRangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second, ok := splitRange(tt.r)
+			if ok != tt.wantOK {
+				t.Fatalf("%s got ok %t want %t", tt.name, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(first, tt.wantFirst) || !reflect.DeepEqual(second, tt.wantSecond) {
+				t.Errorf("%s got %v and %v want %v and %v", tt.name, first, second, tt.wantFirst, tt.wantSecond)
+			}
+		})
+	}
+}
+
 func TestTestPrometheusConnection(t *testing.T) {
 	col := PromCollector{
 		TimeSeries: &promv1.Range{},
@@ -512,12 +1003,23 @@ func TestGetPrometheusConfig(t *testing.T) {
 		SkipTLSVerification: &trueDef,
 	}
 	secretsPath := "./test_files/test_secrets"
+	tmpTLSPath := tlsPath
+	tlsPath, err = ioutil.TempDir("", "prometheus-tls-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer func() {
+		os.RemoveAll(tlsPath)
+		tlsPath = tmpTLSPath
+	}()
 	getPromCfgTests := []struct {
 		name        string
 		inCluster   bool
 		basePath    string
 		certKey     bool
 		tokenKey    bool
+		creds       *PrometheusCredentials
+		tls         *PrometheusTLS
 		want        *PrometheusConfig
 		wantedError error
 	}{
@@ -528,10 +1030,11 @@ func TestGetPrometheusConfig(t *testing.T) {
 			certKey:   true,
 			tokenKey:  true,
 			want: &PrometheusConfig{
-				Address:     "svc-address",
-				SkipTLS:     true,
-				BearerToken: config.Secret([]byte("this-is-token-data")),
-				CAFile:      filepath.Join(secretsPath, certKey),
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BearerToken:       config.Secret([]byte("this-is-token-data")),
+				CAFile:            filepath.Join(secretsPath, certKey),
+				RemoteReadAddress: "svc-address/api/v1/read",
 			},
 			wantedError: nil,
 		},
@@ -544,6 +1047,75 @@ func TestGetPrometheusConfig(t *testing.T) {
 			want:        nil,
 			wantedError: errTest,
 		},
+		{
+			name:      "basic auth credentials - missing token",
+			inCluster: true,
+			basePath:  secretsPath,
+			certKey:   true,
+			tokenKey:  false,
+			creds:     &PrometheusCredentials{Username: "user", Password: "pass"},
+			want: &PrometheusConfig{
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BasicAuthUser:     "user",
+				BasicAuthPassword: config.Secret("pass"),
+				CAFile:            filepath.Join(secretsPath, certKey),
+				RemoteReadAddress: "svc-address/api/v1/read",
+			},
+			wantedError: nil,
+		},
+		{
+			name:      "token credentials - missing token",
+			inCluster: true,
+			basePath:  secretsPath,
+			certKey:   true,
+			tokenKey:  false,
+			creds:     &PrometheusCredentials{BearerToken: "secret-token"},
+			want: &PrometheusConfig{
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BearerToken:       config.Secret("secret-token"),
+				CAFile:            filepath.Join(secretsPath, certKey),
+				RemoteReadAddress: "svc-address/api/v1/read",
+			},
+			wantedError: nil,
+		},
+		{
+			name:      "ca bundle and client certificate",
+			inCluster: true,
+			basePath:  secretsPath,
+			certKey:   true,
+			tokenKey:  true,
+			tls:       &PrometheusTLS{CABundle: []byte("ca"), ClientCert: []byte("cert"), ClientKey: []byte("key")},
+			want: &PrometheusConfig{
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BearerToken:       config.Secret([]byte("this-is-token-data")),
+				CAFile:            filepath.Join(tlsPath, caBundleFile),
+				CertFile:          filepath.Join(tlsPath, clientCertFile),
+				KeyFile:           filepath.Join(tlsPath, clientKeyFile),
+				RemoteReadAddress: "svc-address/api/v1/read",
+			},
+			wantedError: nil,
+		},
+		{
+			name:      "client certificate only",
+			inCluster: true,
+			basePath:  secretsPath,
+			certKey:   true,
+			tokenKey:  true,
+			tls:       &PrometheusTLS{ClientCert: []byte("cert"), ClientKey: []byte("key")},
+			want: &PrometheusConfig{
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BearerToken:       config.Secret([]byte("this-is-token-data")),
+				CAFile:            filepath.Join(secretsPath, certKey),
+				CertFile:          filepath.Join(tlsPath, clientCertFile),
+				KeyFile:           filepath.Join(tlsPath, clientKeyFile),
+				RemoteReadAddress: "svc-address/api/v1/read",
+			},
+			wantedError: nil,
+		},
 		{
 			name:      "successful config - local",
 			inCluster: false,
@@ -551,10 +1123,11 @@ func TestGetPrometheusConfig(t *testing.T) {
 			certKey:   true,
 			tokenKey:  true,
 			want: &PrometheusConfig{
-				Address:     "svc-address",
-				SkipTLS:     true,
-				BearerToken: config.Secret([]byte("this-is-token-data")),
-				CAFile:      filepath.Join(cwd, secretsPath, certKey),
+				Address:           "svc-address",
+				SkipTLS:           true,
+				BearerToken:       config.Secret([]byte("this-is-token-data")),
+				CAFile:            filepath.Join(cwd, secretsPath, certKey),
+				RemoteReadAddress: "svc-address/api/v1/read",
 			},
 			wantedError: nil,
 		},
@@ -598,7 +1171,7 @@ func TestGetPrometheusConfig(t *testing.T) {
 				os.Remove(filepath.Join(tt.basePath, "token"))
 				os.Remove(filepath.Join(tt.basePath, "service-ca.crt"))
 			}()
-			got, err := getPrometheusConfig(kmCfg, tt.inCluster)
+			got, err := getPrometheusConfig(kmCfg, tt.inCluster, tt.creds, tt.tls)
 			if tt.wantedError == nil && err != nil {
 				t.Errorf("%s got unexpected error: %v", tt.name, err)
 			}
@@ -614,3 +1187,137 @@ func TestGetPrometheusConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRoundTripperTenancy(t *testing.T) {
+	roundTripperTests := []struct {
+		name       string
+		cfg        *PrometheusConfig
+		wantAuth   string
+		wantHeader string
+		wantQuery  string
+	}{
+		{
+			name:      "bearer token",
+			cfg:       &PrometheusConfig{BearerToken: "token"},
+			wantAuth:  "Bearer token",
+			wantQuery: "query=up",
+		},
+		{
+			name: "basic auth with tenant header and namespace parameter",
+			cfg: &PrometheusConfig{
+				BearerToken:       "token",
+				BasicAuthUser:     "user",
+				BasicAuthPassword: "pass",
+				Headers:           map[string]string{"X-Scope-OrgID": "tenant-1"},
+				QueryParameters:   map[string]string{"namespace": "project"},
+			},
+			wantAuth:   "Basic dXNlcjpwYXNz",
+			wantHeader: "tenant-1",
+			wantQuery:  "namespace=project&query=up",
+		},
+	}
+	for _, tt := range roundTripperTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAuth, gotHeader, gotQuery string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth, gotHeader, gotQuery = r.Header.Get("Authorization"), r.Header.Get("X-Scope-OrgID"), r.URL.RawQuery
+			}))
+			defer server.Close()
+
+			roundTripper, err := getRoundTripper(tt.cfg)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"?query=up", nil)
+			resp, err := roundTripper.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s request failed: %v", tt.name, err)
+			}
+			resp.Body.Close()
+			if gotAuth != tt.wantAuth {
+				t.Errorf("%s got authorization %q want %q", tt.name, gotAuth, tt.wantAuth)
+			}
+			if gotHeader != tt.wantHeader {
+				t.Errorf("%s got tenant header %q want %q", tt.name, gotHeader, tt.wantHeader)
+			}
+			if gotQuery != tt.wantQuery {
+				t.Errorf("%s got query %q want %q", tt.name, gotQuery, tt.wantQuery)
+			}
+			if req.URL.RawQuery != "query=up" || req.Header.Get("X-Scope-OrgID") != "" {
+				t.Errorf("%s modified the original request", tt.name)
+			}
+		})
+	}
+}
+
+// selfSignedCert returns the PEM encoded certificate and key of a new self-signed client certificate.
+func selfSignedCert(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "koku-metrics-operator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestPrometheusMutualTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "missing client certificate", http.StatusUnauthorized)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "prometheus-tls-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := selfSignedCert(t)
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := writeTLSFiles(dir, &PrometheusTLS{CABundle: caBundle, ClientCert: cert, ClientKey: key}); err != nil {
+		t.Fatalf("writeTLSFiles got unexpected error: %v", err)
+	}
+
+	roundTripper, err := getRoundTripper(&PrometheusConfig{
+		CAFile:   filepath.Join(dir, caBundleFile),
+		CertFile: filepath.Join(dir, clientCertFile),
+		KeyFile:  filepath.Join(dir, clientKeyFile),
+	})
+	if err != nil {
+		t.Fatalf("getRoundTripper got unexpected error: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := roundTripper.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("mTLS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("mTLS request got status %s", resp.Status)
+	}
+
+	// the client certificate files are removed once the secret is no longer configured
+	if err := writeTLSFiles(dir, &PrometheusTLS{CABundle: caBundle}); err != nil {
+		t.Fatalf("writeTLSFiles got unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, clientKeyFile)); !os.IsNotExist(err) {
+		t.Errorf("client key was not removed: %v", err)
+	}
+}
@@ -0,0 +1,598 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// The remote-read query mode evaluates queries in the operator from the raw series of their selectors. Only the part
+// of PromQL that the built-in queries use is supported:
+//
+//	selector                              kube_pod_labels{namespace!=""}
+//	rate(selector[duration])              rate(container_cpu_usage_seconds_total[5m])
+//	aggregation by (labels) (expression)  sum(expression) by (pod, namespace)
+//	expression * on(labels) group_left(labels) expression
+//
+// Any other query is not parsed and is queried as a range query instead.
+
+// promSample is a sample of a series at the evaluation time.
+type promSample struct {
+	metric model.Metric
+	value  float64
+}
+
+type promVector []promSample
+
+// promExpr is an expression that is evaluated at every step of the range.
+type promExpr interface {
+	// selectors returns the selectors whose raw series are read before the expression is evaluated.
+	selectors() []*vectorSelector
+	eval(t model.Time) (promVector, error)
+}
+
+// vectorSelector selects the series matching its matchers. With a range, it is the argument of rate.
+type vectorSelector struct {
+	matchers []labelMatcher
+	window   time.Duration
+	series   []*model.SampleStream
+}
+
+// rateCall is the per-second rate of the counters of a range selector.
+type rateCall struct {
+	arg *vectorSelector
+}
+
+// aggregation combines the samples of the expression that have the same values of the grouping labels.
+type aggregation struct {
+	op       string
+	grouping []model.LabelName
+	arg      promExpr
+}
+
+// multiplication multiplies the samples of both sides that have the same values of the on labels. With group_left,
+// several samples on the left match one sample on the right, which adds the include labels to the result.
+type multiplication struct {
+	lhs, rhs  promExpr
+	on        []model.LabelName
+	hasOn     bool
+	groupLeft bool
+	include   []model.LabelName
+}
+
+var aggregationOps = map[string]bool{"sum": true, "max": true, "min": true, "avg": true}
+
+func (s *vectorSelector) selectors() []*vectorSelector { return []*vectorSelector{s} }
+func (r *rateCall) selectors() []*vectorSelector       { return r.arg.selectors() }
+func (a *aggregation) selectors() []*vectorSelector    { return a.arg.selectors() }
+func (m *multiplication) selectors() []*vectorSelector {
+	return append(m.lhs.selectors(), m.rhs.selectors()...)
+}
+
+// setSeries stores the raw series read for the selector, sorted by time and without stale markers in range selectors.
+func (s *vectorSelector) setSeries(series []*model.SampleStream) {
+	for _, stream := range series {
+		sort.Slice(stream.Values, func(i, j int) bool { return stream.Values[i].Timestamp < stream.Values[j].Timestamp })
+	}
+	s.series = series
+}
+
+// eval returns the latest sample of every series within the lookback delta, unless the series was marked stale.
+func (s *vectorSelector) eval(t model.Time) (promVector, error) {
+	if s.window > 0 {
+		return nil, fmt.Errorf("range selector must be the argument of rate")
+	}
+	var vector promVector
+	for _, stream := range s.series {
+		i := sort.Search(len(stream.Values), func(i int) bool { return stream.Values[i].Timestamp.After(t) })
+		if i == 0 {
+			continue
+		}
+		latest := stream.Values[i-1]
+		if isStale(latest.Value) || latest.Timestamp.Before(t.Add(-lookbackDelta)) {
+			continue
+		}
+		vector = append(vector, promSample{metric: stream.Metric, value: float64(latest.Value)})
+	}
+	return vector, nil
+}
+
+func isStale(v model.SampleValue) bool { return math.Float64bits(float64(v)) == staleNaN }
+
+// eval computes the rate of every series the same way Prometheus does: counter resets are added back and the increase
+// is extrapolated to the boundaries of the window.
+func (r *rateCall) eval(t model.Time) (promVector, error) {
+	start := t.Add(-r.arg.window)
+	var vector promVector
+	for _, stream := range r.arg.series {
+		lo := sort.Search(len(stream.Values), func(i int) bool { return !stream.Values[i].Timestamp.Before(start) })
+		hi := sort.Search(len(stream.Values), func(i int) bool { return stream.Values[i].Timestamp.After(t) })
+		var samples []model.SamplePair
+		for _, s := range stream.Values[lo:hi] {
+			if !isStale(s.Value) {
+				samples = append(samples, s)
+			}
+		}
+		if value, ok := extrapolatedRate(samples, start, t, r.arg.window); ok {
+			vector = append(vector, promSample{metric: dropMetricName(stream.Metric), value: value})
+		}
+	}
+	return vector, nil
+}
+
+func extrapolatedRate(samples []model.SamplePair, start, end model.Time, window time.Duration) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	increase := float64(last.Value - first.Value)
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Value < samples[i-1].Value {
+			increase += float64(samples[i-1].Value)
+		}
+	}
+	durationToStart := float64(first.Timestamp-start) / 1000
+	durationToEnd := float64(end-last.Timestamp) / 1000
+	sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+	averageInterval := sampledInterval / float64(len(samples)-1)
+	// a counter does not extrapolate below zero
+	if increase > 0 && first.Value >= 0 {
+		if durationToZero := sampledInterval * float64(first.Value) / increase; durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	threshold := averageInterval * 1.1
+	extrapolated := sampledInterval
+	if durationToStart < threshold {
+		extrapolated += durationToStart
+	} else {
+		extrapolated += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		extrapolated += durationToEnd
+	} else {
+		extrapolated += averageInterval / 2
+	}
+	return increase * (extrapolated / sampledInterval) / window.Seconds(), true
+}
+
+func dropMetricName(metric model.Metric) model.Metric {
+	if _, ok := metric[model.MetricNameLabel]; !ok {
+		return metric
+	}
+	m := metric.Clone()
+	delete(m, model.MetricNameLabel)
+	return m
+}
+
+// groupMetric returns the values of the labels of the metric.
+func groupMetric(metric model.Metric, labels []model.LabelName) model.Metric {
+	m := model.Metric{}
+	for _, l := range labels {
+		if v, ok := metric[l]; ok && v != "" {
+			m[l] = v
+		}
+	}
+	return m
+}
+
+type aggregationGroup struct {
+	metric model.Metric
+	value  float64
+	count  int
+}
+
+func (a *aggregation) eval(t model.Time) (promVector, error) {
+	vector, err := a.arg.eval(t)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[model.Fingerprint]*aggregationGroup{}
+	var order []model.Fingerprint
+	for _, s := range vector {
+		metric := groupMetric(s.metric, a.grouping)
+		fp := metric.Fingerprint()
+		g, ok := groups[fp]
+		if !ok {
+			groups[fp] = &aggregationGroup{metric: metric, value: s.value, count: 1}
+			order = append(order, fp)
+			continue
+		}
+		g.count++
+		switch a.op {
+		case "sum", "avg":
+			g.value += s.value
+		case "max":
+			if s.value > g.value || math.IsNaN(g.value) {
+				g.value = s.value
+			}
+		case "min":
+			if s.value < g.value || math.IsNaN(g.value) {
+				g.value = s.value
+			}
+		}
+	}
+	result := make(promVector, 0, len(order))
+	for _, fp := range order {
+		g := groups[fp]
+		if a.op == "avg" {
+			g.value /= float64(g.count)
+		}
+		result = append(result, promSample{metric: g.metric, value: g.value})
+	}
+	return result, nil
+}
+
+// signature returns the key that matches samples of both sides: the on labels, or all labels but the metric name.
+func (m *multiplication) signature(metric model.Metric) model.Fingerprint {
+	if m.hasOn {
+		return model.Metric(groupMetric(metric, m.on)).Fingerprint()
+	}
+	return dropMetricName(metric).Fingerprint()
+}
+
+func (m *multiplication) eval(t model.Time) (promVector, error) {
+	lhs, err := m.lhs.eval(t)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := m.rhs.eval(t)
+	if err != nil {
+		return nil, err
+	}
+	right := map[model.Fingerprint]promSample{}
+	for _, s := range rhs {
+		sig := m.signature(s.metric)
+		if _, ok := right[sig]; ok {
+			return nil, fmt.Errorf("found duplicate series for the match group on the right hand-side of the operation")
+		}
+		right[sig] = s
+	}
+	var result promVector
+	seen := map[model.Fingerprint]bool{}
+	for _, l := range lhs {
+		r, ok := right[m.signature(l.metric)]
+		if !ok {
+			continue
+		}
+		var metric model.Metric
+		switch {
+		case m.groupLeft:
+			metric = dropMetricName(l.metric).Clone()
+			for _, name := range m.include {
+				if v, ok := r.metric[name]; ok && v != "" {
+					metric[name] = v
+				} else {
+					delete(metric, name)
+				}
+			}
+		case m.hasOn:
+			metric = groupMetric(l.metric, m.on)
+		default:
+			metric = dropMetricName(l.metric)
+		}
+		fp := metric.Fingerprint()
+		if seen[fp] {
+			return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left)")
+		}
+		seen[fp] = true
+		result = append(result, promSample{metric: metric, value: l.value * r.value})
+	}
+	return result, nil
+}
+
+// evalRange evaluates the expression at every step of the range like a range query.
+func evalRange(e promExpr, r promv1.Range) (model.Matrix, error) {
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	var order []model.Fingerprint
+	for ts := r.Start; !ts.After(r.End); ts = ts.Add(r.Step) {
+		t := model.TimeFromUnixNano(ts.UnixNano())
+		vector, err := e.eval(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range vector {
+			fp := s.metric.Fingerprint()
+			stream, ok := streams[fp]
+			if !ok {
+				stream = &model.SampleStream{Metric: s.metric}
+				streams[fp] = stream
+				order = append(order, fp)
+			}
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(s.value)})
+		}
+		if r.Step <= 0 {
+			break
+		}
+	}
+	matrix := make(model.Matrix, 0, len(order))
+	for _, fp := range order {
+		matrix = append(matrix, streams[fp])
+	}
+	return matrix, nil
+}
+
+// promToken is a token of a query.
+type promToken struct {
+	kind  byte // 'i' identifier, 's' string, 'd' duration, 'o' operator, or the punctuation character itself
+	value string
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func lexQuery(query string) ([]promToken, error) {
+	var tokens []promToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("(){}[],*", c) >= 0:
+			tokens = append(tokens, promToken{kind: c, value: string(c)})
+			i++
+		case c == '=' || c == '!':
+			op := string(c)
+			if i+1 < len(query) && (query[i+1] == '=' || query[i+1] == '~') {
+				op += string(query[i+1])
+			}
+			if op == "!" || op == "==" {
+				return nil, fmt.Errorf("unsupported operator %q", op)
+			}
+			tokens = append(tokens, promToken{kind: 'o', value: op})
+			i += len(op)
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, promToken{kind: 's', value: query[i+1 : i+1+end]})
+			i += end + 2
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(query) && (query[j] >= '0' && query[j] <= '9' || strings.IndexByte("smhdwy", query[j]) >= 0) {
+				j++
+			}
+			tokens = append(tokens, promToken{kind: 'd', value: query[i:j]})
+			i = j
+		case isIdentChar(c, true):
+			j := i + 1
+			for j < len(query) && isIdentChar(query[j], false) {
+				j++
+			}
+			tokens = append(tokens, promToken{kind: 'i', value: query[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unsupported character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+}
+
+// parseQuery parses a query that the operator can evaluate from raw series.
+func parseQuery(query string) (promExpr, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].value)
+	}
+	return e, nil
+}
+
+func (p *promParser) peek() promToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return promToken{}
+}
+
+func (p *promParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == 'i' && strings.EqualFold(t.value, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *promParser) expect(kind byte) (promToken, error) {
+	t := p.peek()
+	if t.kind != kind {
+		if t.kind == 0 {
+			return t, fmt.Errorf("unexpected end of query")
+		}
+		return t, fmt.Errorf("unexpected %q", t.value)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *promParser) parseExpr() (promExpr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == '*' {
+		p.pos++
+		m := &multiplication{lhs: lhs}
+		if p.keyword("on") {
+			m.hasOn = true
+			if m.on, err = p.parseLabels(); err != nil {
+				return nil, err
+			}
+		}
+		if p.keyword("group_left") {
+			m.groupLeft = true
+			if p.peek().kind == '(' {
+				if m.include, err = p.parseLabels(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if m.rhs, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+		lhs = m
+	}
+	return lhs, nil
+}
+
+func (p *promParser) parseUnary() (promExpr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == '(':
+		p.pos++
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(')')
+		return e, err
+	case t.kind == 'i' && aggregationOps[strings.ToLower(t.value)]:
+		p.pos++
+		return p.parseAggregation(strings.ToLower(t.value))
+	case t.kind == 'i' && t.value == "rate":
+		p.pos++
+		if _, err := p.expect('('); err != nil {
+			return nil, err
+		}
+		s, err := p.parseSelector()
+		if err != nil {
+			return nil, err
+		}
+		if s.window <= 0 {
+			return nil, fmt.Errorf("rate expects a range selector")
+		}
+		_, err = p.expect(')')
+		return &rateCall{arg: s}, err
+	case t.kind == 'i' || t.kind == '{':
+		s, err := p.parseSelector()
+		if err != nil {
+			return nil, err
+		}
+		if s.window > 0 {
+			return nil, fmt.Errorf("range selector must be the argument of rate")
+		}
+		return s, nil
+	}
+	if t.kind == 0 {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.value)
+}
+
+func (p *promParser) parseAggregation(op string) (promExpr, error) {
+	a := &aggregation{op: op}
+	var err error
+	if p.keyword("by") {
+		if a.grouping, err = p.parseLabels(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect('('); err != nil {
+		return nil, err
+	}
+	if a.arg, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	if a.grouping == nil && p.keyword("by") {
+		if a.grouping, err = p.parseLabels(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (p *promParser) parseLabels() ([]model.LabelName, error) {
+	if _, err := p.expect('('); err != nil {
+		return nil, err
+	}
+	labels := []model.LabelName{}
+	for p.peek().kind != ')' {
+		t, err := p.expect('i')
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, model.LabelName(t.value))
+		if p.peek().kind == ',' {
+			p.pos++
+		}
+	}
+	p.pos++
+	return labels, nil
+}
+
+func (p *promParser) parseSelector() (*vectorSelector, error) {
+	s := &vectorSelector{}
+	if t := p.peek(); t.kind == 'i' {
+		p.pos++
+		s.matchers = append(s.matchers, labelMatcher{Type: matchEqual, Name: model.MetricNameLabel, Value: t.value})
+	}
+	if p.peek().kind == '{' {
+		p.pos++
+		for p.peek().kind != '}' {
+			name, err := p.expect('i')
+			if err != nil {
+				return nil, err
+			}
+			op, err := p.expect('o')
+			if err != nil {
+				return nil, err
+			}
+			value, err := p.expect('s')
+			if err != nil {
+				return nil, err
+			}
+			s.matchers = append(s.matchers, labelMatcher{Type: matchTypes[op.value], Name: name.value, Value: value.value})
+			if p.peek().kind == ',' {
+				p.pos++
+			}
+		}
+		p.pos++
+	}
+	if len(s.matchers) == 0 {
+		return nil, fmt.Errorf("selector without matchers")
+	}
+	if p.peek().kind == '[' {
+		p.pos++
+		t, err := p.expect('d')
+		if err != nil {
+			return nil, err
+		}
+		d, err := model.ParseDuration(t.value)
+		if err != nil {
+			return nil, err
+		}
+		s.window = time.Duration(d)
+		if _, err := p.expect(']'); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,238 @@
+package collector
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, queries := range []*querys{
+		nodeQueries, volQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries,
+		networkQueries, namespaceQueries, resourceQuotaQueries, limitRangeQueries,
+	} {
+		for _, q := range *queries {
+			if _, err := parseQuery(q.QueryString); err != nil {
+				t.Errorf("built-in query %s got unexpected error: %v", q.Name, err)
+			}
+		}
+	}
+
+	parseQueryTests := []struct {
+		name  string
+		query string
+		want  []labelMatcher
+		err   bool
+	}{
+		{
+			name:  "metric name",
+			query: "kube_node_labels",
+			want:  []labelMatcher{{Type: matchEqual, Name: "__name__", Value: "kube_node_labels"}},
+		},
+		{
+			name:  "metric name with matchers",
+			query: `kubelet_volume_stats_used_bytes{namespace!='', persistentvolumeclaim=~"data-.*"}`,
+			want: []labelMatcher{
+				{Type: matchEqual, Name: "__name__", Value: "kubelet_volume_stats_used_bytes"},
+				{Type: matchNotEqual, Name: "namespace", Value: ""},
+				{Type: matchRegexp, Name: "persistentvolumeclaim", Value: "data-.*"},
+			},
+		},
+		{
+			name:  "matchers only",
+			query: `{__name__="up",job!~"node"}`,
+			want: []labelMatcher{
+				{Type: matchEqual, Name: "__name__", Value: "up"},
+				{Type: matchNotRegexp, Name: "job", Value: "node"},
+			},
+		},
+		{
+			name:  "join reads both sides",
+			query: "kube_node_status_capacity{resource='cpu'} * on(node) group_left(provider_id) max(kube_node_info) by (node, provider_id)",
+			want: []labelMatcher{
+				{Type: matchEqual, Name: "__name__", Value: "kube_node_status_capacity"},
+				{Type: matchEqual, Name: "resource", Value: "cpu"},
+				{Type: matchEqual, Name: "__name__", Value: "kube_node_info"},
+			},
+		},
+		{name: "unsupported function", query: "sum(irate(up[5m])) by (job)", err: true},
+		{name: "unsupported operator", query: "up / on(job) up", err: true},
+		{name: "unsupported modifier", query: "up * ignoring(job) up", err: true},
+		{name: "range selector without rate", query: "up[5m]", err: true},
+		{name: "unbalanced parentheses", query: "sum(up", err: true},
+	}
+	for _, tt := range parseQueryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := parseQuery(tt.query)
+			if err != nil {
+				if !tt.err {
+					t.Errorf("%s got unexpected error: %v", tt.name, err)
+				}
+				return
+			}
+			if tt.err {
+				t.Fatalf("%s expected error but got nil", tt.name)
+			}
+			var got []labelMatcher
+			for _, s := range expr.selectors() {
+				got = append(got, s.matchers...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got %v want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalRange(t *testing.T) {
+	start := time.Date(2020, 11, 6, 18, 0, 0, 0, time.UTC)
+	ms := func(d time.Duration) model.Time { return model.TimeFromUnixNano(start.Add(d).UnixNano()) }
+	// samples every 30 seconds of a counter that increases by 30 and is reset to 0 after 2 minutes
+	counter := func(metric model.Metric) *model.SampleStream {
+		stream := &model.SampleStream{Metric: metric}
+		for i := -10; i <= 10; i++ {
+			value := float64(30 * (i + 10))
+			if i > 4 {
+				value = float64(30 * (i - 4))
+			}
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: ms(time.Duration(i) * 30 * time.Second), Value: model.SampleValue(value)})
+		}
+		return stream
+	}
+	gauge := func(metric model.Metric, value float64) *model.SampleStream {
+		return &model.SampleStream{Metric: metric, Values: []model.SamplePair{{Timestamp: ms(-time.Minute), Value: model.SampleValue(value)}}}
+	}
+
+	evalRangeTests := []struct {
+		name   string
+		query  string
+		series [][]*model.SampleStream
+		r      promv1.Range
+		want   model.Matrix
+	}{
+		{
+			name:  "selector takes the latest sample within the lookback",
+			query: "usage",
+			series: [][]*model.SampleStream{{
+				{
+					Metric: model.Metric{"__name__": "usage", "id": "1"},
+					Values: []model.SamplePair{
+						{Timestamp: ms(-30 * time.Second), Value: 1},
+						{Timestamp: ms(90 * time.Second), Value: 2},
+						{Timestamp: ms(3 * time.Minute), Value: model.SampleValue(math.Float64frombits(staleNaN))},
+						{Timestamp: ms(8 * time.Minute), Value: 3},
+					},
+				},
+				{
+					Metric: model.Metric{"__name__": "usage", "id": "2"},
+					Values: []model.SamplePair{{Timestamp: ms(-10 * time.Minute), Value: 1}},
+				},
+			}},
+			r: promv1.Range{Start: start, End: start.Add(9 * time.Minute), Step: time.Minute},
+			want: model.Matrix{{
+				Metric: model.Metric{"__name__": "usage", "id": "1"},
+				Values: []model.SamplePair{
+					{Timestamp: ms(0), Value: 1},
+					{Timestamp: ms(time.Minute), Value: 1},
+					{Timestamp: ms(2 * time.Minute), Value: 2},
+					{Timestamp: ms(8 * time.Minute), Value: 3},
+					{Timestamp: ms(9 * time.Minute), Value: 3},
+				},
+			}},
+		},
+		{
+			name:   "rate handles counter resets",
+			query:  "rate(cpu[5m])",
+			series: [][]*model.SampleStream{{counter(model.Metric{"__name__": "cpu", "pod": "a"})}},
+			r:      promv1.Range{Start: start.Add(5 * time.Minute), End: start.Add(5 * time.Minute), Step: time.Minute},
+			want: model.Matrix{{
+				Metric: model.Metric{"pod": "a"},
+				Values: []model.SamplePair{{Timestamp: ms(5 * time.Minute), Value: 1}},
+			}},
+		},
+		{
+			name:  "sum by groups the rates",
+			query: "sum(rate(cpu[5m])) BY (pod)",
+			series: [][]*model.SampleStream{{
+				counter(model.Metric{"__name__": "cpu", "pod": "a", "container": "x"}),
+				counter(model.Metric{"__name__": "cpu", "pod": "a", "container": "y"}),
+				counter(model.Metric{"__name__": "cpu", "pod": "b", "container": "x"}),
+			}},
+			r: promv1.Range{Start: start.Add(5 * time.Minute), End: start.Add(5 * time.Minute), Step: time.Minute},
+			want: model.Matrix{
+				{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: ms(5 * time.Minute), Value: 2}}},
+				{Metric: model.Metric{"pod": "b"}, Values: []model.SamplePair{{Timestamp: ms(5 * time.Minute), Value: 1}}},
+			},
+		},
+		{
+			name:  "max by keeps the largest value",
+			query: "max by (node) (capacity)",
+			series: [][]*model.SampleStream{{
+				gauge(model.Metric{"__name__": "capacity", "node": "n", "instance": "1"}, 4),
+				gauge(model.Metric{"__name__": "capacity", "node": "n", "instance": "2"}, 8),
+			}},
+			r:    promv1.Range{Start: start, End: start, Step: time.Minute},
+			want: model.Matrix{{Metric: model.Metric{"node": "n"}, Values: []model.SamplePair{{Timestamp: ms(0), Value: 8}}}},
+		},
+		{
+			name:  "group_left copies the labels of the right side",
+			query: "capacity * on(node) group_left(provider_id) max(kube_node_info) by (node, provider_id)",
+			series: [][]*model.SampleStream{
+				{
+					gauge(model.Metric{"__name__": "capacity", "node": "n1", "resource": "cpu"}, 4),
+					gauge(model.Metric{"__name__": "capacity", "node": "n1", "resource": "memory"}, 16),
+					gauge(model.Metric{"__name__": "capacity", "node": "n2", "resource": "cpu"}, 2),
+				},
+				{gauge(model.Metric{"__name__": "kube_node_info", "node": "n1", "provider_id": "aws:///i-1"}, 1)},
+			},
+			r: promv1.Range{Start: start, End: start, Step: time.Minute},
+			want: model.Matrix{
+				{Metric: model.Metric{"node": "n1", "resource": "cpu", "provider_id": "aws:///i-1"}, Values: []model.SamplePair{{Timestamp: ms(0), Value: 4}}},
+				{Metric: model.Metric{"node": "n1", "resource": "memory", "provider_id": "aws:///i-1"}, Values: []model.SamplePair{{Timestamp: ms(0), Value: 16}}},
+			},
+		},
+	}
+	for _, tt := range evalRangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := parseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			for i, s := range expr.selectors() {
+				s.setSeries(tt.series[i])
+			}
+			got, err := evalRange(expr, tt.r)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got:\n\t%v\n  want:\n\t%v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalDuplicateRightSeries(t *testing.T) {
+	expr, err := parseQuery("capacity * on(node) group_left info")
+	if err != nil {
+		t.Fatalf("parseQuery got unexpected error: %v", err)
+	}
+	now := model.Time(1604685600000)
+	series := [][]*model.SampleStream{
+		{{Metric: model.Metric{"__name__": "capacity", "node": "n"}, Values: []model.SamplePair{{Timestamp: now, Value: 1}}}},
+		{
+			{Metric: model.Metric{"__name__": "info", "node": "n", "id": "1"}, Values: []model.SamplePair{{Timestamp: now, Value: 1}}},
+			{Metric: model.Metric{"__name__": "info", "node": "n", "id": "2"}, Values: []model.SamplePair{{Timestamp: now, Value: 1}}},
+		},
+	}
+	for i, s := range expr.selectors() {
+		s.setSeries(series[i])
+	}
+	if _, err := expr.eval(now); err == nil {
+		t.Errorf("expected error for duplicate series on the right hand-side but got nil")
+	}
+}
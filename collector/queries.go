@@ -5,11 +5,24 @@
 
 package collector
 
-import "github.com/prometheus/common/model"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/prometheus/common/model"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+)
+
+// The factors convert the samples of a query into seconds. They are defined for samples taken every factorStep and
+// are scaled to the step of the queried range.
 const (
 	maxFactor float64 = 60
 	sumFactor float64 = 60
+
+	factorStep = time.Minute
 )
 
 var (
@@ -24,7 +37,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "node-allocatable-cpu-core-seconds",
 			},
-			RowKey: "node",
+			RowKey: []model.LabelName{"node"},
 		},
 		query{
 			Name:        "node-allocatable-memory-bytes",
@@ -36,7 +49,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "node-allocatable-memory-byte-seconds",
 			},
-			RowKey: "node",
+			RowKey: []model.LabelName{"node"},
 		},
 		query{
 			Name:        "node-capacity-cpu-cores",
@@ -48,7 +61,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "node-capacity-cpu-core-seconds",
 			},
-			RowKey: "node",
+			RowKey: []model.LabelName{"node"},
 		},
 		query{
 			Name:        "node-capacity-memory-bytes",
@@ -60,13 +73,13 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "node-capacity-memory-byte-seconds",
 			},
-			RowKey: "node",
+			RowKey: []model.LabelName{"node"},
 		},
 		query{
 			Name:           "node-labels",
 			QueryString:    "kube_node_labels",
 			MetricKeyRegex: regexFields{"node_labels": "label_*"},
-			RowKey:         "node",
+			RowKey:         []model.LabelName{"node"},
 		},
 	}
 	volQueries = &querys{
@@ -74,7 +87,7 @@ var (
 			Name:        "persistentvolume_pod_info",
 			QueryString: "kube_pod_spec_volumes_persistentvolumeclaims_info * on(persistentvolumeclaim, namespace) group_left(volumename) kube_persistentvolumeclaim_info",
 			MetricKey:   staticFields{"namespace": "namespace", "pod": "pod"},
-			RowKey:      "volumename",
+			RowKey:      []model.LabelName{"volumename"},
 		},
 		query{
 			Name:        "persistentvolumeclaim-capacity-bytes",
@@ -85,7 +98,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "persistentvolumeclaim-capacity-byte-seconds",
 			},
-			RowKey: "volumename",
+			RowKey: []model.LabelName{"volumename"},
 		},
 		query{
 			Name:        "persistentvolumeclaim-request-bytes",
@@ -96,7 +109,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "persistentvolumeclaim-request-byte-seconds",
 			},
-			RowKey: "volumename",
+			RowKey: []model.LabelName{"volumename"},
 		},
 		query{
 			Name:        "persistentvolumeclaim-usage-bytes",
@@ -107,21 +120,21 @@ var (
 				Factor:          sumFactor,
 				TransformedName: "persistentvolumeclaim-usage-byte-seconds",
 			},
-			RowKey: "volumename",
+			RowKey: []model.LabelName{"volumename"},
 		},
 		query{
 			Name:           "persistentvolume-labels",
 			QueryString:    "kube_persistentvolume_labels * on(persistentvolume, namespace) group_left(storageclass) kube_persistentvolume_info",
 			MetricKey:      staticFields{"storageclass": "storageclass", "persistentvolume": "persistentvolume"},
 			MetricKeyRegex: regexFields{"persistentvolume_labels": "label_*"},
-			RowKey:         "persistentvolume",
+			RowKey:         []model.LabelName{"persistentvolume"},
 		},
 		query{
 			Name:           "persistentvolumeclaim-labels",
 			QueryString:    "kube_persistentvolumeclaim_labels * on(persistentvolumeclaim, namespace) group_left(volumename) kube_persistentvolumeclaim_info",
 			MetricKey:      staticFields{"namespace": "namespace", "persistentvolumeclaim": "persistentvolumeclaim"},
 			MetricKeyRegex: regexFields{"persistentvolumeclaim_labels": "label_"},
-			RowKey:         "volumename",
+			RowKey:         []model.LabelName{"volumename"},
 		},
 	}
 	podQueries = &querys{
@@ -135,7 +148,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "pod-limit-cpu-core-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:        "pod-limit-memory-bytes",
@@ -147,7 +160,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "pod-limit-memory-byte-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:        "pod-request-cpu-cores",
@@ -159,7 +172,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "pod-request-cpu-core-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:        "pod-request-memory-bytes",
@@ -171,7 +184,7 @@ var (
 				Factor:          maxFactor,
 				TransformedName: "pod-request-memory-byte-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:        "pod-usage-cpu-cores",
@@ -183,7 +196,7 @@ var (
 				Factor:          sumFactor,
 				TransformedName: "pod-usage-cpu-core-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:        "pod-usage-memory-bytes",
@@ -195,13 +208,165 @@ var (
 				Factor:          sumFactor,
 				TransformedName: "pod-usage-memory-byte-seconds",
 			},
-			RowKey: "pod",
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 		query{
 			Name:           "pod-labels",
 			QueryString:    "kube_pod_labels",
 			MetricKeyRegex: regexFields{"pod_labels": "label_*"},
-			RowKey:         "pod",
+			RowKey:         []model.LabelName{"namespace", "pod"},
+		},
+	}
+	containerQueries = &querys{
+		query{
+			Name:        "container-limit-cpu-cores",
+			QueryString: "sum(kube_pod_container_resource_limits{resource='cpu'}) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-limit-cpu-cores",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "container-limit-cpu-core-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+		query{
+			Name:        "container-limit-memory-bytes",
+			QueryString: "sum(kube_pod_container_resource_limits{resource='memory'}) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-limit-memory-bytes",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "container-limit-memory-byte-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+		query{
+			Name:        "container-request-cpu-cores",
+			QueryString: "sum(kube_pod_container_resource_requests{resource='cpu'}) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-request-cpu-cores",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "container-request-cpu-core-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+		query{
+			Name:        "container-request-memory-bytes",
+			QueryString: "sum(kube_pod_container_resource_requests{resource='memory'}) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-request-memory-bytes",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "container-request-memory-byte-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+		query{
+			Name:        "container-usage-cpu-cores",
+			QueryString: "sum(rate(container_cpu_usage_seconds_total{container!='POD',container!='',pod!=''}[5m])) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-usage-cpu-cores",
+				Method:          "sum",
+				Factor:          sumFactor,
+				TransformedName: "container-usage-cpu-core-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+		query{
+			Name:        "container-usage-memory-bytes",
+			QueryString: "sum(container_memory_usage_bytes{container!='POD',container!='',pod!=''}) by (container, pod, namespace, node)",
+			MetricKey:   staticFields{"container": "container", "pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "container-usage-memory-bytes",
+				Method:          "sum",
+				Factor:          sumFactor,
+				TransformedName: "container-usage-memory-byte-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "container"},
+		},
+	}
+	// extended resources are every resource other than cpu and memory, such as nvidia.com/gpu
+	nodeResourceQueries = &querys{
+		query{
+			Name:        "node-capacity-extended-resources",
+			QueryString: "max(kube_node_status_capacity{resource!~'cpu|memory'}) by (node, resource, unit)",
+			QueryValue: &saveQueryValue{
+				ValName:         "node-capacity-resource",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "node-capacity-resource-seconds",
+			},
+			RowKey: []model.LabelName{"node", "resource"},
+		},
+		query{
+			Name:        "node-allocatable-extended-resources",
+			QueryString: "max(kube_node_status_allocatable{resource!~'cpu|memory'}) by (node, resource, unit)",
+			QueryValue: &saveQueryValue{
+				ValName:         "node-allocatable-resource",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "node-allocatable-resource-seconds",
+			},
+			RowKey: []model.LabelName{"node", "resource"},
+		},
+	}
+	podResourceQueries = &querys{
+		query{
+			Name:        "pod-request-extended-resources",
+			QueryString: "sum(kube_pod_container_resource_requests{resource!~'cpu|memory'}) by (pod, namespace, node, resource, unit)",
+			MetricKey:   staticFields{"pod": "pod", "namespace": "namespace", "node": "node", "resource": "resource", "unit": "unit"},
+			QueryValue: &saveQueryValue{
+				ValName:         "pod-request-resource",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "pod-request-resource-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "resource"},
+		},
+		query{
+			Name:        "pod-limit-extended-resources",
+			QueryString: "sum(kube_pod_container_resource_limits{resource!~'cpu|memory'}) by (pod, namespace, node, resource, unit)",
+			MetricKey:   staticFields{"pod": "pod", "namespace": "namespace", "node": "node", "resource": "resource", "unit": "unit"},
+			QueryValue: &saveQueryValue{
+				ValName:         "pod-limit-resource",
+				Method:          "max",
+				Factor:          maxFactor,
+				TransformedName: "pod-limit-resource-seconds",
+			},
+			RowKey: []model.LabelName{"namespace", "pod", "resource"},
+		},
+	}
+	// the rates are averaged over the interval, and the average times the interval seconds is the number of bytes
+	networkQueries = &querys{
+		query{
+			Name:        "pod-network-receive-bytes",
+			QueryString: "sum(rate(container_network_receive_bytes_total{pod!=''}[5m])) by (pod, namespace, node)",
+			MetricKey:   staticFields{"pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "pod-network-receive-bytes-per-second",
+				Method:          "avg",
+				Factor:          maxFactor,
+				TransformedName: "pod-network-receive-bytes",
+			},
+			RowKey: []model.LabelName{"namespace", "pod"},
+		},
+		query{
+			Name:        "pod-network-transmit-bytes",
+			QueryString: "sum(rate(container_network_transmit_bytes_total{pod!=''}[5m])) by (pod, namespace, node)",
+			MetricKey:   staticFields{"pod": "pod", "namespace": "namespace", "node": "node"},
+			QueryValue: &saveQueryValue{
+				ValName:         "pod-network-transmit-bytes-per-second",
+				Method:          "avg",
+				Factor:          maxFactor,
+				TransformedName: "pod-network-transmit-bytes",
+			},
+			RowKey: []model.LabelName{"namespace", "pod"},
 		},
 	}
 	namespaceQueries = &querys{
@@ -210,7 +375,88 @@ var (
 			QueryString:    "kube_namespace_labels",
 			MetricKey:      staticFields{"namespace": "namespace"},
 			MetricKeyRegex: regexFields{"namespace_labels": "label_*"},
-			RowKey:         "namespace",
+			RowKey:         []model.LabelName{"namespace"},
+		},
+	}
+	resourceQuotaQueries = &querys{
+		query{
+			Name:        "resourcequota-hard",
+			QueryString: "max(kube_resourcequota{type='hard'}) by (namespace, resourcequota, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "resourcequota": "resourcequota", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "resourcequota-hard",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "resourcequota", "resource"},
+		},
+		query{
+			Name:        "resourcequota-used",
+			QueryString: "max(kube_resourcequota{type='used'}) by (namespace, resourcequota, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "resourcequota": "resourcequota", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "resourcequota-used",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "resourcequota", "resource"},
+		},
+	}
+	limitRangeQueries = &querys{
+		query{
+			Name:        "limitrange-min",
+			QueryString: "max(kube_limitrange{constraint='min'}) by (namespace, limitrange, type, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "limitrange": "limitrange", "type": "type", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "limitrange-min",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "limitrange", "type", "resource"},
+		},
+		query{
+			Name:        "limitrange-max",
+			QueryString: "max(kube_limitrange{constraint='max'}) by (namespace, limitrange, type, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "limitrange": "limitrange", "type": "type", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "limitrange-max",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "limitrange", "type", "resource"},
+		},
+		query{
+			Name:        "limitrange-default",
+			QueryString: "max(kube_limitrange{constraint='default'}) by (namespace, limitrange, type, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "limitrange": "limitrange", "type": "type", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "limitrange-default",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "limitrange", "type", "resource"},
+		},
+		query{
+			Name:        "limitrange-default-request",
+			QueryString: "max(kube_limitrange{constraint='defaultRequest'}) by (namespace, limitrange, type, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "limitrange": "limitrange", "type": "type", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "limitrange-default-request",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "limitrange", "type", "resource"},
+		},
+		query{
+			Name:        "limitrange-max-limit-request-ratio",
+			QueryString: "max(kube_limitrange{constraint='maxLimitRequestRatio'}) by (namespace, limitrange, type, resource)",
+			MetricKey:   staticFields{"namespace": "namespace", "limitrange": "limitrange", "type": "type", "resource": "resource"},
+			QueryValue: &saveQueryValue{
+				ValName: "limitrange-max-limit-request-ratio",
+				Method:  "max",
+				Factor:  maxFactor,
+			},
+			RowKey: []model.LabelName{"namespace", "limitrange", "type", "resource"},
 		},
 	}
 )
@@ -223,7 +469,7 @@ type query struct {
 	MetricKey      staticFields
 	MetricKeyRegex regexFields
 	QueryValue     *saveQueryValue
-	RowKey         model.LabelName
+	RowKey         []model.LabelName
 }
 
 type staticFields map[string]model.LabelName
@@ -236,3 +482,120 @@ type saveQueryValue struct {
 	Factor          float64
 	TransformedName string
 }
+
+type customQuerySet struct {
+	name       string
+	queries    *querys
+	columns    []string
+	keyColumns []string
+}
+
+// reservedReportNames are the names of the built-in reports. A custom query set may not use them, or a name such as
+// pod-usage whose report file cm-openshift-pod-usage-usage-YYYYMM.csv starts like the built-in report file.
+var reservedReportNames = []string{"node", "pod", "container", "extended-resource", "network", "storage", "namespace", "resourcequota", "limitrange"}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// getCustomQuerySets converts the custom query sets in the spec into queries and the ordered list of report columns.
+func getCustomQuerySets(specs []kokumetricscfgv1beta1.CustomQuerySetSpec) ([]customQuerySet, error) {
+	// the date columns are written to every row, so no query may write to them
+	reservedColumns := map[string]bool{}
+	for _, col := range (customRow{}).csvHeader() {
+		reservedColumns[col] = true
+	}
+
+	seen := map[string]bool{}
+	querySets := []customQuerySet{}
+	for _, spec := range specs {
+		for _, name := range reservedReportNames {
+			if spec.Name == name || strings.HasPrefix(spec.Name, name+"-usage") {
+				return nil, fmt.Errorf("custom query set %s: name conflicts with the %s report", spec.Name, name)
+			}
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("custom query set %s: name is already in use", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		if len(spec.Queries) <= 0 {
+			return nil, fmt.Errorf("custom query set %s: no queries defined", spec.Name)
+		}
+
+		qs := querys{}
+		columns, keyColumns := []string{}, []string{}
+		seenCols, seenKeys := map[string]bool{}, map[string]bool{}
+		addColumn := func(col string) {
+			if col != "" && !seenCols[col] {
+				seenCols[col] = true
+				columns = append(columns, col)
+			}
+		}
+		for _, cq := range spec.Queries {
+			if cq.Name == "" || cq.Query == "" || len(cq.RowKey) <= 0 {
+				return nil, fmt.Errorf("custom query set %s: query name, query and row_key are required", spec.Name)
+			}
+			if cq.TransformedName != "" && cq.Method == "" {
+				return nil, fmt.Errorf("custom query set %s: query %s: transformed_name requires a method", spec.Name, cq.Name)
+			}
+
+			q := query{
+				Name:        cq.Name,
+				QueryString: cq.Query,
+				MetricKey:   staticFields{},
+			}
+			// the row key labels are always written so that each row can be identified
+			for _, label := range cq.RowKey {
+				q.RowKey = append(q.RowKey, model.LabelName(label))
+				q.MetricKey[label] = model.LabelName(label)
+				if !seenKeys[label] {
+					seenKeys[label] = true
+					keyColumns = append(keyColumns, label)
+				}
+				addColumn(label)
+			}
+			for _, col := range sortedKeys(cq.StaticFields) {
+				q.MetricKey[col] = model.LabelName(cq.StaticFields[col])
+				addColumn(col)
+			}
+			if len(cq.RegexFields) > 0 {
+				q.MetricKeyRegex = regexFields{}
+				for _, col := range sortedKeys(cq.RegexFields) {
+					q.MetricKeyRegex[col] = cq.RegexFields[col]
+					addColumn(col)
+				}
+			}
+			if cq.Method != "" {
+				if err := checkMethod(cq.Method); err != nil {
+					return nil, fmt.Errorf("custom query set %s: query %s: %v", spec.Name, cq.Name, err)
+				}
+				factor := maxFactor
+				if cq.Method == "sum" {
+					factor = sumFactor
+				}
+				q.QueryValue = &saveQueryValue{
+					ValName:         cq.Name,
+					Method:          cq.Method,
+					Factor:          factor,
+					TransformedName: cq.TransformedName,
+				}
+				addColumn(cq.Name)
+				addColumn(cq.TransformedName)
+			}
+			qs = append(qs, q)
+		}
+		for _, col := range columns {
+			if reservedColumns[col] {
+				return nil, fmt.Errorf("custom query set %s: column %s is reserved", spec.Name, col)
+			}
+		}
+		querySets = append(querySets, customQuerySet{name: spec.Name, queries: &qs, columns: columns, keyColumns: keyColumns})
+	}
+	return querySets, nil
+}
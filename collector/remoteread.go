@@ -0,0 +1,168 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+
+	"github.com/project-koku/koku-metrics-operator/prompb"
+)
+
+var (
+	// lookbackDelta is how far back a range query evaluation step looks for the latest sample of a series.
+	lookbackDelta = 5 * time.Minute
+
+	// staleNaN is the value Prometheus writes when a series disappears.
+	staleNaN uint64 = 0x7ff0000000000002
+)
+
+// matchType is the remote read encoding of a label matcher operator.
+type matchType prompb.LabelMatcher_Type
+
+const (
+	matchEqual     = matchType(prompb.LabelMatcher_EQ)
+	matchNotEqual  = matchType(prompb.LabelMatcher_NEQ)
+	matchRegexp    = matchType(prompb.LabelMatcher_RE)
+	matchNotRegexp = matchType(prompb.LabelMatcher_NRE)
+)
+
+var matchTypes = map[string]matchType{"=": matchEqual, "!=": matchNotEqual, "=~": matchRegexp, "!~": matchNotRegexp}
+
+type labelMatcher struct {
+	Type  matchType
+	Name  string
+	Value string
+}
+
+type remoteReadClient interface {
+	Read(ctx context.Context, matchers []labelMatcher, start, end time.Time, step time.Duration) ([]*model.SampleStream, error)
+}
+
+// remoteReader reads raw series with the Prometheus remote read protocol.
+type remoteReader struct {
+	client  *http.Client
+	address string
+}
+
+func getRemoteReadClientFromCfg(cfg *PrometheusConfig) (remoteReadClient, error) {
+	roundTripper, err := getRoundTripper(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteReader{client: &http.Client{Transport: roundTripper}, address: cfg.RemoteReadAddress}, nil
+}
+
+// Read returns the raw samples between start and end of the series matching the matchers.
+func (rr *remoteReader) Read(ctx context.Context, matchers []labelMatcher, start, end time.Time, step time.Duration) ([]*model.SampleStream, error) {
+	data, err := encodeReadRequest(matchers, start, end, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode remote read request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, rr.address, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, err := rr.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote read response: %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("remote read returned status %s: %s", resp.Status, strings.TrimSpace(string(compressed)))
+	}
+	data, err = snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote read response: %v", err)
+	}
+	return decodeReadResponse(data)
+}
+
+// getRemoteReadMatrix reads the raw series of every selector of the expression and evaluates the expression at every
+// step of the range. Instant selectors need the samples within the lookback delta before the first step, and range
+// selectors the samples within their window.
+func (c *PromCollector) getRemoteReadMatrix(ctx context.Context, query query, expr promExpr) (model.Matrix, error) {
+	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+	r := *c.TimeSeries
+	for _, s := range expr.selectors() {
+		before := lookbackDelta
+		if s.window > 0 {
+			before = s.window
+		}
+		series, err := c.RemoteRead.Read(ctx, s.matchers, r.Start.Add(-before), r.End, r.Step)
+		if err != nil {
+			return nil, fmt.Errorf("query: %s: error reading from prometheus: %v", query.QueryString, err)
+		}
+		s.setSeries(series)
+	}
+	matrix, err := evalRange(expr, r)
+	if err != nil {
+		return nil, fmt.Errorf("query: %s: error evaluating remote read series: %v", query.QueryString, err)
+	}
+	return matrix, nil
+}
+
+func timestampMs(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+// encodeReadRequest encodes a remote read ReadRequest with a single query that accepts the SAMPLES response type.
+func encodeReadRequest(matchers []labelMatcher, start, end time.Time, step time.Duration) ([]byte, error) {
+	query := &prompb.Query{
+		StartTimestampMs: timestampMs(start),
+		EndTimestampMs:   timestampMs(end),
+		Hints: &prompb.ReadHints{
+			StepMs:  int64(step / time.Millisecond),
+			StartMs: timestampMs(start),
+			EndMs:   timestampMs(end),
+		},
+	}
+	for _, m := range matchers {
+		query.Matchers = append(query.Matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(m.Type), Name: m.Name, Value: m.Value})
+	}
+	return proto.Marshal(&prompb.ReadRequest{
+		Queries:               []*prompb.Query{query},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
+	})
+}
+
+// decodeReadResponse decodes the time series of a remote read ReadResponse.
+func decodeReadResponse(b []byte) ([]*model.SampleStream, error) {
+	resp := &prompb.ReadResponse{}
+	if err := proto.Unmarshal(b, resp); err != nil {
+		return nil, fmt.Errorf("failed to decode remote read response: %v", err)
+	}
+	var series []*model.SampleStream
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			stream := &model.SampleStream{Metric: make(model.Metric, len(ts.Labels))}
+			for _, l := range ts.Labels {
+				stream.Metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+			for _, s := range ts.Samples {
+				stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(s.Timestamp), Value: model.SampleValue(s.Value)})
+			}
+			series = append(series, stream)
+		}
+	}
+	return series, nil
+}
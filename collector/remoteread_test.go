@@ -0,0 +1,177 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/prompb"
+	"github.com/prometheus/common/model"
+)
+
+// encodeReadResponse encodes the series as a remote read ReadResponse with a single query result.
+func encodeReadResponse(t *testing.T, series []*model.SampleStream) []byte {
+	result := &prompb.QueryResult{}
+	for _, s := range series {
+		ts := &prompb.TimeSeries{}
+		for name, value := range s.Metric {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: string(name), Value: string(value)})
+		}
+		for _, v := range s.Values {
+			ts.Samples = append(ts.Samples, &prompb.Sample{Value: float64(v.Value), Timestamp: int64(v.Timestamp)})
+		}
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+	b, err := proto.Marshal(&prompb.ReadResponse{Results: []*prompb.QueryResult{result}})
+	if err != nil {
+		t.Fatalf("failed to encode read response: %v", err)
+	}
+	return b
+}
+
+// decodeReadRequest decodes the time range and matchers of the first query of a remote read ReadRequest.
+func decodeReadRequest(t *testing.T, b []byte) (int64, int64, []labelMatcher) {
+	req := &prompb.ReadRequest{}
+	if err := proto.Unmarshal(b, req); err != nil || len(req.Queries) == 0 {
+		t.Fatalf("failed to decode read request: %v", err)
+	}
+	if !reflect.DeepEqual(req.AcceptedResponseTypes, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}) {
+		t.Errorf("read request accepts %v want SAMPLES", req.AcceptedResponseTypes)
+	}
+	query := req.Queries[0]
+	var matchers []labelMatcher
+	for _, m := range query.Matchers {
+		matchers = append(matchers, labelMatcher{Type: matchType(m.Type), Name: m.Name, Value: m.Value})
+	}
+	return query.StartTimestampMs, query.EndTimestampMs, matchers
+}
+
+// newRemoteReadServer returns a stub remote read endpoint that serves the series of the metric named by the matchers.
+func newRemoteReadServer(t *testing.T, series map[string][]*model.SampleStream) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Read-Version") == "" {
+			http.Error(w, "missing remote read headers", http.StatusBadRequest)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start, end, matchers := decodeReadRequest(t, body)
+		if len(matchers) == 0 || matchers[0].Name != "__name__" {
+			http.Error(w, "missing metric name matcher", http.StatusBadRequest)
+			return
+		}
+		var selected []*model.SampleStream
+		for _, s := range series[matchers[0].Value] {
+			stream := &model.SampleStream{Metric: s.Metric}
+			for _, v := range s.Values {
+				if int64(v.Timestamp) >= start && int64(v.Timestamp) <= end {
+					stream.Values = append(stream.Values, v)
+				}
+			}
+			selected = append(selected, stream)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(snappy.Encode(nil, encodeReadResponse(t, selected)))
+	}))
+}
+
+func TestGetQueryResultsRemoteRead(t *testing.T) {
+	// raw samples every 30 seconds from before the range until its end
+	gauge := []model.SamplePair{}
+	counter := []model.SamplePair{}
+	for ts := fakeTimeRange.Start.Add(-6 * time.Minute); !ts.After(fakeTimeRange.End); ts = ts.Add(30 * time.Second) {
+		gauge = append(gauge, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: 2})
+		counter = append(counter, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: model.SampleValue(ts.Sub(fakeTimeRange.Start).Seconds())})
+	}
+	server := newRemoteReadServer(t, map[string][]*model.SampleStream{
+		"usage": {{Metric: model.Metric{"__name__": "usage", "id": "1"}, Values: gauge}},
+		"requests": {
+			{Metric: model.Metric{"__name__": "requests", "id": "1", "container": "a"}, Values: counter},
+			{Metric: model.Metric{"__name__": "requests", "id": "1", "container": "b"}, Values: counter},
+		},
+		"info": {{Metric: model.Metric{"__name__": "info", "id": "1", "provider": "p"}, Values: gauge}},
+	})
+	defer server.Close()
+
+	remoteRead, err := getRemoteReadClientFromCfg(&PrometheusConfig{RemoteReadAddress: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create remote read client: %v", err)
+	}
+	queries := &querys{
+		query{
+			Name:        "usage",
+			QueryString: "usage{id!=''} * on(id) group_left(provider) info",
+			MetricKey:   staticFields{"id": "id", "provider": "provider"},
+			QueryValue:  &saveQueryValue{ValName: "usage", Method: "max", Factor: maxFactor, TransformedName: "usage-seconds"},
+			RowKey:      []model.LabelName{"id"},
+		},
+		query{
+			Name:        "requests",
+			QueryString: "sum(rate(requests[5m])) by (id)",
+			QueryValue:  &saveQueryValue{ValName: "requests", Method: "max", Factor: maxFactor, TransformedName: "requests-seconds"},
+			RowKey:      []model.LabelName{"id"},
+		},
+		query{
+			Name:        "limits",
+			QueryString: "limits / 2",
+			QueryValue:  &saveQueryValue{ValName: "limits", Method: "max", Factor: maxFactor, TransformedName: "limits-seconds"},
+			RowKey:      []model.LabelName{"id"},
+		},
+	}
+	// only the query outside the supported subset is a range query
+	mapResults := mappedMockPromResult{"limits / 2": &mockPromResult{value: model.Matrix{
+		{Metric: model.Metric{"id": "1"}, Values: []model.SamplePair{{Timestamp: 1604685600000, Value: 1}}},
+	}}}
+	col := PromCollector{
+		PromConn:   mockPrometheusConnection{mappedResults: &mapResults, t: t},
+		RemoteRead: remoteRead,
+		TimeSeries: &fakeTimeRange,
+		Log:        testLogger,
+		QueryMode:  kokumetricscfgv1beta1.RemoteReadQueryMode,
+	}
+	got := mappedResults{}
+	if err := col.getQueryResults(queries, &got); err != nil {
+		t.Fatalf("getQueryResults got unexpected error: %v", err)
+	}
+	want := mappedResults{"1": {
+		"id":               "1",
+		"provider":         "p",
+		"usage":            "4.000000",
+		"usage-seconds":    "14400.000000",
+		"requests":         "2.000000",
+		"requests-seconds": "7200.000000",
+		"limits":           "1.000000",
+		"limits-seconds":   "60.000000",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getQueryResults got:\n\t%v\n  want:\n\t%v", got, want)
+	}
+}
+
+func TestRemoteReadError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "remote read is disabled", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	remoteRead, err := getRemoteReadClientFromCfg(&PrometheusConfig{RemoteReadAddress: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create remote read client: %v", err)
+	}
+	_, err = remoteRead.Read(context.Background(), []labelMatcher{{Type: matchEqual, Name: "__name__", Value: "up"}}, fakeTimeRange.Start, fakeTimeRange.End, fakeTimeRange.Step)
+	if err == nil {
+		t.Errorf("expected error for status 404 but got nil")
+	}
+}
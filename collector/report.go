@@ -14,11 +14,12 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
 	"github.com/project-koku/koku-metrics-operator/strset"
 )
 
 type dataInterface interface {
-	writeToFile(io.Writer, *strset.Set, bool) error
+	writeToFile(io.Writer, *writtenRows, bool) error
 	getPrefix() string
 }
 
@@ -27,10 +28,15 @@ type fileInterface interface {
 	getOrCreateFile() (*os.File, bool, error)
 }
 
+// data holds the rows of a report. The results are decoded into rows with newRow one at a time while they are written,
+// so that a query set is never held as results and rows at once.
 type data struct {
-	queryData mappedCSVStruct
-	headers   []string
-	prefix    string
+	queryData  mappedCSVStruct
+	results    mappedResults
+	newRow     func(val mappedValues) (csvStruct, error)
+	headers    []string
+	prefix     string
+	anonymizer *anonymizer
 }
 
 type file struct {
@@ -38,14 +44,20 @@ type file struct {
 	path string
 }
 
+// report is written to file. The entity columns identify the rows of an interval: a row of an entity that is already
+// in the file with other values replaces the row that was written before.
 type report struct {
-	data dataInterface
-	file fileInterface
-	size int64
+	data          dataInterface
+	file          fileInterface
+	index         *reportIndex
+	entityColumns []int
+	size          int64
+	previousRows  int
+	replacedRows  int
 }
 
-// writeToFile writes the rows to file. Writes headers if file was created.
-func (d *data) writeToFile(file io.Writer, set *strset.Set, created bool) error {
+// writeToFile writes the rows that are not already written to file. Writes headers if file was created.
+func (d *data) writeToFile(file io.Writer, rows *writtenRows, created bool) error {
 	cw := csv.NewWriter(file)
 	if created {
 		if err := cw.Write(d.headers); err != nil {
@@ -53,16 +65,38 @@ func (d *data) writeToFile(file io.Writer, set *strset.Set, created bool) error
 		}
 	}
 	for _, row := range d.queryData {
-		if !set.Contains(row.string()) {
-			if err := cw.Write(row.csvRow()); err != nil {
-				return fmt.Errorf("writeToFile: failed to write data row: %v", err)
-			}
+		if err := d.writeRow(cw, rows, row); err != nil {
+			return err
+		}
+	}
+	for _, val := range d.results {
+		row, err := d.newRow(val)
+		if err != nil {
+			return fmt.Errorf("writeToFile: %v", err)
+		}
+		if err := d.writeRow(cw, rows, row); err != nil {
+			return err
 		}
 	}
 	cw.Flush()
 	return nil
 }
 
+// writeRow writes the row unless the same row of its entity is already written.
+func (d *data) writeRow(cw *csv.Writer, rows *writtenRows, row csvStruct) error {
+	values, line := row.csvRow(), row.string()
+	if d.anonymizer != nil {
+		values = d.anonymizer.anonymizeRow(d.headers, values)
+		line = strings.Join(values, ",")
+	}
+	if rows.add(values, line) {
+		if err := cw.Write(values); err != nil {
+			return fmt.Errorf("writeToFile: failed to write data row: %v", err)
+		}
+	}
+	return nil
+}
+
 func (d *data) getPrefix() string {
 	return d.prefix
 }
@@ -91,24 +125,96 @@ func (f *file) getOrCreateFile() (*os.File, bool, error) {
 }
 
 func (r *report) writeReport() error {
+	return r.writeReportChunks(nil)
+}
+
+// writeReportChunks writes the data of the report and then the data of every chunk. The rows of the hour that are
+// already in the file are read once, so that a report can be written one partition at a time. The rows replaced by
+// re-collected rows are recorded in the index and removed from the file by RemoveReplacedRows once the collection is
+// done. The report files are moved out when they are packaged, so the replaced rows were not packaged yet.
+func (r *report) writeReportChunks(chunks func(write func(dataInterface) error) error) error {
 	csvFile, fileCreated, err := r.file.getOrCreateFile()
 	if err != nil {
 		return fmt.Errorf("writeReport: failed to get or create csv: %v", err)
 	}
 	defer csvFile.Close()
-	set, err := readCSV(csvFile, strset.NewSet(), r.data.getPrefix())
+	rows, err := r.writtenRows(csvFile)
 	if err != nil {
 		return fmt.Errorf("writeReport: failed to read csv: %v", err)
 	}
-	if err := r.data.writeToFile(csvFile, set, fileCreated); err != nil {
+	r.previousRows = len(rows.rows)
+	if err := r.data.writeToFile(csvFile, rows, fileCreated); err != nil {
 		return fmt.Errorf("writeReport: failed to write to file: %v", err)
 	}
-	fileInfo, err := csvFile.Stat()
+	if chunks != nil {
+		if err := chunks(func(d dataInterface) error { return d.writeToFile(csvFile, rows, false) }); err != nil {
+			return fmt.Errorf("writeReport: failed to write to file: %v", err)
+		}
+	}
+	if err := csvFile.Sync(); err != nil {
+		return err
+	}
+	r.replacedRows = rows.replaced.Len()
+	if r.replacedRows > 0 {
+		if err := r.removeReplaced(csvFile.Name(), rows.replaced); err != nil {
+			return fmt.Errorf("writeReport: failed to replace rows: %v", err)
+		}
+	}
+	fileInfo, err := os.Stat(csvFile.Name())
 	if err != nil {
 		return fmt.Errorf("writeReport: failed to get file size: %v", err)
 	}
 	r.size = fileInfo.Size()
-	return csvFile.Sync()
+	if r.index != nil {
+		if err := r.index.save(r.data.getPrefix(), rows, fileInfo); err != nil {
+			return fmt.Errorf("writeReport: %v", err)
+		}
+	}
+	return nil
+}
+
+// writtenRows returns the rows of the hour that are already in the file. Without an index, the whole file is read.
+func (r *report) writtenRows(csvFile *os.File) (*writtenRows, error) {
+	if r.index != nil {
+		return r.index.load(csvFile, r.data.getPrefix(), r.entityColumns)
+	}
+	lines, err := readCSV(csvFile, strset.NewSet(), r.data.getPrefix())
+	if err != nil {
+		return nil, err
+	}
+	rows := newWrittenRows(r.entityColumns)
+	for line := range lines.Range() {
+		values, err := newCSVReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return nil, err
+		}
+		rows.add(values, strings.Join(values, ","))
+	}
+	return rows, nil
+}
+
+// removeReplaced records the replaced rows of the interval for RemoveReplacedRows. Without an index, they are removed
+// from the report file right away.
+func (r *report) removeReplaced(path string, replaced *strset.Set) error {
+	if r.index != nil {
+		return r.index.remove(r.data.getPrefix(), replaced)
+	}
+	keys := strset.NewSet()
+	for key := range replaced.Range() {
+		keys.Add(rowKey(r.data.getPrefix()) + key)
+	}
+	_, err := removeRows(path, keys)
+	return err
+}
+
+// markCorrections records in the reports directory that rows of an interval in an earlier package were written again,
+// so that the next package declares the corrections in its manifest.
+func markCorrections(reportsPath string) error {
+	f, err := os.OpenFile(filepath.Join(reportsPath, dirconfig.CorrectionsFile), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("markCorrections: %v", err)
+	}
+	return f.Close()
 }
 
 // readCSV reads the file and puts each row into a set, excluding rows that do not start with prefix.
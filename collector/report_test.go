@@ -48,7 +48,7 @@ func (f *fakeData) getPrefix() string {
 	return f.prefix
 }
 
-func (f *fakeData) writeToFile(w io.Writer, s *strset.Set, b bool) error {
+func (f *fakeData) writeToFile(w io.Writer, rows *writtenRows, b bool) error {
 	return f.writeErr
 }
 
@@ -242,7 +242,7 @@ func TestWriteToFile(t *testing.T) {
 	writeToFileTests := []struct {
 		name     string
 		report   *data
-		set      *strset.Set
+		rows     *writtenRows
 		writer   io.Writer
 		created  bool
 		expected string
@@ -251,7 +251,7 @@ func TestWriteToFile(t *testing.T) {
 		{
 			name:     "write header to writer",
 			report:   &data{headers: []string{"header1"}},
-			set:      strset.NewSet(),
+			rows:     newWrittenRows(nil),
 			writer:   builder,
 			created:  true,
 			expected: "header1\n",
@@ -263,7 +263,7 @@ func TestWriteToFile(t *testing.T) {
 				headers:   fakeCSVstruct{}.csvHeader(),
 				queryData: fakeQueryData,
 			},
-			set:      strset.NewSet(),
+			rows:     newWrittenRows(nil),
 			writer:   builder,
 			created:  true,
 			expected: "header1\nfake-header,fake-header2\nfake-row,fake-row2\n",
@@ -275,16 +275,41 @@ func TestWriteToFile(t *testing.T) {
 				headers:   fakeCSVstruct{}.csvHeader(),
 				queryData: fakeQueryData,
 			},
-			set:      strset.NewSet(),
+			rows:     newWrittenRows(nil),
 			writer:   builder,
 			created:  false,
 			expected: "header1\nfake-header,fake-header2\nfake-row,fake-row2\nfake-row,fake-row2\n",
 			err:      nil,
 		},
+		{
+			name: "write decoded results to writer",
+			report: &data{
+				headers: fakeCSVstruct{}.csvHeader(),
+				results: mappedResults{"fake": mappedValues{}},
+				newRow:  func(mappedValues) (csvStruct, error) { return fakeCSVstruct{}, nil },
+			},
+			rows:     newWrittenRows(nil),
+			writer:   builder,
+			created:  false,
+			expected: "header1\nfake-header,fake-header2\nfake-row,fake-row2\nfake-row,fake-row2\nfake-row,fake-row2\n",
+			err:      nil,
+		},
+		{
+			name: "failed to decode results",
+			report: &data{
+				headers: fakeCSVstruct{}.csvHeader(),
+				results: mappedResults{"fake": mappedValues{}},
+				newRow:  func(mappedValues) (csvStruct, error) { return nil, errTest },
+			},
+			rows:    newWrittenRows(nil),
+			writer:  builder,
+			created: false,
+			err:     errTest,
+		},
 	}
 	for _, tt := range writeToFileTests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := tt.report.writeToFile(tt.writer, tt.set, tt.created)
+			err := tt.report.writeToFile(tt.writer, tt.rows, tt.created)
 			if err != nil && tt.err == nil {
 				t.Errorf("%s got unexpected error: %v", tt.name, err)
 			}
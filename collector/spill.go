@@ -0,0 +1,152 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spillPartitions is the number of files the rows of a spilled query set are split into by row key. The rows of one
+// partition are merged in memory when they are written.
+const spillPartitions = 16
+
+type spillRecord struct {
+	Key    string       `json:"k"`
+	Values mappedValues `json:"v"`
+}
+
+// rowSpill moves the merged rows of a query set to partition files on disk whenever there are more than maxRows of
+// them. A row key is always written to the same partition, so that the fields of a row that were merged by different
+// queries are brought together again when the partition is read.
+type rowSpill struct {
+	dir     string
+	maxRows int
+	files   []*os.File
+	rows    int64
+}
+
+// newRowSpill returns nil when maxRows is not positive, which keeps every row in memory.
+func newRowSpill(dir string, maxRows int64) *rowSpill {
+	if maxRows <= 0 {
+		return nil
+	}
+	return &rowSpill{dir: dir, maxRows: int(maxRows)}
+}
+
+// spillIfFull spills the results when they have more than maxRows rows.
+func (s *rowSpill) spillIfFull(results *mappedResults) error {
+	if s == nil || len(*results) <= s.maxRows {
+		return nil
+	}
+	return s.spill(results)
+}
+
+// spill appends the rows to their partitions and empties the results.
+func (s *rowSpill) spill(results *mappedResults) error {
+	if s.files == nil {
+		for i := 0; i < spillPartitions; i++ {
+			f, err := ioutil.TempFile(s.dir, "report-spill-")
+			if err != nil {
+				s.close()
+				return fmt.Errorf("spill: failed to create partition: %v", err)
+			}
+			s.files = append(s.files, f)
+		}
+	}
+	writers := make([]*bufio.Writer, len(s.files))
+	encoders := make([]*json.Encoder, len(s.files))
+	for i, f := range s.files {
+		writers[i] = bufio.NewWriter(f)
+		encoders[i] = json.NewEncoder(writers[i])
+	}
+	for key, val := range *results {
+		if err := encoders[partitionOf(key)].Encode(spillRecord{Key: key, Values: val}); err != nil {
+			return fmt.Errorf("spill: failed to write row: %v", err)
+		}
+	}
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("spill: failed to write partition: %v", err)
+		}
+	}
+	s.rows += int64(len(*results))
+	*results = mappedResults{}
+	return nil
+}
+
+func partitionOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % spillPartitions)
+}
+
+// forEachPartition calls fn with the results when nothing was spilled. Otherwise the remaining rows are spilled too and
+// fn is called with the merged rows of each partition in turn.
+func (s *rowSpill) forEachPartition(results *mappedResults, fn func(mappedResults) error) error {
+	if s == nil || s.files == nil {
+		return fn(*results)
+	}
+	if len(*results) > 0 {
+		if err := s.spill(results); err != nil {
+			return err
+		}
+	}
+	for _, f := range s.files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("spill: failed to read partition: %v", err)
+		}
+		part := mappedResults{}
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for {
+			var rec spillRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("spill: failed to read row: %v", err)
+			}
+			row, ok := part[rec.Key]
+			if !ok {
+				part[rec.Key] = rec.Values
+				continue
+			}
+			// later queries overwrite the fields of earlier ones, as they do when the rows are merged in memory
+			for field, val := range rec.Values {
+				row[field] = val
+			}
+		}
+		if err := fn(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spilledRows returns the number of rows written to the partitions. A row merged by several queries can be counted
+// more than once.
+func (s *rowSpill) spilledRows() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.rows
+}
+
+// close removes the partition files.
+func (s *rowSpill) close() {
+	if s == nil {
+		return
+	}
+	for _, f := range s.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.files = nil
+}
@@ -0,0 +1,169 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+)
+
+func TestRowSpill(t *testing.T) {
+	newResults := func(field string, keys ...string) mappedResults {
+		results := mappedResults{}
+		for _, key := range keys {
+			results[key] = mappedValues{"key": key, field: field + "-" + key}
+		}
+		return results
+	}
+	spillTests := []struct {
+		name        string
+		maxRows     int64
+		merges      []mappedResults
+		wantSpilled int64
+		wantParts   int
+	}{
+		{
+			name:      "not positive never spills",
+			maxRows:   0,
+			merges:    []mappedResults{newResults("a", "1", "2", "3")},
+			wantParts: 1,
+		},
+		{
+			name:      "within the limit stays in memory",
+			maxRows:   3,
+			merges:    []mappedResults{newResults("a", "1", "2", "3")},
+			wantParts: 1,
+		},
+		{
+			name:    "fields of different merges are brought together",
+			maxRows: 1,
+			merges: []mappedResults{
+				newResults("a", "1", "2", "3"),
+				newResults("b", "1", "2"),
+				newResults("c", "3"),
+			},
+			wantSpilled: 6,
+			wantParts:   spillPartitions,
+		},
+	}
+	for _, tt := range spillTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "spill")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			spill := newRowSpill(dir, tt.maxRows)
+			defer spill.close()
+			results := mappedResults{}
+			want := mappedResults{}
+			for _, merge := range tt.merges {
+				for key, val := range merge {
+					if results[key] == nil {
+						results[key] = mappedValues{}
+					}
+					if want[key] == nil {
+						want[key] = mappedValues{}
+					}
+					for field, v := range val {
+						results[key][field] = v
+						want[key][field] = v
+					}
+				}
+				if err := spill.spillIfFull(&results); err != nil {
+					t.Fatalf("%s got unexpected error: %v", tt.name, err)
+				}
+			}
+
+			got := mappedResults{}
+			parts := 0
+			if err := spill.forEachPartition(&results, func(part mappedResults) error {
+				parts++
+				for key, val := range part {
+					if _, ok := got[key]; ok {
+						t.Errorf("%s row %s is in more than one partition", tt.name, key)
+					}
+					got[key] = val
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s got rows %v want %v", tt.name, got, want)
+			}
+			if parts != tt.wantParts {
+				t.Errorf("%s got %d partitions want %d", tt.name, parts, tt.wantParts)
+			}
+			if spilled := spill.spilledRows(); spilled != tt.wantSpilled {
+				t.Errorf("%s got %d spilled rows want %d", tt.name, spilled, tt.wantSpilled)
+			}
+			spill.close()
+			if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+				t.Errorf("%s left %d partition files behind", tt.name, len(files))
+			}
+		})
+	}
+}
+
+func TestGenerateReportsSpilled(t *testing.T) {
+	tempDir := getTempDir(t, os.ModePerm, "./test_files", "test-dir-*")
+	defer os.RemoveAll(tempDir)
+	dirCfg := &dirconfig.DirectoryConfig{
+		Parent:  dirconfig.Directory{Path: tempDir},
+		Reports: dirconfig.Directory{Path: filepath.Join(tempDir, "reports")},
+	}
+
+	mapResults := make(mappedMockPromResult)
+	queryList := []*querys{nodeQueries, namespaceQueries, podQueries, containerQueries, nodeResourceQueries, podResourceQueries, networkQueries, volQueries, resourceQuotaQueries, limitRangeQueries}
+	for _, q := range queryList {
+		for _, query := range *q {
+			res := &model.Matrix{}
+			Load(filepath.Join("test_files", "test_data", query.Name), res, t)
+			mapResults[query.QueryString] = &mockPromResult{value: *res}
+		}
+	}
+
+	fakeCollector := &PromCollector{
+		PromConn: mockPrometheusConnection{
+			mappedResults: &mapResults,
+			t:             t,
+		},
+		TimeSeries:  &fakeTimeRange,
+		Log:         testLogger,
+		Parallelism: 4,
+	}
+	maxRows := int64(1)
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	kmCfg.Spec.MaxRowsInMemory = &maxRows
+	if err := GenerateReports(kmCfg, dirCfg, fakeCollector, nil); err != nil {
+		t.Fatalf("Failed to generate reports: %v", err)
+	}
+	if kmCfg.Status.Reports.SpilledRows == 0 {
+		t.Errorf("no rows were spilled")
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "report-spill-*")); len(files) != 0 {
+		t.Errorf("partition files were left behind: %v", files)
+	}
+
+	// spilling the rows produces the same reports as merging them in memory
+	expectedMap := getFiles("expected_reports", t)
+	for expected, expectedinfo := range expectedMap {
+		generatedinfo, err := os.Open(filepath.Join(dirCfg.Reports.Path, expected))
+		if err != nil {
+			t.Errorf("%s report file was not generated", expected)
+			continue
+		}
+		if err := compareFiles(expectedinfo, generatedinfo); err != nil {
+			t.Errorf("%s files do not compare: error: %v", expected, err)
+		}
+		generatedinfo.Close()
+	}
+}
@@ -46,6 +46,20 @@ type csvStruct interface {
 	string() string
 }
 
+func newCustomRow(ts *promv1.Range, columns []string) customRow {
+	return customRow{dateTimes: newDates(ts), columns: columns}
+}
+func newContainerRow(ts *promv1.Range) containerRow { return containerRow{dateTimes: newDates(ts)} }
+func newExtendedResourceRow(ts *promv1.Range) extendedResourceRow {
+	return extendedResourceRow{dateTimes: newDates(ts)}
+}
+func newResourceQuotaRow(ts *promv1.Range) resourceQuotaRow {
+	return resourceQuotaRow{dateTimes: newDates(ts)}
+}
+func newLimitRangeRow(ts *promv1.Range) limitRangeRow {
+	return limitRangeRow{dateTimes: newDates(ts)}
+}
+func newNetworkRow(ts *promv1.Range) networkRow     { return networkRow{dateTimes: newDates(ts)} }
 func newNamespaceRow(ts *promv1.Range) namespaceRow { return namespaceRow{dateTimes: newDates(ts)} }
 func newNodeRow(ts *promv1.Range) nodeRow           { return nodeRow{dateTimes: newDates(ts)} }
 func newPodRow(ts *promv1.Range) podRow             { return podRow{dateTimes: newDates(ts)} }
@@ -80,15 +94,108 @@ func (row namespaceRow) csvRow() []string {
 
 func (row namespaceRow) string() string { return strings.Join(row.csvRow(), ",") }
 
+type resourceQuotaRow struct {
+	*dateTimes
+	Namespace     string `mapstructure:"namespace"`
+	ResourceQuota string `mapstructure:"resourcequota"`
+	Resource      string `mapstructure:"resource"`
+	Hard          string `mapstructure:"resourcequota-hard"`
+	Used          string `mapstructure:"resourcequota-used"`
+}
+
+func (resourceQuotaRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"namespace",
+		"resourcequota",
+		"resource",
+		"hard",
+		"used"}
+}
+
+func (row resourceQuotaRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Namespace,
+		row.ResourceQuota,
+		row.Resource,
+		row.Hard,
+		row.Used,
+	}
+}
+
+func (row resourceQuotaRow) string() string { return strings.Join(row.csvRow(), ",") }
+
+type limitRangeRow struct {
+	*dateTimes
+	Namespace            string `mapstructure:"namespace"`
+	LimitRange           string `mapstructure:"limitrange"`
+	Type                 string `mapstructure:"type"`
+	Resource             string `mapstructure:"resource"`
+	Min                  string `mapstructure:"limitrange-min"`
+	Max                  string `mapstructure:"limitrange-max"`
+	Default              string `mapstructure:"limitrange-default"`
+	DefaultRequest       string `mapstructure:"limitrange-default-request"`
+	MaxLimitRequestRatio string `mapstructure:"limitrange-max-limit-request-ratio"`
+}
+
+func (limitRangeRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"namespace",
+		"limitrange",
+		"type",
+		"resource",
+		"min",
+		"max",
+		"default",
+		"default_request",
+		"max_limit_request_ratio"}
+}
+
+func (row limitRangeRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Namespace,
+		row.LimitRange,
+		row.Type,
+		row.Resource,
+		row.Min,
+		row.Max,
+		row.Default,
+		row.DefaultRequest,
+		row.MaxLimitRequestRatio,
+	}
+}
+
+func (row limitRangeRow) string() string { return strings.Join(row.csvRow(), ",") }
+
 type nodeRow struct {
 	*dateTimes
-	Node                          string `mapstructure:"node"`
-	NodeCapacityCPUCores          string `mapstructure:"node-capacity-cpu-cores"`
-	ModeCapacityCPUCoreSeconds    string `mapstructure:"node-capacity-cpu-core-seconds"`
-	NodeCapacityMemoryBytes       string `mapstructure:"node-capacity-memory-bytes"`
-	NodeCapacityMemoryByteSeconds string `mapstructure:"node-capacity-memory-byte-seconds"`
-	ResourceID                    string `mapstructure:"resource_id"`
-	NodeLabels                    string `mapstructure:"node_labels"`
+	Node                             string `mapstructure:"node"`
+	NodeCapacityCPUCores             string `mapstructure:"node-capacity-cpu-cores"`
+	ModeCapacityCPUCoreSeconds       string `mapstructure:"node-capacity-cpu-core-seconds"`
+	NodeCapacityMemoryBytes          string `mapstructure:"node-capacity-memory-bytes"`
+	NodeCapacityMemoryByteSeconds    string `mapstructure:"node-capacity-memory-byte-seconds"`
+	NodeAllocatableCPUCores          string `mapstructure:"node-allocatable-cpu-cores"`
+	NodeAllocatableCPUCoreSeconds    string `mapstructure:"node-allocatable-cpu-core-seconds"`
+	NodeAllocatableMemoryBytes       string `mapstructure:"node-allocatable-memory-bytes"`
+	NodeAllocatableMemoryByteSeconds string `mapstructure:"node-allocatable-memory-byte-seconds"`
+	ResourceID                       string `mapstructure:"resource_id"`
+	ProviderID                       string `mapstructure:"provider_id"`
+	NodeLabels                       string `mapstructure:"node_labels"`
 }
 
 func (nodeRow) csvHeader() []string {
@@ -98,11 +205,6 @@ func (nodeRow) csvHeader() []string {
 		"interval_start",
 		"interval_end",
 		"node",
-		// "node_capacity_cpu_cores",  // if Node and Pod reports are ever separated, these lines can be uncommented
-		// "node_capacity_cpu_core_seconds",
-		// "node_capacity_memory_bytes",
-		// "node_capacity_memory_byte_seconds",
-		// "resource_id",
 		"node_labels"}
 }
 
@@ -113,17 +215,60 @@ func (row nodeRow) csvRow() []string {
 		row.IntervalStart,
 		row.IntervalEnd,
 		row.Node,
-		// row.NodeCapacityCPUCores,  // if Node and Pod reports are ever separated, these lines can be uncommented
-		// row.ModeCapacityCPUCoreSeconds,
-		// row.NodeCapacityMemoryBytes,
-		// row.NodeCapacityMemoryByteSeconds,
-		// row.ResourceID,
 		row.NodeLabels,
 	}
 }
 
 func (row nodeRow) string() string { return strings.Join(row.csvRow(), ",") }
 
+// standaloneNodeRow is the node report row of the standalone-node report schema.
+type standaloneNodeRow struct {
+	nodeRow
+}
+
+func (standaloneNodeRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"node",
+		"node_capacity_cpu_cores",
+		"node_capacity_cpu_core_seconds",
+		"node_capacity_memory_bytes",
+		"node_capacity_memory_byte_seconds",
+		"node_allocatable_cpu_cores",
+		"node_allocatable_cpu_core_seconds",
+		"node_allocatable_memory_bytes",
+		"node_allocatable_memory_byte_seconds",
+		"resource_id",
+		"provider_id",
+		"node_labels"}
+}
+
+func (row standaloneNodeRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Node,
+		row.NodeCapacityCPUCores,
+		row.ModeCapacityCPUCoreSeconds,
+		row.NodeCapacityMemoryBytes,
+		row.NodeCapacityMemoryByteSeconds,
+		row.NodeAllocatableCPUCores,
+		row.NodeAllocatableCPUCoreSeconds,
+		row.NodeAllocatableMemoryBytes,
+		row.NodeAllocatableMemoryByteSeconds,
+		row.ResourceID,
+		row.ProviderID,
+		row.NodeLabels,
+	}
+}
+
+func (row standaloneNodeRow) string() string { return strings.Join(row.csvRow(), ",") }
+
 type podRow struct {
 	*dateTimes
 	nodeRow
@@ -187,6 +332,151 @@ func (row podRow) csvRow() []string {
 
 func (row podRow) string() string { return strings.Join(row.csvRow(), ",") }
 
+type containerRow struct {
+	*dateTimes
+	Node                              string `mapstructure:"node"`
+	Namespace                         string `mapstructure:"namespace"`
+	Pod                               string `mapstructure:"pod"`
+	Container                         string `mapstructure:"container"`
+	ContainerUsageCPUCoreSeconds      string `mapstructure:"container-usage-cpu-core-seconds"`
+	ContainerRequestCPUCoreSeconds    string `mapstructure:"container-request-cpu-core-seconds"`
+	ContainerLimitCPUCoreSeconds      string `mapstructure:"container-limit-cpu-core-seconds"`
+	ContainerUsageMemoryByteSeconds   string `mapstructure:"container-usage-memory-byte-seconds"`
+	ContainerRequestMemoryByteSeconds string `mapstructure:"container-request-memory-byte-seconds"`
+	ContainerLimitMemoryByteSeconds   string `mapstructure:"container-limit-memory-byte-seconds"`
+}
+
+func (containerRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"node",
+		"namespace",
+		"pod",
+		"container",
+		"container_usage_cpu_core_seconds",
+		"container_request_cpu_core_seconds",
+		"container_limit_cpu_core_seconds",
+		"container_usage_memory_byte_seconds",
+		"container_request_memory_byte_seconds",
+		"container_limit_memory_byte_seconds"}
+}
+
+func (row containerRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Node,
+		row.Namespace,
+		row.Pod,
+		row.Container,
+		row.ContainerUsageCPUCoreSeconds,
+		row.ContainerRequestCPUCoreSeconds,
+		row.ContainerLimitCPUCoreSeconds,
+		row.ContainerUsageMemoryByteSeconds,
+		row.ContainerRequestMemoryByteSeconds,
+		row.ContainerLimitMemoryByteSeconds,
+	}
+}
+
+func (row containerRow) string() string { return strings.Join(row.csvRow(), ",") }
+
+// extendedResourceRow is a long-format row with one line per pod and extended resource.
+type extendedResourceRow struct {
+	*dateTimes
+	Node                           string `mapstructure:"node"`
+	Namespace                      string `mapstructure:"namespace"`
+	Pod                            string `mapstructure:"pod"`
+	Resource                       string `mapstructure:"resource"`
+	Unit                           string `mapstructure:"unit"`
+	PodRequestResourceSeconds      string `mapstructure:"pod-request-resource-seconds"`
+	PodLimitResourceSeconds        string `mapstructure:"pod-limit-resource-seconds"`
+	NodeCapacityResource           string `mapstructure:"node-capacity-resource"`
+	NodeCapacityResourceSeconds    string `mapstructure:"node-capacity-resource-seconds"`
+	NodeAllocatableResourceSeconds string `mapstructure:"node-allocatable-resource-seconds"`
+}
+
+func (extendedResourceRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"node",
+		"namespace",
+		"pod",
+		"resource",
+		"unit",
+		"pod_request_resource_seconds",
+		"pod_limit_resource_seconds",
+		"node_capacity_resource",
+		"node_capacity_resource_seconds",
+		"node_allocatable_resource_seconds"}
+}
+
+func (row extendedResourceRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Node,
+		row.Namespace,
+		row.Pod,
+		row.Resource,
+		row.Unit,
+		row.PodRequestResourceSeconds,
+		row.PodLimitResourceSeconds,
+		row.NodeCapacityResource,
+		row.NodeCapacityResourceSeconds,
+		row.NodeAllocatableResourceSeconds,
+	}
+}
+
+func (row extendedResourceRow) string() string { return strings.Join(row.csvRow(), ",") }
+
+type networkRow struct {
+	*dateTimes
+	Node                    string `mapstructure:"node"`
+	Namespace               string `mapstructure:"namespace"`
+	Pod                     string `mapstructure:"pod"`
+	PodNetworkReceiveBytes  string `mapstructure:"pod-network-receive-bytes"`
+	PodNetworkTransmitBytes string `mapstructure:"pod-network-transmit-bytes"`
+}
+
+func (networkRow) csvHeader() []string {
+	return []string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end",
+		"node",
+		"namespace",
+		"pod",
+		"pod_network_receive_bytes",
+		"pod_network_transmit_bytes"}
+}
+
+func (row networkRow) csvRow() []string {
+	return []string{
+		row.ReportPeriodStart,
+		row.ReportPeriodEnd,
+		row.IntervalStart,
+		row.IntervalEnd,
+		row.Node,
+		row.Namespace,
+		row.Pod,
+		row.PodNetworkReceiveBytes,
+		row.PodNetworkTransmitBytes,
+	}
+}
+
+func (row networkRow) string() string { return strings.Join(row.csvRow(), ",") }
+
 type storageRow struct {
 	*dateTimes
 	Namespace                                string
@@ -242,3 +532,30 @@ func (row storageRow) csvRow() []string {
 }
 
 func (row storageRow) string() string { return strings.Join(row.csvRow(), ",") }
+
+// customRow is a report row with the columns defined by a custom query set.
+type customRow struct {
+	*dateTimes
+	columns []string
+	values  mappedValues
+}
+
+func (row customRow) csvHeader() []string {
+	return append([]string{
+		"report_period_start",
+		"report_period_end",
+		"interval_start",
+		"interval_end"},
+		row.columns...)
+}
+
+func (row customRow) csvRow() []string {
+	result := row.dateTimes.csvRow()
+	for _, col := range row.columns {
+		val, _ := row.values[col].(string)
+		result = append(result, val)
+	}
+	return result
+}
+
+func (row customRow) string() string { return strings.Join(row.csvRow(), ",") }
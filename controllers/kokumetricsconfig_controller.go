@@ -7,6 +7,7 @@ package controllers
 
 import (
 	"context"
+	cryptorand "crypto/rand"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -47,7 +48,13 @@ var (
 	pullSecretAuthKey        = "cloud.openshift.com"
 	authSecretUserKey        = "username"
 	authSecretPasswordKey    = "password"
-	promCompareFormat        = "2006-01-02T15"
+	promSecretTokenKey       = "token"
+	promClientCertKey        = "tls.crt"
+	promClientKeyKey         = "tls.key"
+	promCABundleKey          = "ca-bundle.crt"
+	reportSaltSecretName     = "koku-metrics-operator-report-salt"
+	reportSaltKey            = "salt"
+	reportSaltBytes          = 32
 
 	falseDef = false
 	trueDef  = true
@@ -66,8 +73,9 @@ type KokuMetricsConfigReconciler struct {
 	InCluster bool
 	Namespace string
 
-	cvClientBuilder cv.ClusterVersionBuilder
-	promCollector   *collector.PromCollector
+	cvClientBuilder  cv.ClusterVersionBuilder
+	promCollector    *collector.PromCollector
+	kubeletCollector *collector.KubeletCollector
 }
 
 type previousAuthValidation struct {
@@ -148,6 +156,44 @@ func ReflectSpec(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.Ko
 
 	StringReflectSpec(r, kmCfg, &kmCfg.Spec.PrometheusConfig.SvcAddress, &kmCfg.Status.Prometheus.SvcAddress, kokumetricscfgv1beta1.DefaultPrometheusSvcAddress)
 	kmCfg.Status.Prometheus.SkipTLSVerification = kmCfg.Spec.PrometheusConfig.SkipTLSVerification
+
+	promSpec := &kmCfg.Spec.PrometheusConfig
+	promStatus := &kmCfg.Status.Prometheus
+	promStatus.MaxBackfillHours = promSpec.MaxBackfillHours
+	promStatus.QueryParallelism = promSpec.QueryParallelism
+	promStatus.QueryMode = promSpec.QueryMode
+	if promStatus.QueryMode == "" {
+		promStatus.QueryMode = kokumetricscfgv1beta1.RangeQueryMode
+	}
+	// the remote read endpoint defaults to the read API of the service address
+	StringReflectSpec(r, kmCfg, &promSpec.RemoteReadAddress, &promStatus.RemoteReadAddress, strings.TrimSuffix(promStatus.SvcAddress, "/")+"/api/v1/read")
+	promStatus.CollectionIntervalMinutes = promSpec.CollectionIntervalMinutes
+	promStatus.QueryStepSeconds = promSpec.QueryStepSeconds
+	promStatus.SettleDelayMinutes = promSpec.SettleDelayMinutes
+	promStatus.RecollectHours = promSpec.RecollectHours
+	promStatus.Headers = promSpec.Headers
+	promStatus.QueryParameters = promSpec.QueryParameters
+	StringReflectSpec(r, kmCfg, &promSpec.CredentialsSecretName, &promStatus.CredentialsSecretName, "")
+	StringReflectSpec(r, kmCfg, &promSpec.ClientCertSecretName, &promStatus.ClientCertSecretName, "")
+	StringReflectSpec(r, kmCfg, &promSpec.CABundleConfigMapName, &promStatus.CABundleConfigMapName, "")
+
+	kmCfg.Status.Packaging.AggregationLevel = kmCfg.Spec.Packaging.AggregationLevel
+	if kmCfg.Status.Packaging.AggregationLevel == "" {
+		kmCfg.Status.Packaging.AggregationLevel = kokumetricscfgv1beta1.PodAggregationLevel
+	}
+	kmCfg.Status.ReportSchema = kmCfg.Spec.ReportSchema
+	if kmCfg.Status.ReportSchema == "" {
+		kmCfg.Status.ReportSchema = kokumetricscfgv1beta1.LegacyReportSchema
+	}
+	kmCfg.Status.MetricsSource = kmCfg.Spec.MetricsSource
+	if kmCfg.Status.MetricsSource == "" {
+		kmCfg.Status.MetricsSource = kokumetricscfgv1beta1.PrometheusMetricsSource
+	}
+	kmCfg.Status.CustomQueries = kmCfg.Spec.CustomQueries
+	kmCfg.Status.NamespaceFilter = kmCfg.Spec.NamespaceFilter
+	kmCfg.Status.LabelPolicy = kmCfg.Spec.LabelPolicy
+	kmCfg.Status.AnonymizeIdentifiers = kmCfg.Spec.AnonymizeIdentifiers
+	kmCfg.Status.MaxRowsInMemory = kmCfg.Spec.MaxRowsInMemory
 }
 
 // GetClientset returns a clientset based on rest.config
@@ -275,6 +321,142 @@ func GetAuthSecret(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.
 	return nil
 }
 
+// getPrometheusCredentials reads the Prometheus credentials from the secret named in the PrometheusSpec. It returns nil
+// when no secret is named, so that the service account token is used.
+func getPrometheusCredentials(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) (*collector.PrometheusCredentials, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("KokuMetricsConfig", "getPrometheusCredentials")
+
+	secretName := kmCfg.Spec.PrometheusConfig.CredentialsSecretName
+	if secretName == "" {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: kmCfg.Namespace, Name: secretName}, secret)
+	if err != nil {
+		switch {
+		case errors.IsNotFound(err):
+			log.Error(err, "prometheus credentials secret does not exist")
+		case errors.IsForbidden(err):
+			log.Error(err, "operator does not have permission to check prometheus credentials secret")
+		default:
+			log.Error(err, "could not check prometheus credentials secret")
+		}
+		return nil, err
+	}
+
+	keys := make(map[string]string)
+	for k, v := range secret.Data {
+		keys[strings.ToLower(k)] = string(v)
+	}
+
+	if token := keys[promSecretTokenKey]; len(token) > 0 {
+		return &collector.PrometheusCredentials{BearerToken: token}, nil
+	}
+	for _, k := range []string{authSecretUserKey, authSecretPasswordKey} {
+		if len(keys[k]) <= 0 {
+			msg := fmt.Sprintf("secret not found with expected %s or %s data", promSecretTokenKey, k)
+			log.Info(msg)
+			return nil, fmt.Errorf(msg)
+		}
+	}
+	return &collector.PrometheusCredentials{
+		Username: keys[authSecretUserKey],
+		Password: keys[authSecretPasswordKey],
+	}, nil
+}
+
+// getPrometheusTLS reads the client certificate secret and the CA bundle configmap named in the PrometheusSpec. It
+// returns nil when neither is named, so that the service CA is used.
+func getPrometheusTLS(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) (*collector.PrometheusTLS, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("KokuMetricsConfig", "getPrometheusTLS")
+
+	promCfg := kmCfg.Spec.PrometheusConfig
+	if promCfg.ClientCertSecretName == "" && promCfg.CABundleConfigMapName == "" {
+		return nil, nil
+	}
+
+	tls := &collector.PrometheusTLS{}
+	if promCfg.ClientCertSecretName != "" {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: kmCfg.Namespace, Name: promCfg.ClientCertSecretName}, secret)
+		if err != nil {
+			log.Error(err, "could not get prometheus client certificate secret")
+			return nil, err
+		}
+		for _, k := range []string{promClientCertKey, promClientKeyKey} {
+			if len(secret.Data[k]) <= 0 {
+				msg := fmt.Sprintf("secret not found with expected %s data", k)
+				log.Info(msg)
+				return nil, fmt.Errorf(msg)
+			}
+		}
+		tls.ClientCert = secret.Data[promClientCertKey]
+		tls.ClientKey = secret.Data[promClientKeyKey]
+	}
+
+	if promCfg.CABundleConfigMapName != "" {
+		configMap := &corev1.ConfigMap{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: kmCfg.Namespace, Name: promCfg.CABundleConfigMapName}, configMap)
+		if err != nil {
+			log.Error(err, "could not get prometheus CA bundle configmap")
+			return nil, err
+		}
+		if len(configMap.Data[promCABundleKey]) <= 0 {
+			msg := fmt.Sprintf("configmap not found with expected %s data", promCABundleKey)
+			log.Info(msg)
+			return nil, fmt.Errorf(msg)
+		}
+		tls.CABundle = []byte(configMap.Data[promCABundleKey])
+	}
+
+	return tls, nil
+}
+
+// getReportSalt returns the salt of the hashed report values. The salt secret is created in the operator namespace on
+// first use. It is not owned by the KokuMetricsConfig, so that the hashes do not change when the CR is recreated.
+func getReportSalt(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) ([]byte, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("KokuMetricsConfig", "getReportSalt")
+
+	policy := kmCfg.Spec.LabelPolicy
+	hashLabels := policy.Redaction == kokumetricscfgv1beta1.HashLabelRedaction && (len(policy.Allow) > 0 || len(policy.Deny) > 0)
+	anonymize := kmCfg.Spec.AnonymizeIdentifiers != nil && *kmCfg.Spec.AnonymizeIdentifiers
+	if !hashLabels && !anonymize {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: kmCfg.Namespace, Name: reportSaltSecretName}, secret)
+	if err == nil {
+		if len(secret.Data[reportSaltKey]) <= 0 {
+			return nil, fmt.Errorf("secret not found with expected %s data", reportSaltKey)
+		}
+		return secret.Data[reportSaltKey], nil
+	}
+	if !errors.IsNotFound(err) {
+		log.Error(err, "could not check report salt secret")
+		return nil, err
+	}
+
+	salt := make([]byte, reportSaltBytes)
+	if _, err := cryptorand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate report salt: %v", err)
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: reportSaltSecretName, Namespace: kmCfg.Namespace},
+		Data:       map[string][]byte{reportSaltKey: salt},
+	}
+	if err := r.Create(ctx, secret); err != nil {
+		log.Error(err, "could not create report salt secret")
+		return nil, err
+	}
+	log.Info("created report salt secret", "name", reportSaltSecretName)
+	return salt, nil
+}
+
 func checkCycle(logger logr.Logger, cycle int64, lastExecution metav1.Time, action string) bool {
 	log := logger.WithValues("KokuMetricsConfig", "checkCycle")
 	if lastExecution.IsZero() {
@@ -490,8 +672,104 @@ func uploadFiles(r *KokuMetricsConfigReconciler, authConfig *crhchttp.AuthConfig
 	return nil
 }
 
-func collectPromStats(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, dirCfg *dirconfig.DirectoryConfig) {
-	log := r.Log.WithValues("KokuMetricsConfig", "collectPromStats")
+// getQueryStep returns the resolution of the collected samples.
+func getQueryStep(kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) time.Duration {
+	if kmCfg.Spec.PrometheusConfig.QueryStepSeconds != nil {
+		return time.Duration(*kmCfg.Spec.PrometheusConfig.QueryStepSeconds) * time.Second
+	}
+	return time.Duration(kokumetricscfgv1beta1.DefaultQueryStep) * time.Second
+}
+
+// getTimeRanges returns the interval ranges, oldest first, that have not been collected. An interval is only collected
+// once it has ended for the settle delay. When there is a new interval, the intervals of the re-collect hours before it
+// are collected again. Intervals older than the backfill limit are skipped. If the interval length was changed, the
+// first range ends at the next interval boundary.
+func getTimeRanges(kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, now time.Time) []promv1.Range {
+	interval := time.Duration(kokumetricscfgv1beta1.DefaultCollectionInterval) * time.Minute
+	if kmCfg.Spec.PrometheusConfig.CollectionIntervalMinutes != nil {
+		interval = time.Duration(*kmCfg.Spec.PrometheusConfig.CollectionIntervalMinutes) * time.Minute
+	}
+	settleDelay := kokumetricscfgv1beta1.DefaultSettleDelay
+	if kmCfg.Spec.PrometheusConfig.SettleDelayMinutes != nil {
+		settleDelay = *kmCfg.Spec.PrometheusConfig.SettleDelayMinutes
+	}
+	step := getQueryStep(kmCfg)
+	currentInterval := now.UTC().Add(-time.Duration(settleDelay) * time.Minute).Truncate(interval)
+
+	start := kmCfg.Status.Prometheus.CollectedThrough.UTC()
+	if kmCfg.Status.Prometheus.CollectedThrough.IsZero() {
+		if kmCfg.Status.Prometheus.LastQuerySuccessTime.IsZero() {
+			start = currentInterval.Add(-interval)
+		} else {
+			// the previous interval was collected at the time of the last successful query
+			start = kmCfg.Status.Prometheus.LastQuerySuccessTime.UTC().Truncate(interval)
+		}
+	}
+	if !start.Before(currentInterval) {
+		return nil
+	}
+
+	recollect := kokumetricscfgv1beta1.DefaultRecollectHours
+	if kmCfg.Spec.PrometheusConfig.RecollectHours != nil {
+		recollect = *kmCfg.Spec.PrometheusConfig.RecollectHours
+	}
+	if recollect > 0 && !kmCfg.Status.Prometheus.CollectedThrough.IsZero() {
+		start = start.Add(-time.Duration(recollect) * time.Hour).Truncate(interval)
+	}
+
+	maxBackfill := kokumetricscfgv1beta1.DefaultMaxBackfillHours
+	if kmCfg.Spec.PrometheusConfig.MaxBackfillHours != nil {
+		maxBackfill = *kmCfg.Spec.PrometheusConfig.MaxBackfillHours
+	}
+	if limit := currentInterval.Add(-time.Duration(maxBackfill) * time.Hour); start.Before(limit) {
+		start = limit
+	}
+	// the kubelet source only keeps its samples for the retention, so older intervals are left out instead of being
+	// collected without samples
+	if kmCfg.Spec.MetricsSource == kokumetricscfgv1beta1.KubeletMetricsSource {
+		retained := now.UTC().Add(-collector.KubeletRetention)
+		limit := retained.Truncate(interval)
+		if limit.Before(retained) {
+			limit = limit.Add(interval)
+		}
+		if start.Before(limit) {
+			start = limit
+		}
+	}
+
+	var timeRanges []promv1.Range
+	for t := start; t.Before(currentInterval); {
+		end := t.Truncate(interval).Add(interval)
+		timeRanges = append(timeRanges, promv1.Range{
+			Start: t,
+			End:   end.Add(-time.Second),
+			Step:  step,
+		})
+		t = end
+	}
+	return timeRanges
+}
+
+// getMetricsSource returns the configured metrics source. The kubelet source samples between reconciles, so it is only
+// restarted when the sample interval changes.
+func getMetricsSource(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) (collector.MetricsSource, error) {
+	if kmCfg.Spec.MetricsSource == kokumetricscfgv1beta1.KubeletMetricsSource {
+		interval := getQueryStep(kmCfg)
+		if r.kubeletCollector != nil && r.kubeletCollector.SampleInterval != interval {
+			r.kubeletCollector.Stop()
+			r.kubeletCollector = nil
+		}
+		if r.kubeletCollector == nil {
+			r.kubeletCollector = collector.NewKubeletCollector(r.Clientset, r.Log, interval)
+			r.kubeletCollector.Start()
+		}
+		return r.kubeletCollector, nil
+	}
+	if r.kubeletCollector != nil {
+		r.kubeletCollector.Stop()
+		r.kubeletCollector = nil
+	}
+
 	if r.promCollector == nil {
 		r.promCollector = &collector.PromCollector{
 			Log:       r.Log,
@@ -499,34 +777,104 @@ func collectPromStats(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1bet
 		}
 	}
 	r.promCollector.TimeSeries = nil
+	r.promCollector.Parallelism = int(kokumetricscfgv1beta1.DefaultQueryParallelism)
+	if kmCfg.Spec.PrometheusConfig.QueryParallelism != nil {
+		r.promCollector.Parallelism = int(*kmCfg.Spec.PrometheusConfig.QueryParallelism)
+	}
+	r.promCollector.QueryMode = kmCfg.Spec.PrometheusConfig.QueryMode
+
+	creds, err := getPrometheusCredentials(r, kmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prometheus credentials: %v", err)
+	}
+	r.promCollector.Credentials = creds
+
+	tls, err := getPrometheusTLS(r, kmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prometheus tls configuration: %v", err)
+	}
+	r.promCollector.TLS = tls
 
 	if err := r.promCollector.GetPromConn(kmCfg); err != nil {
-		log.Error(err, "failed to get prometheus connection")
-		return
+		return nil, fmt.Errorf("failed to get prometheus connection: %v", err)
 	}
-	timeUTC := metav1.Now().UTC()
-	t := metav1.Time{Time: timeUTC}
-	timeRange := promv1.Range{
-		Start: time.Date(t.Year(), t.Month(), t.Day(), t.Hour()-1, 0, 0, 0, t.Location()),
-		End:   time.Date(t.Year(), t.Month(), t.Day(), t.Hour()-1, 59, 59, 0, t.Location()),
-		Step:  time.Minute,
+	return r.promCollector, nil
+}
+
+func collectPromStats(r *KokuMetricsConfigReconciler, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig, dirCfg *dirconfig.DirectoryConfig) {
+	ctx := context.Background()
+	log := r.Log.WithValues("KokuMetricsConfig", "collectPromStats")
+	// the rows replaced by re-collected rows are removed from the reports once, after every interval is written
+	defer func() {
+		removed, err := collector.RemoveReplacedRows(dirCfg.Reports.Path)
+		if err != nil {
+			kmCfg.Status.Reports.DataCollected = false
+			kmCfg.Status.Reports.DataCollectionMessage = fmt.Sprintf("error: %v", err)
+			log.Error(err, "failed to remove replaced rows")
+		} else if removed > 0 {
+			log.Info("removed rows replaced by re-collected rows", "rows", removed)
+		}
+	}()
+	source, err := getMetricsSource(r, kmCfg)
+	if err != nil {
+		log.Error(err, "failed to get metrics source")
+		return
 	}
-	r.promCollector.TimeSeries = &timeRange
 
-	if kmCfg.Status.Prometheus.LastQuerySuccessTime.UTC().Format(promCompareFormat) == t.Format(promCompareFormat) {
-		log.Info("reports already generated for range", "start", timeRange.Start, "end", timeRange.End)
+	t := metav1.Now()
+	timeRanges := getTimeRanges(kmCfg, t.Time)
+	if len(timeRanges) <= 0 {
+		log.Info("reports already generated for range", "through", kmCfg.Status.Prometheus.CollectedThrough)
 		return
 	}
-	kmCfg.Status.Prometheus.LastQueryStartTime = t
-	log.Info("generating reports for range", "start", timeRange.Start, "end", timeRange.End)
-	if err := collector.GenerateReports(kmCfg, dirCfg, r.promCollector); err != nil {
+	collectedThrough := kmCfg.Status.Prometheus.CollectedThrough.Time
+	recollected := 0
+	for _, timeRange := range timeRanges {
+		if timeRange.Start.Before(collectedThrough) {
+			recollected++
+		}
+	}
+	if recollected > 0 {
+		log.Info(fmt.Sprintf("re-collecting %d intervals", recollected), "start", timeRanges[0].Start)
+	}
+	if missed := len(timeRanges) - recollected; missed > 1 {
+		log.Info(fmt.Sprintf("collecting %d missed intervals", missed), "start", timeRanges[recollected].Start)
+	}
+
+	salt, err := getReportSalt(r, kmCfg)
+	if err != nil {
 		kmCfg.Status.Reports.DataCollected = false
 		kmCfg.Status.Reports.DataCollectionMessage = fmt.Sprintf("error: %v", err)
-		log.Error(err, "failed to generate reports")
+		log.Error(err, "failed to get report salt")
 		return
 	}
-	log.Info("reports generated for range", "start", timeRange.Start, "end", timeRange.End)
-	kmCfg.Status.Prometheus.LastQuerySuccessTime = t
+
+	kmCfg.Status.Prometheus.LastQueryStartTime = t
+	for i, timeRange := range timeRanges {
+		timeRange := timeRange
+		source.SetTimeSeries(&timeRange)
+
+		log.Info("generating reports for range", "start", timeRange.Start, "end", timeRange.End)
+		if err := collector.GenerateReports(kmCfg, dirCfg, source, salt); err != nil {
+			kmCfg.Status.Reports.DataCollected = false
+			kmCfg.Status.Reports.DataCollectionMessage = fmt.Sprintf("error: %v", err)
+			log.Error(err, "failed to generate reports")
+			return
+		}
+		log.Info("reports generated for range", "start", timeRange.Start, "end", timeRange.End)
+		kmCfg.Status.Prometheus.LastQuerySuccessTime = metav1.Now()
+		// re-collected intervals do not move the progress back
+		if through := timeRange.End.Add(time.Second); through.After(kmCfg.Status.Prometheus.CollectedThrough.Time) {
+			kmCfg.Status.Prometheus.CollectedThrough = metav1.NewTime(through)
+		}
+
+		// checkpoint the progress so that a restart resumes the backfill from here
+		if i < len(timeRanges)-1 {
+			if err := r.Status().Update(ctx, kmCfg); err != nil {
+				log.Error(err, "failed to update KokuMetricsConfig status")
+			}
+		}
+	}
 }
 
 func configurePVC(r *KokuMetricsConfigReconciler, req ctrl.Request, kmCfg *kokumetricscfgv1beta1.KokuMetricsConfig) (*ctrl.Result, error) {
@@ -578,6 +926,8 @@ func configurePVC(r *KokuMetricsConfigReconciler, req ctrl.Request, kmCfg *kokum
 // +kubebuilder:rbac:groups=config.openshift.io,resources=clusterversions,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get
+// +kubebuilder:rbac:groups=core,resources=nodes;nodes/proxy;pods;persistentvolumes;persistentvolumeclaims,verbs=get;list
+// +kubebuilder:rbac:groups=metrics.k8s.io,resources=pods,verbs=get;list
 // +kubebuilder:rbac:groups=core,namespace=koku-metrics-operator,resources=pods;services;services/finalizers;endpoints;persistentvolumeclaims;events;configmaps;secrets;serviceaccounts,verbs=create;delete;get;list;patch;update;watch
 // +kubebuilder:rbac:groups=apps,namespace=koku-metrics-operator,resources=deployments,verbs=get;list;patch;watch
 
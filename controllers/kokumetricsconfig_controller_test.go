@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -19,13 +20,17 @@ import (
 	. "github.com/onsi/gomega"
 
 	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/collector"
 	"github.com/project-koku/koku-metrics-operator/storage"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
 var (
@@ -227,6 +232,321 @@ func TestConcatErrors(t *testing.T) {
 	}
 }
 
+func TestReflectSpec(t *testing.T) {
+	backfill, parallelism, interval, step, settle, recollect, maxRows := int64(12), int64(8), int64(15), int64(30), int64(10), int64(2), int64(1000)
+	customQueries := []kokumetricscfgv1beta1.CustomQuerySetSpec{{
+		Name:    "app",
+		Queries: []kokumetricscfgv1beta1.CustomQuerySpec{{Name: "requests", Query: "app_requests", RowKey: []string{"service"}}},
+	}}
+	namespaceFilter := kokumetricscfgv1beta1.NamespaceFilterSpec{Exclude: []string{"openshift-.*"}}
+	labelPolicy := kokumetricscfgv1beta1.LabelPolicySpec{Deny: []string{"owner"}, Redaction: kokumetricscfgv1beta1.HashLabelRedaction}
+	// the status fields in the order of the vals of the test cases
+	fields := []string{
+		"api_url", "service_address", "query_mode", "remote_read_address",
+		"max_backfill_hours", "query_parallelism", "collection_interval_minutes", "query_step_seconds",
+		"settle_delay_minutes", "recollect_hours", "headers", "query_parameters",
+		"credentials_secret_name", "client_cert_secret_name", "ca_bundle_configmap_name",
+		"aggregation_level", "report_schema", "metrics_source", "custom_queries", "namespace_filter", "label_policy",
+		"anonymize_identifiers", "max_rows_in_memory",
+	}
+	reflectSpecTests := []struct {
+		name string
+		spec kokumetricscfgv1beta1.KokuMetricsConfigSpec
+		vals []interface{}
+	}{
+		{
+			name: "defaults",
+			spec: kokumetricscfgv1beta1.KokuMetricsConfigSpec{},
+			vals: []interface{}{
+				kokumetricscfgv1beta1.DefaultAPIURL,
+				kokumetricscfgv1beta1.DefaultPrometheusSvcAddress,
+				kokumetricscfgv1beta1.RangeQueryMode,
+				kokumetricscfgv1beta1.DefaultPrometheusSvcAddress + "/api/v1/read",
+				(*int64)(nil), (*int64)(nil), (*int64)(nil), (*int64)(nil), (*int64)(nil), (*int64)(nil),
+				map[string]string(nil), map[string]string(nil),
+				"", "", "",
+				kokumetricscfgv1beta1.PodAggregationLevel,
+				kokumetricscfgv1beta1.LegacyReportSchema,
+				kokumetricscfgv1beta1.PrometheusMetricsSource,
+				[]kokumetricscfgv1beta1.CustomQuerySetSpec(nil),
+				kokumetricscfgv1beta1.NamespaceFilterSpec{},
+				kokumetricscfgv1beta1.LabelPolicySpec{},
+				(*bool)(nil), (*int64)(nil),
+			},
+		},
+		{
+			name: "every field set",
+			spec: kokumetricscfgv1beta1.KokuMetricsConfigSpec{
+				APIURL: "https://api.example.com",
+				PrometheusConfig: kokumetricscfgv1beta1.PrometheusSpec{
+					SvcAddress:                "https://prometheus.example.com",
+					MaxBackfillHours:          &backfill,
+					QueryParallelism:          &parallelism,
+					QueryMode:                 kokumetricscfgv1beta1.RemoteReadQueryMode,
+					RemoteReadAddress:         "https://prometheus.example.com/read",
+					CollectionIntervalMinutes: &interval,
+					QueryStepSeconds:          &step,
+					SettleDelayMinutes:        &settle,
+					RecollectHours:            &recollect,
+					Headers:                   map[string]string{"X-Scope-OrgID": "tenant"},
+					QueryParameters:           map[string]string{"namespace": "koku"},
+					CredentialsSecretName:     "prometheus-credentials",
+					ClientCertSecretName:      "prometheus-client-cert",
+					CABundleConfigMapName:     "prometheus-ca",
+				},
+				Packaging:            kokumetricscfgv1beta1.PackagingSpec{AggregationLevel: kokumetricscfgv1beta1.NamespaceAggregationLevel},
+				ReportSchema:         kokumetricscfgv1beta1.StandaloneNodeReportSchema,
+				MetricsSource:        kokumetricscfgv1beta1.KubeletMetricsSource,
+				CustomQueries:        customQueries,
+				NamespaceFilter:      namespaceFilter,
+				LabelPolicy:          labelPolicy,
+				AnonymizeIdentifiers: &trueValue,
+				MaxRowsInMemory:      &maxRows,
+			},
+			vals: []interface{}{
+				"https://api.example.com",
+				"https://prometheus.example.com",
+				kokumetricscfgv1beta1.RemoteReadQueryMode,
+				"https://prometheus.example.com/read",
+				&backfill, &parallelism, &interval, &step, &settle, &recollect,
+				map[string]string{"X-Scope-OrgID": "tenant"}, map[string]string{"namespace": "koku"},
+				"prometheus-credentials", "prometheus-client-cert", "prometheus-ca",
+				kokumetricscfgv1beta1.NamespaceAggregationLevel,
+				kokumetricscfgv1beta1.StandaloneNodeReportSchema,
+				kokumetricscfgv1beta1.KubeletMetricsSource,
+				customQueries,
+				namespaceFilter,
+				labelPolicy,
+				&trueValue, &maxRows,
+			},
+		},
+	}
+	for _, tt := range reflectSpecTests {
+		t.Run(tt.name, func(t *testing.T) {
+			kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{Spec: tt.spec}
+			ReflectSpec(&KokuMetricsConfigReconciler{}, kmCfg)
+			status := kmCfg.Status
+			got := []interface{}{
+				status.APIURL,
+				status.Prometheus.SvcAddress,
+				status.Prometheus.QueryMode,
+				status.Prometheus.RemoteReadAddress,
+				status.Prometheus.MaxBackfillHours, status.Prometheus.QueryParallelism, status.Prometheus.CollectionIntervalMinutes,
+				status.Prometheus.QueryStepSeconds, status.Prometheus.SettleDelayMinutes, status.Prometheus.RecollectHours,
+				status.Prometheus.Headers, status.Prometheus.QueryParameters,
+				status.Prometheus.CredentialsSecretName, status.Prometheus.ClientCertSecretName, status.Prometheus.CABundleConfigMapName,
+				status.Packaging.AggregationLevel,
+				status.ReportSchema,
+				status.MetricsSource,
+				status.CustomQueries,
+				status.NamespaceFilter,
+				status.LabelPolicy,
+				status.AnonymizeIdentifiers, status.MaxRowsInMemory,
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i], tt.vals[i]) {
+					t.Errorf("%s status %s got %v want %v", tt.name, fields[i], got[i], tt.vals[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetTimeRanges(t *testing.T) {
+	now := time.Date(2021, 1, 15, 10, 23, 11, 0, time.UTC)
+	maxBackfill := int64(3)
+	quarterHour := int64(15)
+	halfMinute := int64(30)
+	settleDelay := int64(20)
+	longSettleDelay := int64(30)
+	recollect := int64(2)
+	getTimeRangesTests := []struct {
+		name          string
+		collected     time.Time
+		lastSuccess   time.Time
+		maxBackfill   *int64
+		interval      *int64
+		step          *int64
+		settleDelay   *int64
+		recollect     *int64
+		source        kokumetricscfgv1beta1.MetricsSourceType
+		wantStart     time.Time
+		wantNumRanges int
+		wantInterval  time.Duration
+		wantStep      time.Duration
+	}{
+		{
+			name:          "first collection",
+			wantStart:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+		},
+		{
+			name:          "previous hour already collected",
+			collected:     time.Date(2021, 1, 15, 10, 0, 0, 0, time.UTC),
+			wantNumRanges: 0,
+		},
+		{
+			name:          "missed hours are collected",
+			collected:     time.Date(2021, 1, 15, 6, 0, 0, 0, time.UTC),
+			wantStart:     time.Date(2021, 1, 15, 6, 0, 0, 0, time.UTC),
+			wantNumRanges: 4,
+		},
+		{
+			name:          "missed hours are limited by max backfill",
+			collected:     time.Date(2021, 1, 14, 6, 0, 0, 0, time.UTC),
+			maxBackfill:   &maxBackfill,
+			wantStart:     time.Date(2021, 1, 15, 7, 0, 0, 0, time.UTC),
+			wantNumRanges: 3,
+		},
+		{
+			name:          "missed hours are limited by default max backfill",
+			collected:     time.Date(2021, 1, 10, 6, 0, 0, 0, time.UTC),
+			wantStart:     time.Date(2021, 1, 14, 10, 0, 0, 0, time.UTC),
+			wantNumRanges: 24,
+		},
+		{
+			name:          "resume from last query success time",
+			lastSuccess:   time.Date(2021, 1, 15, 8, 5, 0, 0, time.UTC),
+			wantStart:     time.Date(2021, 1, 15, 8, 0, 0, 0, time.UTC),
+			wantNumRanges: 2,
+		},
+		{
+			name:          "quarter hour intervals",
+			collected:     time.Date(2021, 1, 15, 9, 30, 0, 0, time.UTC),
+			interval:      &quarterHour,
+			wantStart:     time.Date(2021, 1, 15, 9, 30, 0, 0, time.UTC),
+			wantNumRanges: 3,
+			wantInterval:  15 * time.Minute,
+		},
+		{
+			name:          "first collection with quarter hour intervals",
+			interval:      &quarterHour,
+			wantStart:     time.Date(2021, 1, 15, 10, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+			wantInterval:  15 * time.Minute,
+		},
+		{
+			name:          "interval changed from quarter hour to hour",
+			collected:     time.Date(2021, 1, 15, 8, 45, 0, 0, time.UTC),
+			wantStart:     time.Date(2021, 1, 15, 8, 45, 0, 0, time.UTC),
+			wantNumRanges: 2,
+		},
+		{
+			name:          "half minute step",
+			collected:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			step:          &halfMinute,
+			wantStart:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+			wantStep:      30 * time.Second,
+		},
+		{
+			name:          "previous hour has settled",
+			collected:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			settleDelay:   &settleDelay,
+			wantStart:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+		},
+		{
+			name:          "previous hour has not settled",
+			collected:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			settleDelay:   &longSettleDelay,
+			wantNumRanges: 0,
+		},
+		{
+			name:          "recent hours are re-collected with the new hour",
+			collected:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			recollect:     &recollect,
+			wantStart:     time.Date(2021, 1, 15, 7, 0, 0, 0, time.UTC),
+			wantNumRanges: 3,
+		},
+		{
+			name:          "recent hours are not re-collected without a new hour",
+			collected:     time.Date(2021, 1, 15, 10, 0, 0, 0, time.UTC),
+			recollect:     &recollect,
+			wantNumRanges: 0,
+		},
+		{
+			name:          "recent hours are not re-collected by the first collection",
+			recollect:     &recollect,
+			wantStart:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+		},
+		{
+			name:          "re-collected hours are limited by max backfill",
+			collected:     time.Date(2021, 1, 15, 8, 0, 0, 0, time.UTC),
+			maxBackfill:   &maxBackfill,
+			recollect:     &maxBackfill,
+			wantStart:     time.Date(2021, 1, 15, 7, 0, 0, 0, time.UTC),
+			wantNumRanges: 3,
+		},
+		{
+			name:          "re-collected quarter hour intervals",
+			collected:     time.Date(2021, 1, 15, 10, 0, 0, 0, time.UTC),
+			interval:      &quarterHour,
+			recollect:     &recollect,
+			wantStart:     time.Date(2021, 1, 15, 8, 0, 0, 0, time.UTC),
+			wantNumRanges: 9,
+			wantInterval:  15 * time.Minute,
+		},
+		{
+			name:          "kubelet source backfill is limited to the retention",
+			collected:     time.Date(2021, 1, 15, 6, 0, 0, 0, time.UTC),
+			source:        kokumetricscfgv1beta1.KubeletMetricsSource,
+			wantStart:     time.Date(2021, 1, 15, 9, 0, 0, 0, time.UTC),
+			wantNumRanges: 1,
+		},
+		{
+			name:          "kubelet source re-collection is limited to the retention",
+			collected:     time.Date(2021, 1, 15, 9, 30, 0, 0, time.UTC),
+			interval:      &quarterHour,
+			recollect:     &recollect,
+			source:        kokumetricscfgv1beta1.KubeletMetricsSource,
+			wantStart:     time.Date(2021, 1, 15, 8, 30, 0, 0, time.UTC),
+			wantNumRanges: 7,
+			wantInterval:  15 * time.Minute,
+		},
+	}
+	for _, tt := range getTimeRangesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+			kmCfg.Spec.MetricsSource = tt.source
+			kmCfg.Spec.PrometheusConfig.MaxBackfillHours = tt.maxBackfill
+			kmCfg.Spec.PrometheusConfig.CollectionIntervalMinutes = tt.interval
+			kmCfg.Spec.PrometheusConfig.QueryStepSeconds = tt.step
+			kmCfg.Spec.PrometheusConfig.SettleDelayMinutes = tt.settleDelay
+			kmCfg.Spec.PrometheusConfig.RecollectHours = tt.recollect
+			kmCfg.Status.Prometheus.CollectedThrough = metav1.NewTime(tt.collected)
+			kmCfg.Status.Prometheus.LastQuerySuccessTime = metav1.NewTime(tt.lastSuccess)
+			got := getTimeRanges(kmCfg, now)
+			if len(got) != tt.wantNumRanges {
+				t.Fatalf("%s got %d ranges want %d", tt.name, len(got), tt.wantNumRanges)
+			}
+			wantInterval, wantStep := time.Hour, time.Minute
+			if tt.wantInterval != 0 {
+				wantInterval = tt.wantInterval
+			}
+			if tt.wantStep != 0 {
+				wantStep = tt.wantStep
+			}
+			wantStart := tt.wantStart
+			for i, r := range got {
+				if !r.Start.Equal(wantStart) {
+					t.Errorf("%s range %d got start %s want %s", tt.name, i, r.Start, wantStart)
+				}
+				// every range ends at an interval boundary, which realigns ranges after an interval change
+				wantEnd := wantStart.Truncate(wantInterval).Add(wantInterval - time.Second)
+				if !r.End.Equal(wantEnd) {
+					t.Errorf("%s range %d got end %s want %s", tt.name, i, r.End, wantEnd)
+				}
+				if r.Step != wantStep {
+					t.Errorf("%s range %d got step %s want %s", tt.name, i, r.Step, wantStep)
+				}
+				wantStart = wantEnd.Add(time.Second)
+			}
+		})
+	}
+}
+
 func setup() error {
 	type dirInfo struct {
 		dirName  string
@@ -987,3 +1307,138 @@ var _ = Describe("KokuMetricsConfigController - CRD Handling", func() {
 		})
 	})
 })
+
+func TestGetPrometheusCredentials(t *testing.T) {
+	secrets := []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-token", Namespace: namespace},
+			Data:       map[string][]byte{"Token": []byte("tenant-token")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-basic", Namespace: namespace},
+			Data:       map[string][]byte{"username": []byte("user1"), "password": []byte("password1")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-user-only", Namespace: namespace},
+			Data:       map[string][]byte{"username": []byte("user1")},
+		},
+	}
+	r := &KokuMetricsConfigReconciler{Client: fake.NewFakeClient(secrets...), Log: zap.New()}
+	getCredentialsTests := []struct {
+		name       string
+		secretName string
+		want       *collector.PrometheusCredentials
+		wantErr    bool
+	}{
+		{name: "no secret", secretName: "", want: nil},
+		{name: "token", secretName: "prom-token", want: &collector.PrometheusCredentials{BearerToken: "tenant-token"}},
+		{name: "basic auth", secretName: "prom-basic", want: &collector.PrometheusCredentials{Username: "user1", Password: "password1"}},
+		{name: "missing password", secretName: "prom-user-only", wantErr: true},
+		{name: "missing secret", secretName: "does-not-exist", wantErr: true},
+	}
+	for _, tt := range getCredentialsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}
+			kmCfg.Spec.PrometheusConfig.CredentialsSecretName = tt.secretName
+			got, err := getPrometheusCredentials(r, kmCfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s got error %v, wanted error %t", tt.name, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got %+v want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPrometheusTLS(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-client", Namespace: namespace},
+			Data:       map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-client-no-key", Namespace: namespace},
+			Data:       map[string][]byte{"tls.crt": []byte("cert")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-ca", Namespace: namespace},
+			Data:       map[string]string{"ca-bundle.crt": "ca"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "prom-ca-empty", Namespace: namespace},
+		},
+	}
+	r := &KokuMetricsConfigReconciler{Client: fake.NewFakeClient(objects...), Log: zap.New()}
+	getTLSTests := []struct {
+		name      string
+		secret    string
+		configMap string
+		want      *collector.PrometheusTLS
+		wantErr   bool
+	}{
+		{name: "nothing configured", want: nil},
+		{name: "client certificate", secret: "prom-client", want: &collector.PrometheusTLS{ClientCert: []byte("cert"), ClientKey: []byte("key")}},
+		{name: "ca bundle", configMap: "prom-ca", want: &collector.PrometheusTLS{CABundle: []byte("ca")}},
+		{
+			name:      "client certificate and ca bundle",
+			secret:    "prom-client",
+			configMap: "prom-ca",
+			want:      &collector.PrometheusTLS{CABundle: []byte("ca"), ClientCert: []byte("cert"), ClientKey: []byte("key")},
+		},
+		{name: "missing key", secret: "prom-client-no-key", wantErr: true},
+		{name: "missing ca bundle", configMap: "prom-ca-empty", wantErr: true},
+		{name: "missing configmap", configMap: "does-not-exist", wantErr: true},
+	}
+	for _, tt := range getTLSTests {
+		t.Run(tt.name, func(t *testing.T) {
+			kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}
+			kmCfg.Spec.PrometheusConfig.ClientCertSecretName = tt.secret
+			kmCfg.Spec.PrometheusConfig.CABundleConfigMapName = tt.configMap
+			got, err := getPrometheusTLS(r, kmCfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s got error %v, wanted error %t", tt.name, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s got %+v want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetReportSalt(t *testing.T) {
+	r := &KokuMetricsConfigReconciler{Client: fake.NewFakeClient(), Log: zap.New()}
+	kmCfg := &kokumetricscfgv1beta1.KokuMetricsConfig{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}
+
+	kmCfg.Spec.LabelPolicy.Deny = []string{"customer_.*"}
+	salt, err := getReportSalt(r, kmCfg)
+	if err != nil || salt != nil {
+		t.Fatalf("drop redaction got salt %v and error %v, want neither", salt, err)
+	}
+
+	kmCfg.Spec.LabelPolicy.Redaction = kokumetricscfgv1beta1.HashLabelRedaction
+	salt, err = getReportSalt(r, kmCfg)
+	if err != nil {
+		t.Fatalf("getReportSalt got unexpected error: %v", err)
+	}
+	if len(salt) != reportSaltBytes {
+		t.Errorf("getReportSalt got %d bytes want %d", len(salt), reportSaltBytes)
+	}
+	again, err := getReportSalt(r, kmCfg)
+	if err != nil {
+		t.Fatalf("getReportSalt got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(salt, again) {
+		t.Errorf("getReportSalt did not reuse the salt secret")
+	}
+
+	kmCfg.Spec.LabelPolicy = kokumetricscfgv1beta1.LabelPolicySpec{}
+	kmCfg.Spec.AnonymizeIdentifiers = &trueDef
+	again, err = getReportSalt(r, kmCfg)
+	if err != nil {
+		t.Fatalf("getReportSalt got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(salt, again) {
+		t.Errorf("anonymization did not use the same salt as the label redaction")
+	}
+}
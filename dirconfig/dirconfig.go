@@ -22,6 +22,10 @@ var (
 	uploadDir    = "upload"
 )
 
+// CorrectionsFile is created in the reports directory when an interval that was already packaged is collected again.
+// The next package declares the corrections in its manifest and removes the file.
+const CorrectionsFile = ".corrections"
+
 type DirListFunc = func(path string) ([]os.FileInfo, error)
 type RemoveAllFunc = func(path string) error
 type StatFunc = func(path string) (os.FileInfo, error)
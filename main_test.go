@@ -0,0 +1,35 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The test binary runs the init functions of main and every package it imports, so a collector that is registered
+// twice panics before this test runs.
+func TestMetricsRegistry(t *testing.T) {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	found := map[string]bool{}
+	for _, f := range families {
+		found[f.GetName()] = true
+	}
+	for _, name := range []string{
+		"go_memstats_heap_inuse_bytes",
+		"process_resident_memory_bytes",
+		"koku_metrics_operator_report_peak_heap_inuse_bytes",
+		"koku_metrics_operator_report_spilled_rows_total",
+	} {
+		if !found[name] {
+			t.Errorf("metric %s is not exposed on the metrics endpoint", name)
+		}
+	}
+}
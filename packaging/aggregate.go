@@ -0,0 +1,266 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package packaging
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// dateColumns are part of the group of every rolled up report.
+	dateColumns = []string{"report_period_start", "report_period_end", "interval_start", "interval_end"}
+
+	// namespaceReports are the reports without pod details, which are packaged as they are at namespace level.
+	namespaceReports = []string{
+		"cm-openshift-node-usage-",
+		"cm-openshift-namespace-usage-",
+		"cm-openshift-resourcequota-usage-",
+		"cm-openshift-limitrange-usage-",
+	}
+
+	reportDateRegex = regexp.MustCompile(`^[0-9]{6}\.csv$`)
+)
+
+// isReport reports whether the file is the monthly report with the prefix, which is named <prefix>YYYYMM.csv. Custom
+// reports whose name starts with the name of a built-in report do not match it.
+func isReport(fileName, prefix string) bool {
+	date := strings.TrimPrefix(fileName, prefix)
+	return date != fileName && reportDateRegex.MatchString(date)
+}
+
+// rollup describes how a report is summed to namespace level. Rows are grouped by the date columns and the groupBy
+// columns, the sum columns are added up and the keep columns take the value of the first row of the group. Every other
+// column is left empty so that the report keeps its headers.
+type rollup struct {
+	prefix             string
+	groupBy, sum, keep []string
+}
+
+var rollups = []rollup{
+	{
+		prefix:  "cm-openshift-pod-usage-",
+		groupBy: []string{"node", "namespace"},
+		sum: []string{
+			"pod_usage_cpu_core_seconds",
+			"pod_request_cpu_core_seconds",
+			"pod_limit_cpu_core_seconds",
+			"pod_usage_memory_byte_seconds",
+			"pod_request_memory_byte_seconds",
+			"pod_limit_memory_byte_seconds",
+		},
+		keep: []string{
+			"node_capacity_cpu_cores",
+			"node_capacity_cpu_core_seconds",
+			"node_capacity_memory_bytes",
+			"node_capacity_memory_byte_seconds",
+			"resource_id",
+		},
+	},
+	{
+		prefix:  "cm-openshift-container-usage-",
+		groupBy: []string{"node", "namespace"},
+		sum: []string{
+			"container_usage_cpu_core_seconds",
+			"container_request_cpu_core_seconds",
+			"container_limit_cpu_core_seconds",
+			"container_usage_memory_byte_seconds",
+			"container_request_memory_byte_seconds",
+			"container_limit_memory_byte_seconds",
+		},
+	},
+	{
+		prefix:  "cm-openshift-extended-resource-usage-",
+		groupBy: []string{"node", "namespace", "resource", "unit"},
+		sum:     []string{"pod_request_resource_seconds", "pod_limit_resource_seconds"},
+		keep:    []string{"node_capacity_resource", "node_capacity_resource_seconds", "node_allocatable_resource_seconds"},
+	},
+	{
+		prefix:  "cm-openshift-network-usage-",
+		groupBy: []string{"node", "namespace"},
+		sum:     []string{"pod_network_receive_bytes", "pod_network_transmit_bytes"},
+	},
+	{
+		prefix:  "cm-openshift-storage-usage-",
+		groupBy: []string{"namespace", "storageclass"},
+		sum: []string{
+			"persistentvolumeclaim_capacity_bytes",
+			"persistentvolumeclaim_capacity_byte_seconds",
+			"volume_request_storage_byte_seconds",
+			"persistentvolumeclaim_usage_byte_seconds",
+		},
+	},
+}
+
+// rollupFor returns the rollup of the report, or nil when the report has none.
+func rollupFor(fileName string) *rollup {
+	for i := range rollups {
+		if isReport(fileName, rollups[i].prefix) {
+			return &rollups[i]
+		}
+	}
+	return nil
+}
+
+// isNamespaceReport reports whether the report is packaged as it is at namespace level.
+func isNamespaceReport(fileName string) bool {
+	for _, prefix := range namespaceReports {
+		if isReport(fileName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type rollupGroup struct {
+	row  []string
+	sums []float64
+}
+
+// aggregate rewrites the report in place with one row per group. Rolling up a report twice gives the same report.
+func (r *rollup) aggregate(filePath string) error {
+	in, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("aggregate: error opening file: %v", err)
+	}
+	defer in.Close()
+	csvReader := csv.NewReader(in)
+	csvHeader, err := csvReader.Read()
+	if err != nil {
+		return fmt.Errorf("aggregate: error reading file: %v", err)
+	}
+	index := func(columns []string) ([]int, error) {
+		var indexes []int
+		for _, column := range columns {
+			i, err := getIndex(csvHeader, column)
+			if err != nil {
+				return nil, fmt.Errorf("aggregate: %s is missing column %s", filepath.Base(filePath), column)
+			}
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	}
+	groupIdx, err := index(append(append([]string{}, dateColumns...), r.groupBy...))
+	if err != nil {
+		return err
+	}
+	sumIdx, err := index(r.sum)
+	if err != nil {
+		return err
+	}
+	keepIdx, err := index(r.keep)
+	if err != nil {
+		return err
+	}
+
+	var order []string
+	groups := map[string]*rollupGroup{}
+	for {
+		line, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("aggregate: error reading file: %v", err)
+		}
+		key := make([]string, len(groupIdx))
+		for i, idx := range groupIdx {
+			key[i] = line[idx]
+		}
+		k := strings.Join(key, ",")
+		g, ok := groups[k]
+		if !ok {
+			g = &rollupGroup{row: make([]string, len(csvHeader)), sums: make([]float64, len(sumIdx))}
+			for _, idx := range append(append([]int{}, groupIdx...), keepIdx...) {
+				g.row[idx] = line[idx]
+			}
+			groups[k] = g
+			order = append(order, k)
+		}
+		for i, idx := range sumIdx {
+			if line[idx] == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(line[idx], 64)
+			if err != nil {
+				return fmt.Errorf("aggregate: invalid %s value %q: %v", csvHeader[idx], line[idx], err)
+			}
+			g.sums[i] += v
+		}
+	}
+
+	tmpPath := filePath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("aggregate: error creating file: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	csvWriter := csv.NewWriter(out)
+	if err := csvWriter.Write(csvHeader); err != nil {
+		out.Close()
+		return fmt.Errorf("aggregate: error writing file: %v", err)
+	}
+	for _, k := range order {
+		g := groups[k]
+		for i, idx := range sumIdx {
+			g.row[idx] = strconv.FormatFloat(g.sums[i], 'f', 6, 64)
+		}
+		if err := csvWriter.Write(g.row); err != nil {
+			out.Close()
+			return fmt.Errorf("aggregate: error writing file: %v", err)
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		out.Close()
+		return fmt.Errorf("aggregate: error writing file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("aggregate: error closing file: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("aggregate: error replacing file: %v", err)
+	}
+	return nil
+}
+
+// aggregateFiles rolls the staged reports up to namespace level and returns the new file stats. Custom reports have no
+// rollup and may hold pod details, so they are removed instead of packaged.
+func (p *FilePackager) aggregateFiles(fileList []os.FileInfo) ([]os.FileInfo, error) {
+	log := p.Log.WithValues("kokumetricsconfig", "aggregateFiles")
+	var aggregated []os.FileInfo
+	for _, file := range fileList {
+		absPath := filepath.Join(p.DirCfg.Staging.Path, file.Name())
+		name := p.reportName(file.Name())
+		r := rollupFor(name)
+		if r == nil {
+			if isNamespaceReport(name) {
+				aggregated = append(aggregated, file)
+				continue
+			}
+			log.Info("dropping custom report without a namespace rollup", "file", file.Name())
+			if err := os.Remove(absPath); err != nil {
+				return nil, fmt.Errorf("aggregateFiles: failed to remove file: %v", err)
+			}
+			continue
+		}
+		log.Info("rolling report up to namespace level", "file", file.Name())
+		if err := r.aggregate(absPath); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(absPath)
+		if err != nil {
+			return nil, fmt.Errorf("aggregateFiles: failed to get file stats: %v", err)
+		}
+		aggregated = append(aggregated, info)
+	}
+	return aggregated, nil
+}
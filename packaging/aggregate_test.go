@@ -0,0 +1,218 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package packaging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kokumetricscfgv1beta1 "github.com/project-koku/koku-metrics-operator/api/v1beta1"
+	"github.com/project-koku/koku-metrics-operator/dirconfig"
+)
+
+const (
+	testDates  = "2021-01-01 00:00:00 +0000 UTC,2021-02-01 00:00:00 +0000 UTC,2021-01-05 18:00:00 +0000 UTC,2021-01-05 18:59:59 +0000 UTC"
+	testDates2 = "2021-01-01 00:00:00 +0000 UTC,2021-02-01 00:00:00 +0000 UTC,2021-01-05 19:00:00 +0000 UTC,2021-01-05 19:59:59 +0000 UTC"
+)
+
+var testPodHeader = "report_period_start,report_period_end,interval_start,interval_end,node,namespace,pod," +
+	"pod_usage_cpu_core_seconds,pod_request_cpu_core_seconds,pod_limit_cpu_core_seconds," +
+	"pod_usage_memory_byte_seconds,pod_request_memory_byte_seconds,pod_limit_memory_byte_seconds," +
+	"node_capacity_cpu_cores,node_capacity_cpu_core_seconds,node_capacity_memory_bytes,node_capacity_memory_byte_seconds," +
+	"resource_id,pod_labels"
+
+var testStorageHeader = "report_period_start,report_period_end,interval_start,interval_end,namespace,pod," +
+	"persistentvolumeclaim,persistentvolume,storageclass," +
+	"persistentvolumeclaim_capacity_bytes,persistentvolumeclaim_capacity_byte_seconds," +
+	"volume_request_storage_byte_seconds,persistentvolumeclaim_usage_byte_seconds," +
+	"persistentvolume_labels,persistentvolumeclaim_labels"
+
+func TestRollupAggregate(t *testing.T) {
+	aggregateTests := []struct {
+		name      string
+		fileName  string
+		lines     []string
+		want      []string
+		expectErr bool
+	}{
+		{
+			name:     "pod rows are summed per node, namespace and interval",
+			fileName: "cm-openshift-pod-usage-202101.csv",
+			lines: []string{
+				testPodHeader,
+				testDates + ",node-1,shop,web-1,1.5,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,label_app:web",
+				testDates + ",node-1,shop,web-2,2.5,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,label_app:web",
+				testDates + ",node-2,shop,web-3,1.000000,1.000000,,50.000000,50.000000,,8.000000,28800.000000,2048.000000,7372800.000000,i-2,",
+				testDates2 + ",node-1,shop,web-1,3.000000,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,label_app:web",
+			},
+			want: []string{
+				testPodHeader,
+				testDates + ",node-1,shop,,4.000000,4.000000,0.000000,200.000000,400.000000,0.000000,4.000000,14400.000000,1024.000000,3686400.000000,i-1,",
+				testDates + ",node-2,shop,,1.000000,1.000000,0.000000,50.000000,50.000000,0.000000,8.000000,28800.000000,2048.000000,7372800.000000,i-2,",
+				testDates2 + ",node-1,shop,,3.000000,2.000000,0.000000,100.000000,200.000000,0.000000,4.000000,14400.000000,1024.000000,3686400.000000,i-1,",
+			},
+		},
+		{
+			name:     "storage rows are summed per namespace, storage class and interval",
+			fileName: "cm-openshift-storage-usage-202101.csv",
+			lines: []string{
+				testStorageHeader,
+				testDates + ",shop,db-0,data-db-0,pv-1,gp2,10.000000,36000.000000,36000.000000,18000.000000,label_a:b,",
+				testDates + ",shop,db-1,data-db-1,pv-2,gp2,20.000000,72000.000000,72000.000000,9000.000000,,label_c:d",
+				testDates + ",shop,cache-0,data-cache-0,pv-3,io1,5.000000,18000.000000,18000.000000,,,",
+			},
+			want: []string{
+				testStorageHeader,
+				testDates + ",shop,,,,gp2,30.000000,108000.000000,108000.000000,27000.000000,,",
+				testDates + ",shop,,,,io1,5.000000,18000.000000,18000.000000,0.000000,,",
+			},
+		},
+		{
+			name:      "missing column",
+			fileName:  "cm-openshift-network-usage-202101.csv",
+			lines:     []string{"report_period_start,report_period_end,interval_start,interval_end,node,namespace,pod"},
+			expectErr: true,
+		},
+		{
+			name:     "invalid value",
+			fileName: "cm-openshift-network-usage-202101.csv",
+			lines: []string{
+				"report_period_start,report_period_end,interval_start,interval_end,node,namespace,pod,pod_network_receive_bytes,pod_network_transmit_bytes",
+				testDates + ",node-1,shop,web-1,many,1.000000",
+			},
+			expectErr: true,
+		},
+	}
+	for _, tt := range aggregateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "aggregate")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			filePath := filepath.Join(dir, tt.fileName)
+			if err := ioutil.WriteFile(filePath, []byte(strings.Join(tt.lines, "\n")+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write report: %v", err)
+			}
+			r := rollupFor(tt.fileName)
+			if r == nil {
+				t.Fatalf("%s has no rollup", tt.fileName)
+			}
+			err = r.aggregate(filePath)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("%s got error %v, expected error %t", tt.name, err, tt.expectErr)
+			}
+			if tt.expectErr {
+				return
+			}
+			want := strings.Join(tt.want, "\n") + "\n"
+			got, _ := ioutil.ReadFile(filePath)
+			if string(got) != want {
+				t.Errorf("%s got:\n%s\nwant:\n%s", tt.name, got, want)
+			}
+			// rolling up the report again does not change it
+			if err := r.aggregate(filePath); err != nil {
+				t.Fatalf("%s got unexpected error on second rollup: %v", tt.name, err)
+			}
+			if got, _ := ioutil.ReadFile(filePath); string(got) != want {
+				t.Errorf("%s second rollup got:\n%s\nwant:\n%s", tt.name, got, want)
+			}
+		})
+	}
+}
+
+func TestRollupFor(t *testing.T) {
+	for fileName, want := range map[string]bool{
+		"cm-openshift-pod-usage-202101.csv":                true,
+		"cm-openshift-container-usage-202101.csv":          true,
+		"cm-openshift-extended-resource-usage-202101.csv":  true,
+		"cm-openshift-network-usage-202101.csv":            true,
+		"cm-openshift-storage-usage-202101.csv":            true,
+		"cm-openshift-node-usage-202101.csv":               false,
+		"cm-openshift-namespace-usage-202101.csv":          false,
+		"cm-openshift-gpu-usage-202101.csv":                false,
+		"cm-openshift-pod-gpu-usage-202101.csv":            false,
+		"cm-openshift-pod-usage-x-usage-202101.csv":        false,
+		"cm-openshift-a-cm-openshift-pod-usage-202101.csv": false,
+	} {
+		if got := rollupFor(fileName) != nil; got != want {
+			t.Errorf("%s got rollup %t want %t", fileName, got, want)
+		}
+	}
+}
+
+func TestPackageReportsNamespaceAggregation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregation-level")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &dirconfig.DirectoryConfig{
+		Reports: dirconfig.Directory{Path: filepath.Join(dir, "data")},
+		Staging: dirconfig.Directory{Path: filepath.Join(dir, "staging")},
+		Upload:  dirconfig.Directory{Path: filepath.Join(dir, "upload")},
+	}
+	for _, d := range []string{cfg.Reports.Path, cfg.Staging.Path, cfg.Upload.Path} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	lines := []string{
+		testPodHeader,
+		testDates + ",node-1,shop,web-1,1.000000,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,label_app:web",
+		testDates + ",node-1,shop,web-2,1.000000,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,label_app:web",
+	}
+	podReport := "cm-openshift-pod-usage-202101.csv"
+	if err := ioutil.WriteFile(filepath.Join(cfg.Reports.Path, podReport), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	// a custom report has no rollup, so its pod names are not packaged
+	customReport := "cm-openshift-pod-gpu-usage-202101.csv"
+	custom := "report_period_start,report_period_end,interval_start,interval_end,namespace,pod,gpu\n" + testDates + ",shop,web-1,1.000000\n"
+	if err := ioutil.WriteFile(filepath.Join(cfg.Reports.Path, customReport), []byte(custom), 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+
+	maxSize := int64(100)
+	cr := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	cr.Spec.Packaging.AggregationLevel = kokumetricscfgv1beta1.NamespaceAggregationLevel
+	cr.Status.Packaging.MaxSize = &maxSize
+	p := FilePackager{KMCfg: cr, DirCfg: cfg, Log: testLogger}
+	if err := p.PackageReports(); err != nil {
+		t.Fatalf("PackageReports got unexpected error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.Staging.Path, p.uid+"-"+podReport))
+	if err != nil {
+		t.Fatalf("failed to read staged report: %v", err)
+	}
+	if rows := strings.Count(string(data), "\n") - 1; rows != 1 {
+		t.Errorf("staged pod report has %d rows, want 1:\n%s", rows, data)
+	}
+	manifestData, err := ioutil.ReadFile(p.manifest.filename)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var found manifest
+	if err := json.Unmarshal(manifestData, &found); err != nil {
+		t.Fatalf("failed to unmarshal manifest: %v", err)
+	}
+	if found.AggregationLevel != string(kokumetricscfgv1beta1.NamespaceAggregationLevel) {
+		t.Errorf("manifest aggregation level got %q want %q", found.AggregationLevel, kokumetricscfgv1beta1.NamespaceAggregationLevel)
+	}
+	for _, f := range found.Files {
+		if strings.Contains(f, customReport) {
+			t.Errorf("manifest lists the custom report %s", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Staging.Path, p.uid+"-"+customReport)); !os.IsNotExist(err) {
+		t.Errorf("the custom report was staged: %v", err)
+	}
+}
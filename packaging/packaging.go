@@ -40,6 +40,7 @@ type FilePackager struct {
 	maxBytes         int64
 	start            time.Time
 	end              time.Time
+	corrections      bool
 }
 
 const timestampFormat = "20060102T150405"
@@ -55,6 +56,9 @@ const megaByte int64 = 1024 * 1024
 // VARIANCE := 0.03
 const variance float64 = 0.03
 
+// podReportPrefix is the file prefix of the pod report, whose intervals are the start and end of the manifest.
+const podReportPrefix = "cm-openshift-pod-usage-"
+
 // if we're creating more than 1k files, something is probably wrong.
 var maxSplits int64 = 1000
 
@@ -73,6 +77,10 @@ type manifest struct {
 	Files     []string  `json:"files"`
 	Start     time.Time `json:"start"`
 	End       time.Time `json:"end"`
+	// AggregationLevel is "namespace" when the pod and storage reports were rolled up before packaging.
+	AggregationLevel string `json:"aggregation_level,omitempty"`
+	// Corrections is true when rows of intervals in earlier packages were replaced by re-collected rows.
+	Corrections bool `json:"corrections"`
 }
 
 type manifestInfo struct {
@@ -115,18 +123,33 @@ func (p *FilePackager) getManifest(archiveFiles map[int]string, filePath string)
 	}
 	p.manifest = manifestInfo{
 		manifest: manifest{
-			UUID:      p.uid,
-			ClusterID: p.KMCfg.Status.ClusterID,
-			Version:   p.KMCfg.Status.OperatorCommit,
-			Date:      manifestDate.UTC(),
-			Files:     manifestFiles,
-			Start:     p.start.UTC(),
-			End:       p.end.UTC(),
+			UUID:             p.uid,
+			ClusterID:        p.KMCfg.Status.ClusterID,
+			Version:          p.KMCfg.Status.OperatorCommit,
+			Date:             manifestDate.UTC(),
+			Files:            manifestFiles,
+			Start:            p.start.UTC(),
+			End:              p.end.UTC(),
+			AggregationLevel: string(p.aggregationLevel()),
+			Corrections:      p.corrections,
 		},
 		filename: filepath.Join(filePath, "manifest.json"),
 	}
 }
 
+// reportName returns the name of a staged report without the uid of the package.
+func (p *FilePackager) reportName(stagedName string) string {
+	return strings.TrimPrefix(stagedName, p.uid+"-")
+}
+
+// aggregationLevel returns the aggregation level of the spec, which defaults to pod.
+func (p *FilePackager) aggregationLevel() kokumetricscfgv1beta1.AggregationLevelType {
+	if p.KMCfg.Spec.Packaging.AggregationLevel == "" {
+		return kokumetricscfgv1beta1.PodAggregationLevel
+	}
+	return p.KMCfg.Spec.Packaging.AggregationLevel
+}
+
 func (p *FilePackager) addFileToTarWriter(uploadName, filePath string, tarWriter *tar.Writer) error {
 	log := p.Log.WithValues("kokumetricsconfig", "addFileToTarWriter")
 	log.Info("adding file to tar.gz", "file", filePath)
@@ -270,7 +293,10 @@ func (p *FilePackager) getStartEnd(filePath string) error {
 	if err != nil {
 		return fmt.Errorf("getStartEnd: error reading file: %v", err)
 	}
-	lastLine := allLines[len(allLines)-1]
+	lastLine := firstLine
+	if len(allLines) > 0 {
+		lastLine = allLines[len(allLines)-1]
+	}
 	endInterval := lastLine[endIndex]
 	p.end, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", endInterval)
 	return nil
@@ -346,7 +372,14 @@ func (p *FilePackager) moveFiles() ([]os.FileInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("moveFiles: could not read reports directory: %v", err)
 	}
-	if len(fileList) <= 0 {
+	// the reports directory also keeps the hidden deduplication index of the reports, which is not packaged
+	var csvFiles []os.FileInfo
+	for _, file := range fileList {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".csv") {
+			csvFiles = append(csvFiles, file)
+		}
+	}
+	if len(csvFiles) <= 0 {
 		return nil, ErrNoReports
 	}
 
@@ -360,10 +393,7 @@ func (p *FilePackager) moveFiles() ([]os.FileInfo, error) {
 	}
 
 	log.Info("moving report files to staging directory")
-	for _, file := range fileList {
-		if !strings.HasSuffix(file.Name(), ".csv") {
-			continue
-		}
+	for _, file := range csvFiles {
 		from := filepath.Join(p.DirCfg.Reports.Path, file.Name())
 		to := filepath.Join(p.DirCfg.Staging.Path, p.uid+"-"+file.Name())
 		if err := os.Rename(from, to); err != nil {
@@ -447,10 +477,25 @@ func (p *FilePackager) PackageReports() error {
 	} else if err != nil {
 		return fmt.Errorf("PackageReports: %v", err)
 	}
+	// the collector leaves a marker when it collected an interval of an earlier package again
+	correctionsFile := filepath.Join(p.DirCfg.Reports.Path, dirconfig.CorrectionsFile)
+	if _, err := os.Stat(correctionsFile); err == nil {
+		log.Info("the reports contain corrected rows")
+		p.corrections = true
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("PackageReports: %v", err)
+	}
+	if p.aggregationLevel() == kokumetricscfgv1beta1.NamespaceAggregationLevel {
+		log.Info("rolling the reports up to namespace level")
+		filesToPackage, err = p.aggregateFiles(filesToPackage)
+		if err != nil {
+			return fmt.Errorf("PackageReports: %v", err)
+		}
+	}
 	// get the start and end dates from the report
 	log.Info("getting the start and end intervals for the manifest")
 	for _, file := range filesToPackage {
-		if strings.Contains(file.Name(), "pod") {
+		if isReport(p.reportName(file.Name()), podReportPrefix) {
 			absPath := filepath.Join(p.DirCfg.Staging.Path, file.Name())
 			if err := p.getStartEnd(absPath); err != nil {
 				return fmt.Errorf("PackageReports: %v", err)
@@ -494,6 +539,12 @@ func (p *FilePackager) PackageReports() error {
 		}
 	}
 
+	if p.corrections {
+		if err := os.Remove(correctionsFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("PackageReports: %v", err)
+		}
+	}
+
 	log.Info("file packaging was successful")
 	p.KMCfg.Status.Packaging.LastSuccessfulPackagingTime = metav1.Now()
 	return nil
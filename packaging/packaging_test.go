@@ -401,6 +401,135 @@ func TestMoveFiles(t *testing.T) {
 	}
 }
 
+func TestMoveFilesSkipsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move-index")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	packager := FilePackager{
+		DirCfg: genDirCfg(t, dir),
+		Log:    testLogger,
+		KMCfg:  &kokumetricscfgv1beta1.KokuMetricsConfig{},
+		uid:    uuid.New().String(),
+	}
+	// the deduplication index of the reports is kept in a hidden directory of the reports directory
+	if err := os.MkdirAll(filepath.Join(packager.DirCfg.Reports.Path, ".index", "report.csv"), os.ModePerm); err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	if _, err := packager.moveFiles(); err != ErrNoReports {
+		t.Errorf("moveFiles with only the index got %v want %v", err, ErrNoReports)
+	}
+	if err := ioutil.WriteFile(filepath.Join(packager.DirCfg.Reports.Path, "report.csv"), []byte("header\n"), 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	moved, err := packager.moveFiles()
+	if err != nil {
+		t.Fatalf("moveFiles got unexpected error: %v", err)
+	}
+	if len(moved) != 1 || moved[0].Name() != packager.uid+"-report.csv" {
+		t.Errorf("moveFiles moved %v want only the report", moved)
+	}
+	if _, err := os.Stat(filepath.Join(packager.DirCfg.Reports.Path, ".index")); err != nil {
+		t.Errorf("the index was moved: %v", err)
+	}
+}
+
+func TestPackageReportsCorrections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corrections")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := genDirCfg(t, dir)
+	for _, d := range []string{cfg.Reports.Path, cfg.Staging.Path, cfg.Upload.Path} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	correctionsFile := filepath.Join(cfg.Reports.Path, dirconfig.CorrectionsFile)
+	if err := ioutil.WriteFile(correctionsFile, nil, 0644); err != nil {
+		t.Fatalf("failed to write corrections marker: %v", err)
+	}
+
+	for _, want := range []bool{true, false} {
+		report := testPodHeader + "\n" + testDates + ",node-1,shop,web-1,1.000000,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,\n"
+		if err := ioutil.WriteFile(filepath.Join(cfg.Reports.Path, "cm-openshift-pod-usage-202101.csv"), []byte(report), 0644); err != nil {
+			t.Fatalf("failed to write report: %v", err)
+		}
+		maxSize := int64(100)
+		cr := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+		cr.Status.Packaging.MaxSize = &maxSize
+		p := FilePackager{KMCfg: cr, DirCfg: cfg, Log: testLogger}
+		if err := p.PackageReports(); err != nil {
+			t.Fatalf("PackageReports got unexpected error: %v", err)
+		}
+		manifestData, err := ioutil.ReadFile(p.manifest.filename)
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+		var found manifest
+		if err := json.Unmarshal(manifestData, &found); err != nil {
+			t.Fatalf("failed to unmarshal manifest: %v", err)
+		}
+		if found.Corrections != want {
+			t.Errorf("manifest corrections got %t want %t", found.Corrections, want)
+		}
+		// the corrections are only declared in the next package
+		if _, err := os.Stat(correctionsFile); !os.IsNotExist(err) {
+			t.Errorf("the corrections marker was not removed: %v", err)
+		}
+	}
+}
+
+func TestPackageReportsManifestDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-dates")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := genDirCfg(t, dir)
+	for _, d := range []string{cfg.Reports.Path, cfg.Staging.Path, cfg.Upload.Path} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	reports := map[string]string{
+		"cm-openshift-pod-usage-202101.csv": testPodHeader + "\n" + testDates + ",node-1,shop,web-1,1.000000,2.000000,,100.000000,200.000000,,4.000000,14400.000000,1024.000000,3686400.000000,i-1,\n",
+		// a custom report whose name starts with pod, and sorts after the pod report, has other intervals
+		"cm-openshift-pod-vgpu-usage-202101.csv": "report_period_start,report_period_end,interval_start,interval_end,pod,gpu\n" +
+			"2021-01-01 00:00:00 +0000 UTC,2021-02-01 00:00:00 +0000 UTC,2021-01-02 00:00:00 +0000 UTC,2021-01-02 00:59:59 +0000 UTC,web-1,1.000000\n",
+	}
+	for name, report := range reports {
+		if err := ioutil.WriteFile(filepath.Join(cfg.Reports.Path, name), []byte(report), 0644); err != nil {
+			t.Fatalf("failed to write report: %v", err)
+		}
+	}
+	maxSize := int64(100)
+	cr := &kokumetricscfgv1beta1.KokuMetricsConfig{}
+	cr.Status.Packaging.MaxSize = &maxSize
+	p := FilePackager{KMCfg: cr, DirCfg: cfg, Log: testLogger}
+	if err := p.PackageReports(); err != nil {
+		t.Fatalf("PackageReports got unexpected error: %v", err)
+	}
+	manifestData, err := ioutil.ReadFile(p.manifest.filename)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var found manifest
+	if err := json.Unmarshal(manifestData, &found); err != nil {
+		t.Fatalf("failed to unmarshal manifest: %v", err)
+	}
+	wantStart := time.Date(2021, 1, 5, 18, 0, 0, 0, time.UTC)
+	wantEnd := time.Date(2021, 1, 5, 18, 59, 59, 0, time.UTC)
+	if !found.Start.Equal(wantStart) || !found.End.Equal(wantEnd) {
+		t.Errorf("manifest got start %v end %v want start %v end %v", found.Start, found.End, wantStart, wantEnd)
+	}
+	if len(found.Files) != 2 {
+		t.Errorf("manifest got files %v want both reports", found.Files)
+	}
+}
+
 func TestPackagingReports(t *testing.T) {
 	// create the packagingReports tests
 	packagingReportTests := []struct {
@@ -0,0 +1,68 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package prompb holds the messages of the Prometheus remote read protocol. The types mirror
+// github.com/prometheus/prometheus/prompb (remote.proto and types.proto) with the same field numbers, and are encoded
+// with github.com/gogo/protobuf/proto.
+//
+// The upstream package is not imported because every prometheus/prometheus release that provides it requires newer
+// client-go, apimachinery and client_golang versions than controller-runtime v0.6 supports, and it would pull the
+// whole Prometheus server module into the operator for a handful of messages. Only the messages used by a SAMPLES
+// read are copied; the wire format is checked byte for byte in remote_test.go.
+package prompb
+
+import (
+	"github.com/gogo/protobuf/proto"
+)
+
+// ReadRequest_ResponseType is the response type a client accepts.
+type ReadRequest_ResponseType int32
+
+const (
+	// ReadRequest_SAMPLES is a ReadResponse with the raw samples of each series.
+	ReadRequest_SAMPLES ReadRequest_ResponseType = 0
+	// ReadRequest_STREAMED_XOR_CHUNKS is a stream of ChunkedReadResponse messages, which is not supported.
+	ReadRequest_STREAMED_XOR_CHUNKS ReadRequest_ResponseType = 1
+)
+
+// ReadRequest is the body of a remote read request.
+type ReadRequest struct {
+	Queries               []*Query                   `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
+	AcceptedResponseTypes []ReadRequest_ResponseType `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes,proto3,enum=prometheus.ReadRequest_ResponseType" json:"accepted_response_types,omitempty"`
+}
+
+func (m *ReadRequest) Reset()         { *m = ReadRequest{} }
+func (m *ReadRequest) String() string { return proto.CompactTextString(m) }
+func (*ReadRequest) ProtoMessage()    {}
+
+// ReadResponse is the SAMPLES response of a remote read request, with one result per query.
+type ReadResponse struct {
+	Results []*QueryResult `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+}
+
+func (m *ReadResponse) Reset()         { *m = ReadResponse{} }
+func (m *ReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ReadResponse) ProtoMessage()    {}
+
+// Query selects the series matching all matchers within the time range.
+type Query struct {
+	StartTimestampMs int64           `protobuf:"varint,1,opt,name=start_timestamp_ms,json=startTimestampMs,proto3" json:"start_timestamp_ms,omitempty"`
+	EndTimestampMs   int64           `protobuf:"varint,2,opt,name=end_timestamp_ms,json=endTimestampMs,proto3" json:"end_timestamp_ms,omitempty"`
+	Matchers         []*LabelMatcher `protobuf:"bytes,3,rep,name=matchers,proto3" json:"matchers,omitempty"`
+	Hints            *ReadHints      `protobuf:"bytes,4,opt,name=hints,proto3" json:"hints,omitempty"`
+}
+
+func (m *Query) Reset()         { *m = Query{} }
+func (m *Query) String() string { return proto.CompactTextString(m) }
+func (*Query) ProtoMessage()    {}
+
+// QueryResult holds the series selected by a query.
+type QueryResult struct {
+	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+}
+
+func (m *QueryResult) Reset()         { *m = QueryResult{} }
+func (m *QueryResult) String() string { return proto.CompactTextString(m) }
+func (*QueryResult) ProtoMessage()    {}
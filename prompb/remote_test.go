@@ -0,0 +1,73 @@
+//
+// Copyright 2021 Red Hat Inc.
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package prompb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestWireFormat(t *testing.T) {
+	wireFormatTests := []struct {
+		name string
+		msg  proto.Message
+		new  proto.Message
+		want []byte
+	}{
+		{
+			name: "read request",
+			msg: &ReadRequest{
+				Queries: []*Query{{
+					StartTimestampMs: 1,
+					EndTimestampMs:   2,
+					Matchers:         []*LabelMatcher{{Type: LabelMatcher_NEQ, Name: "a", Value: "b"}},
+				}},
+				AcceptedResponseTypes: []ReadRequest_ResponseType{ReadRequest_SAMPLES},
+			},
+			new: &ReadRequest{},
+			want: []byte{
+				0x0a, 0x0e, // queries
+				0x08, 0x01, 0x10, 0x02, // start and end
+				0x1a, 0x08, 0x08, 0x01, 0x12, 0x01, 'a', 0x1a, 0x01, 'b', // matcher
+				0x12, 0x01, 0x00, // packed accepted response types
+			},
+		},
+		{
+			name: "read response",
+			msg: &ReadResponse{Results: []*QueryResult{{Timeseries: []*TimeSeries{{
+				Labels:  []*Label{{Name: "a", Value: "b"}},
+				Samples: []*Sample{{Value: 1, Timestamp: 2}},
+			}}}}},
+			new: &ReadResponse{},
+			want: []byte{
+				0x0a, 0x17, // results
+				0x0a, 0x15, // timeseries
+				0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b', // label
+				0x12, 0x0b, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x02, // sample
+			},
+		},
+	}
+	for _, tt := range wireFormatTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proto.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%s got %x want %x", tt.name, got, tt.want)
+			}
+			if err := proto.Unmarshal(tt.want, tt.new); err != nil {
+				t.Fatalf("%s got unexpected error: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(tt.new, tt.msg) {
+				t.Errorf("%s decoded %v want %v", tt.name, tt.new, tt.msg)
+			}
+		})
+	}
+}